@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// AsyncQueueSize is the number of asynchronous requests that can wait for the
+// host at the same time.
+const AsyncQueueSize = 64
+
+var (
+	// ErrTryAgain is returned when an asynchronous request cannot be queued
+	// yet, or its result was asked for before it completed.
+	ErrTryAgain        = errors.New("resource temporarily unavailable")
+	ErrAsyncInProgress = errors.New("asynchronous I/O is in progress")
+)
+
+// AsyncResult is what a completed request left for the program to fetch with
+// ARESULT: the number of bytes transferred and the error code.
+type AsyncResult struct {
+	N    uint32
+	Code uint32
+}
+
+type asyncRequest struct {
+	ID    uint32
+	File  *OpenFile
+	Write bool
+	Data  []byte
+	Addr  uint32
+	N     int
+	Err   error
+	// Requests on the console are carried out by the CPU, since printing
+	// writes to video memory
+	onCPU bool
+	done  chan struct{}
+}
+
+// AsyncIO runs the AREAD and AWRITE requests of a CPU on a host goroutine,
+// one at a time in the order they were queued, while the program keeps
+// running. Finished requests wait until the CPU hands them back to the
+// program between two instructions, so memory is only ever touched by the
+// CPU. The worker goroutine only runs while there are requests to carry out.
+type AsyncIO struct {
+	Results map[uint32]AsyncResult
+	NextID  uint32
+
+	mu       sync.Mutex
+	queue    []*asyncRequest
+	running  *asyncRequest
+	finished []*asyncRequest
+	working  bool
+}
+
+func NewAsyncIO() *AsyncIO {
+	return &AsyncIO{
+		Results: make(map[uint32]AsyncResult),
+		NextID:  1,
+	}
+}
+
+// Submit queues a request and returns its id. Ids start at 1, so 0 is never
+// a valid request id.
+func (a *AsyncIO) Submit(file *OpenFile, write bool, data []byte, addr uint32) (uint32, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.outstanding() >= AsyncQueueSize {
+		return 0, ErrTryAgain
+	}
+	_, console := file.FS.(*Console)
+	r := &asyncRequest{ID: a.NextID, File: file, Write: write, Data: data, Addr: addr, onCPU: console}
+	a.NextID++
+	if a.NextID == 0 {
+		a.NextID = 1
+	}
+	if r.onCPU {
+		a.finished = append(a.finished, r)
+		return r.ID, nil
+	}
+	a.queue = append(a.queue, r)
+	if !a.working {
+		a.working = true
+		go a.work()
+	}
+	return r.ID, nil
+}
+
+// work carries out queued requests until there are none left.
+func (a *AsyncIO) work() {
+	for {
+		a.mu.Lock()
+		if len(a.queue) == 0 {
+			a.working = false
+			a.mu.Unlock()
+			return
+		}
+		r := a.queue[0]
+		a.queue = a.queue[1:]
+		a.running = r
+		r.done = make(chan struct{})
+		a.mu.Unlock()
+
+		if r.File != nil {
+			r.transfer()
+		}
+
+		a.mu.Lock()
+		a.running = nil
+		a.finished = append(a.finished, r)
+		close(r.done)
+		a.mu.Unlock()
+	}
+}
+
+func (r *asyncRequest) transfer() {
+	if r.Write {
+		r.N, r.Err = r.File.FS.Write(r.File.File, r.Data)
+	} else {
+		r.N, r.Err = r.File.FS.Read(r.File.File, r.Data)
+		if r.Err == io.EOF && r.N > 0 {
+			r.Err = nil
+		}
+	}
+}
+
+// Cancel fails the queued requests for file with EBADF instead of carrying
+// them out, since the file is about to be closed. A request on the file that
+// is already running is waited for. A nil file cancels every request.
+func (a *AsyncIO) Cancel(file *OpenFile) {
+	a.mu.Lock()
+	cancel := func(r *asyncRequest) {
+		if file == nil || r.File == file {
+			r.File = nil
+			r.Err = ErrBadFileDescriptor
+		}
+	}
+	for _, r := range a.queue {
+		cancel(r)
+	}
+	for _, r := range a.finished {
+		if r.onCPU {
+			cancel(r)
+		}
+	}
+	var running chan struct{}
+	if r := a.running; r != nil && (file == nil || r.File == file) {
+		running = r.done
+	}
+	a.mu.Unlock()
+	if running != nil {
+		<-running
+	}
+}
+
+// next removes the oldest finished request and returns it, or nil if there
+// is none.
+func (a *AsyncIO) next() *asyncRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.finished) == 0 {
+		return nil
+	}
+	r := a.finished[0]
+	a.finished = a.finished[1:]
+	return r
+}
+
+// Outstanding returns the number of requests that were queued but not handed
+// back to the program yet.
+func (a *AsyncIO) Outstanding() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.outstanding()
+}
+
+func (a *AsyncIO) outstanding() int {
+	n := len(a.queue) + len(a.finished)
+	if a.running != nil {
+		n++
+	}
+	return n
+}
+
+// fork copies the results that were not fetched yet. It must only be called
+// while no requests are outstanding.
+func (a *AsyncIO) fork() *AsyncIO {
+	f := NewAsyncIO()
+	f.NextID = a.NextID
+	for id, res := range a.Results {
+		f.Results[id] = res
+	}
+	return f
+}
+
+// Result returns and forgets the result of a completed request.
+func (a *AsyncIO) Result(id uint32) (AsyncResult, error) {
+	if res, ok := a.Results[id]; ok {
+		delete(a.Results, id)
+		return res, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running != nil && a.running.ID == id {
+		return AsyncResult{}, ErrTryAgain
+	}
+	for _, requests := range [][]*asyncRequest{a.queue, a.finished} {
+		for _, r := range requests {
+			if r.ID == id {
+				return AsyncResult{}, ErrTryAgain
+			}
+		}
+	}
+	return AsyncResult{}, ErrInvalid
+}
+
+// pollAsync hands the requests that finished since the last instruction back
+// to the program. Console requests are carried out here.
+func (c *CPU) pollAsync() {
+	for r := c.AsyncIO.next(); r != nil; r = c.AsyncIO.next() {
+		if r.onCPU && r.File != nil {
+			r.transfer()
+		}
+		c.completeAsync(r)
+	}
+}
+
+// completeAsync hands a finished request back to the program. Read data is
+// copied into memory before the interrupt is raised, so the handler can use
+// it right away.
+func (c *CPU) completeAsync(r *asyncRequest) {
+	if !r.Write {
+		for i, b := range r.Data[:r.N] {
+			c.MemoryManager.WriteMemory(r.Addr+uint32(i), b)
+		}
+	}
+	c.AsyncIO.Results[r.ID] = AsyncResult{N: uint32(r.N), Code: ErrorCode(r.Err)}
+	c.RaiseInterrupt(InterruptIOComplete, r.ID)
+}
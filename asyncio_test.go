@@ -0,0 +1,231 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const asyncTestProgram = `
+.DATA
+    msg DB "hello", 0
+    buffer DB "xxxxxxxx", 0
+    name DB "data.txt", 0
+.TEXT
+    LD R0 io
+    ST [0x88000008] R0
+    LD R0 key
+    ST [0x88000001] R0
+    LD R1 1
+    AWRITE R1 [msg] 5
+    AWRITE R1 [msg] 5
+    OPEN R2 [name]
+    AREAD R2 [buffer] 8
+    AREAD R2 [buffer] 8
+wait:
+    CMP R7 4
+    JNE wait
+    CMP R8 5
+    JNE wait
+    HLT
+
+io:
+    INC R7
+    RET
+key:
+    INC R8
+    RET
+`
+
+// assemble assembles a test program.
+func assemble(t *testing.T, program string) *Bytecode {
+	t.Helper()
+	source := filepath.Join(t.TempDir(), "test.asm")
+	if err := os.WriteFile(source, []byte(program), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := NewParser()
+	p.AddFile(source)
+	p.Parse()
+	if p.HasErrors() {
+		p.WriteDiagnostics(os.Stderr)
+		t.Fatal("failed to assemble test program")
+	}
+	return ProgramToBytecode(p)
+}
+
+// runUntilHalted steps the CPU until it halts, failing the test if it takes
+// longer than a few seconds.
+func runUntilHalted(t *testing.T, c *CPU) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.Halted && time.Now().Before(deadline) {
+		c.Step()
+	}
+	if !c.Halted || c.Fault != nil {
+		t.Fatalf("program did not finish: halted %v, fault %v", c.Halted, c.Fault)
+	}
+}
+
+// blockingVFS is a MemoryVFS whose reads only go ahead once the test
+// releases them.
+type blockingVFS struct {
+	*MemoryVFS
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingVFS() *blockingVFS {
+	fs := &blockingVFS{
+		MemoryVFS: NewMemoryVFS(),
+		started:   make(chan struct{}, AsyncQueueSize),
+		release:   make(chan struct{}),
+	}
+	fs.AddFile("data.txt", []byte("0123456789"))
+	return fs
+}
+
+func (vfs *blockingVFS) Read(file interface{}, b []byte) (int, error) {
+	vfs.started <- struct{}{}
+	<-vfs.release
+	return vfs.MemoryVFS.Read(file, b)
+}
+
+// TestAsyncIOWithKeyboard runs asynchronous requests against the console and a
+// file while keys are pressed on another goroutine. Run with -race to check
+// that the I/O on the host goroutine does not race with the CPU.
+func TestAsyncIOWithKeyboard(t *testing.T) {
+	fs := NewMemoryVFS()
+	fs.AddFile("data.txt", []byte("0123456789"))
+	c := NewCPU()
+	c.FileSystem = fs
+	c.LoadProgram(assemble(t, asyncTestProgram))
+
+	// Install the interrupt handlers before pressing any keys
+	for i := 0; i < 4; i++ {
+		c.Step()
+	}
+	go func() {
+		for _, key := range []string{"a", "b", "c", "d", "e"} {
+			c.InputQueue <- key
+		}
+	}()
+	runUntilHalted(t, c)
+
+	if got := string(c.MemoryManager.ReadMemoryN(VRAMStart, 10)); got != "hellohello" {
+		t.Errorf("console shows %q, want %q", got, "hellohello")
+	}
+}
+
+const slowReadProgram = `
+.DATA
+    buffer DB "xxxxxxxx", 0
+    name DB "data.txt", 0
+.TEXT
+    LD R0 io
+    ST [0x88000008] R0
+    OPEN R2 [name]
+    AREAD R2 [buffer] 8
+spin:
+    INC R3
+    CMP R7 1
+    JNE spin
+    LD R4 [buffer]
+    HLT
+
+io:
+    INC R7
+    RET
+`
+
+// TestAsyncIOSlowRead checks that the program keeps running while the host is
+// stuck in a read.
+func TestAsyncIOSlowRead(t *testing.T) {
+	fs := newBlockingVFS()
+	c := NewCPU()
+	c.FileSystem = fs
+	c.LoadProgram(assemble(t, slowReadProgram))
+
+	stepped := make(chan bool)
+	go func() {
+		// Run until the read has started, then some more
+		for started := false; !started; {
+			select {
+			case <-fs.started:
+				started = true
+			default:
+				c.Step()
+			}
+		}
+		for i := 0; i < 1000; i++ {
+			c.Step()
+		}
+		stepped <- true
+	}()
+	select {
+	case <-stepped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Step blocked while a read was in progress")
+	}
+	if c.Registers[3] < 100 || c.Registers[7] != 0 {
+		t.Fatalf("R3 = %d and R7 = %d while the read was in progress", c.Registers[3], c.Registers[7])
+	}
+
+	close(fs.release)
+	runUntilHalted(t, c)
+	if c.Registers[4] != 0x33323130 {
+		t.Errorf("buffer starts with %08x, want the data read", c.Registers[4])
+	}
+}
+
+// TestAsyncIOCancelOnClose closes a file while one request on it is running
+// and another one is queued. Closing waits for the running request, and the
+// queued one fails with EBADF.
+func TestAsyncIOCancelOnClose(t *testing.T) {
+	fs := newBlockingVFS()
+	c := NewCPU()
+	c.FileSystem = fs
+	file, err := fs.Open("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := c.FileTable.Add(fs, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := c.FileTable.Get(fd)
+	running, err := c.AsyncIO.Submit(f, false, make([]byte, 4), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := c.AsyncIO.Submit(f, false, make([]byte, 4), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-fs.started
+
+	closed := make(chan error)
+	go func() { closed <- c.CloseFile(fd) }()
+	select {
+	case <-closed:
+		t.Fatal("closing did not wait for the running request")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(fs.release)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	c.pollAsync()
+
+	want := map[uint32]AsyncResult{running: {N: 4, Code: ENONE}, queued: {N: 0, Code: EBADF}}
+	for id, res := range want {
+		if got := c.AsyncIO.Results[id]; got != res {
+			t.Errorf("request %d finished with %+v, want %+v", id, got, res)
+		}
+	}
+	got := c.queuedInterrupts()
+	if len(got) != 2 || got[0] != (Interrupt{Vector: InterruptIOComplete, Data: running}) || got[1] != (Interrupt{Vector: InterruptIOComplete, Data: queued}) {
+		t.Errorf("queued interrupts are %v, want the completion of requests %d and %d", got, running, queued)
+	}
+}
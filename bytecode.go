@@ -11,6 +11,7 @@ type Bytecode struct {
 	Version      uint32
 	SectorCount  uint8
 	StartAddress uint32
+	StackSize    uint32
 	Sectors      []BCSector
 }
 
@@ -24,7 +25,7 @@ func NewBytecode(magicNumber uint32) *Bytecode {
 	return &Bytecode{
 		MagicNumber: magicNumber,
 		SectorCount: 0,
-		Version:     2,
+		Version:     3,
 		Sectors:     []BCSector{},
 	}
 }
@@ -76,6 +77,11 @@ func EncodeBytecode(bc *Bytecode) ([]byte, error) {
 		return nil, err
 	}
 
+	err = binary.Write(buffer, binary.LittleEndian, bc.StackSize)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, sector := range bc.Sectors {
 		err := binary.Write(buffer, binary.LittleEndian, sector.StartAddress)
 		if err != nil {
@@ -114,7 +120,8 @@ func DecodeBytecode(data []byte) (*Bytecode, error) {
 		return nil, err
 	}
 
-	if bc.Version != NewBytecode(0).Version {
+	// Version 2 is the same format without the stack size field
+	if bc.Version != NewBytecode(0).Version && bc.Version != 2 {
 		return nil, fmt.Errorf("This bytecode was generated for a different version of the VM")
 	}
 
@@ -129,6 +136,13 @@ func DecodeBytecode(data []byte) (*Bytecode, error) {
 		return nil, err
 	}
 
+	if bc.Version >= 3 {
+		err = binary.Read(buffer, binary.LittleEndian, &bc.StackSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	for i := 0; i < int(bc.SectorCount); i++ {
 		sector := BCSector{}
 
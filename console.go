@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// The console shows text in the top left corner of the video buffer.
+const (
+	ConsoleColumns = 40
+	ConsoleRows    = 24
+)
+
+var ErrNotSupported = errors.New("operation not supported")
+
+// Console is the device behind the standard file descriptors 0, 1 and 2.
+// Writing to it prints text to the video buffer, scrolling once the last row
+// is full. It has no input, keyboard input is delivered through interrupt 1.
+// Since it writes to memory, it is only ever used by the CPU itself, which
+// also carries out asynchronous requests on it.
+type Console struct {
+	cpu    *CPU
+	Cursor uint32
+}
+
+func NewConsole(cpu *CPU) *Console {
+	return &Console{cpu: cpu}
+}
+
+func (c *Console) put(b byte) {
+	switch b {
+	case '\n':
+		c.Cursor = (c.Cursor/ConsoleColumns + 1) * ConsoleColumns
+	case '\r':
+		c.Cursor = c.Cursor / ConsoleColumns * ConsoleColumns
+	case '\b':
+		if c.Cursor%ConsoleColumns > 0 {
+			c.Cursor--
+			c.cpu.MemoryManager.WriteMemory(VRAMStart+c.Cursor, 0)
+		}
+	default:
+		c.cpu.MemoryManager.WriteMemory(VRAMStart+c.Cursor, b)
+		c.Cursor++
+	}
+
+	if c.Cursor >= ConsoleColumns*ConsoleRows {
+		c.scroll()
+	}
+}
+
+func (c *Console) scroll() {
+	mm := c.cpu.MemoryManager
+	for i := uint32(0); i < ConsoleColumns*(ConsoleRows-1); i++ {
+		mm.WriteMemory(VRAMStart+i, mm.ReadMemory(VRAMStart+ConsoleColumns+i))
+	}
+	for i := ConsoleColumns * (ConsoleRows - 1); i < ConsoleColumns*ConsoleRows; i++ {
+		mm.WriteMemory(VRAMStart+uint32(i), 0)
+	}
+	c.Cursor -= ConsoleColumns
+}
+
+func (c *Console) Open(string) (interface{}, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *Console) Close(interface{}) error {
+	return nil
+}
+
+func (c *Console) Create(string) (interface{}, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *Console) Remove(string) error {
+	return ErrNotSupported
+}
+
+func (c *Console) Rename(string, string) error {
+	return ErrNotSupported
+}
+
+func (c *Console) Mkdir(string) error {
+	return ErrNotSupported
+}
+
+func (c *Console) Stat(string) (*FileInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *Console) ReadDir(string) ([]*FileInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *Console) Read(interface{}, []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *Console) Write(_ interface{}, b []byte) (int, error) {
+	for _, v := range b {
+		c.put(v)
+	}
+	return len(b), nil
+}
+
+func (c *Console) ReadAt(interface{}, []byte, int64) (int, error) {
+	return 0, ErrNotSupported
+}
+
+func (c *Console) WriteAt(interface{}, []byte, int64) (int, error) {
+	return 0, ErrNotSupported
+}
+
+func (c *Console) Seek(interface{}, int64, int) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (c *Console) LoadBinary(interface{}, *MemoryManager) (*ProgramInfo, error) {
+	return nil, ErrNotSupported
+}
@@ -3,6 +3,13 @@ package main
 import (
 	"fmt"
 	"strings"
+	"sync"
+)
+
+// Interrupts raised by the VM itself.
+const (
+	InterruptKeyboard   uint32 = 1
+	InterruptIOComplete uint32 = 8
 )
 
 const (
@@ -11,33 +18,49 @@ const (
 	KeyUp    uint32 = 0x03 << 24
 )
 
+// Interrupt is a hardware interrupt waiting to be delivered to the program.
+type Interrupt struct {
+	Vector uint32
+	Data   uint32
+}
+
 type CPU struct {
-	MemoryManager       *MemoryManager
-	Registers           [19]uint32 // 0-15: General purpose (15 can be overwritten by interrupts), 16: Instruction register, 17: Stack pointer, 18: Heap pointer
-	Halted              bool
-	LastAccessedAddress uint32
-	FileSystem          VFS
-	FileTable           map[uint32]interface{}
-	NextFD              uint32
-	InputQueue          chan string
-	InterruptPending    bool
-	InterruptProcessing bool
-	OriginalPC          uint32
-	InterruptVector     uint32
-	InterruptData       uint32
-	InterruptReturned   chan bool
+	MemoryManager          *MemoryManager
+	Scheduler              *Scheduler
+	Registers              [20]uint32 // 0-15: General purpose (15 can be overwritten by interrupts), 16: Instruction register, 17: Stack pointer, 18: Heap pointer, 19: Error register
+	Halted                 bool
+	Fault                  error
+	LastAccessedAddress    uint32
+	LastInstructionAddress uint32
+	LeakReport             string
+	FileSystem             VFS
+	FileTable              *FileTable
+	Console                *Console
+	AsyncIO                *AsyncIO
+	InputQueue             chan string
+	InterruptPending       bool
+	InterruptProcessing    bool
+	OriginalPC             uint32
+	InterruptVector        uint32
+	InterruptData          uint32
+	InterruptReturned      chan bool
+	Interrupts             []Interrupt
+	interruptMu            sync.Mutex
 }
 
 func NewCPU() *CPU {
 	cpu := &CPU{
-		Registers:         [19]uint32{},
+		Registers:         [20]uint32{},
 		Halted:            false,
-		FileTable:         make(map[uint32]interface{}),
-		NextFD:            0,
+		FileTable:         NewFileTable(DefaultMaxFiles),
+		AsyncIO:           NewAsyncIO(),
 		InputQueue:        make(chan string),
 		InterruptReturned: make(chan bool),
 	}
 	cpu.MemoryManager = NewMemoryManager(cpu, NewMemory())
+	cpu.Scheduler = NewScheduler(cpu)
+	cpu.Console = NewConsole(cpu)
+	cpu.openStandardFiles()
 	go cpu.KeyboardInputLoop()
 	return cpu
 }
@@ -140,29 +163,89 @@ func (c *CPU) processKeyEvent(event string) {
 		}
 	}
 
+	c.RaiseInterrupt(InterruptKeyboard, eventType|asciiCode)
+}
+
+// RaiseInterrupt queues an interrupt for the program. It is safe to call from
+// any goroutine. Queued interrupts are delivered one at a time, in the order
+// they were raised, once the handler of the previous one has returned.
+func (c *CPU) RaiseInterrupt(vector uint32, data uint32) {
+	c.interruptMu.Lock()
+	defer c.interruptMu.Unlock()
+	c.Interrupts = append(c.Interrupts, Interrupt{Vector: vector, Data: data})
+}
+
+// queuedInterrupts returns a copy of the interrupts that were not delivered
+// yet.
+func (c *CPU) queuedInterrupts() []Interrupt {
+	c.interruptMu.Lock()
+	defer c.interruptMu.Unlock()
+	return append([]Interrupt{}, c.Interrupts...)
+}
+
+// nextInterrupt makes the oldest queued interrupt pending.
+func (c *CPU) nextInterrupt() {
+	c.interruptMu.Lock()
+	defer c.interruptMu.Unlock()
+	if len(c.Interrupts) == 0 {
+		return
+	}
 	c.InterruptPending = true
-	c.InterruptVector = 1
-	c.InterruptData = eventType | asciiCode
+	c.InterruptVector = c.Interrupts[0].Vector
+	c.InterruptData = c.Interrupts[0].Data
+	c.Interrupts = c.Interrupts[1:]
+}
+
+// RaiseFault halts the CPU because the guest did something it cannot recover
+// from, like overflowing its stack.
+func (c *CPU) RaiseFault(err error) {
+	c.Fault = err
+	c.Halted = true
+}
+
+// Supervisor reports whether the CPU is running in supervisor mode, which is
+// the case while it executes code from ROM.
+func (c *CPU) Supervisor() bool {
+	return c.LastInstructionAddress >= ROMStart && c.LastInstructionAddress <= ROMEnd
 }
 
 func (c *CPU) Reset() {
-	c.Registers = [19]uint32{}
+	c.Registers = [20]uint32{}
+	stackSize := c.MemoryManager.StackSize
 	c.MemoryManager = NewMemoryManager(c, NewMemory())
+	c.MemoryManager.StackSize = stackSize
+	timeSlice := c.Scheduler.TimeSlice
+	c.Scheduler = NewScheduler(c)
+	c.Scheduler.TimeSlice = timeSlice
 	c.Halted = false
-	for _, v := range c.FileTable {
-		if v == nil {
-			continue
-		}
-		c.FileSystem.Close(v)
+	c.Fault = nil
+	c.LeakReport = ""
+	c.AsyncIO.Cancel(nil)
+	c.FileTable.CloseAll()
+	c.FileTable = NewFileTable(c.FileTable.Limit)
+	c.Console = NewConsole(c)
+	c.openStandardFiles()
+	c.AsyncIO = NewAsyncIO()
+	c.interruptMu.Lock()
+	c.Interrupts = nil
+	c.interruptMu.Unlock()
+}
+
+// openStandardFiles opens file descriptors 0, 1 and 2 on the console.
+func (c *CPU) openStandardFiles() {
+	for i := 0; i < 3; i++ {
+		c.FileTable.Add(c.Console, nil)
 	}
-	c.FileTable = make(map[uint32]interface{})
-	c.NextFD = 0
 }
 
 func (c *CPU) Step() {
 	if c.Halted {
 		return
 	}
+	c.pollAsync()
+	if !c.InterruptPending && !c.InterruptProcessing {
+		c.nextInterrupt()
+	}
 	if c.InterruptPending {
 		c.InterruptPending = false
 		c.InterruptProcessing = true
@@ -178,6 +261,7 @@ func (c *CPU) Step() {
 	} else {
 		c.InterruptReturned <- true
 	}
+	c.LastInstructionAddress = c.Registers[16]
 	instr := DecodeInstruction(c.MemoryManager, &c.Registers[16])
 	instr.Execute(c, instr.Operands)
 	if c.InterruptProcessing {
@@ -186,9 +270,18 @@ func (c *CPU) Step() {
 			c.InterruptReturned <- true
 		}
 	}
+	if !c.Halted {
+		c.Scheduler.Tick()
+	}
 }
 
-func (c *CPU) LoadProgram(program *Bytecode) {
+func (c *CPU) LoadProgram(program *Bytecode) error {
+	if program.StackSize != 0 {
+		if err := c.MemoryManager.SetStackSize(program.StackSize); err != nil {
+			return err
+		}
+	}
+
 	var p *ProgramInfo
 	for _, sector := range program.Sectors {
 		if sector.Bytecode != nil {
@@ -208,9 +301,13 @@ func (c *CPU) LoadProgram(program *Bytecode) {
 	c.Registers[16] = program.StartAddress
 
 	if p != nil {
-		start := c.MemoryManager.LoadProgram(p)
+		start, err := c.MemoryManager.LoadProgram(p)
+		if err != nil {
+			return err
+		}
 		if c.Registers[16] < 0x80000000 {
 			c.Registers[16] = start
 		}
 	}
+	return nil
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is a problem found while assembling. Line and Col start at 1,
+// and are 0 when the problem is not about a specific line or column.
+type Diagnostic struct {
+	File     string
+	Line     int
+	Col      int
+	Severity Severity
+	Message  string
+
+	source string
+	notes  []string
+}
+
+func (d Diagnostic) String() string {
+	var b strings.Builder
+	if d.File != "" {
+		b.WriteString(d.File)
+	} else {
+		b.WriteString("<input>")
+	}
+	if d.Line > 0 {
+		fmt.Fprintf(&b, ":%d", d.Line)
+		if d.Col > 0 {
+			fmt.Fprintf(&b, ":%d", d.Col)
+		}
+	}
+	fmt.Fprintf(&b, ": %s: %s", d.Severity, d.Message)
+	return b.String()
+}
+
+// Format returns the diagnostic followed by the line it is about, with a
+// caret under the offending column.
+func (d Diagnostic) Format() string {
+	if d.Line == 0 {
+		return d.String()
+	}
+	var b strings.Builder
+	b.WriteString(d.String())
+	b.WriteString("\n    ")
+	b.WriteString(d.source)
+	if d.Col > 0 {
+		b.WriteString("\n    ")
+		// Keep tabs so the caret lines up with the source
+		for i := 0; i < d.Col-1 && i < len(d.source); i++ {
+			if d.source[i] == '\t' {
+				b.WriteByte('\t')
+			} else {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteByte('^')
+	}
+	for _, note := range d.notes {
+		b.WriteString("\n    note: ")
+		b.WriteString(note)
+	}
+	return b.String()
+}
+
+// position is where a problem was found, kept for problems that are only
+// detected once all files are parsed, like unknown labels.
+type position struct {
+	file   string
+	line   int
+	col    int
+	source string
+	notes  []string
+}
+
+// pos returns the position of a column in the line being parsed. Inside a
+// macro, it also lists where the macro was used.
+func (p *Parser) pos(col int) position {
+	pos := position{file: p.file, line: p.line, col: col, source: p.source}
+	for i := len(p.expansions) - 1; i >= 0; i-- {
+		e := p.expansions[i]
+		if e.name == "" {
+			pos.notes = append(pos.notes, fmt.Sprintf("included from %s:%d", e.file, e.line))
+		} else {
+			pos.notes = append(pos.notes, fmt.Sprintf("in expansion of macro %s at %s:%d", e.name, e.file, e.line))
+		}
+	}
+	if len(pos.notes) > 5 {
+		skipped := len(pos.notes) - 4
+		pos.notes = append(pos.notes[:3:3], fmt.Sprintf("... %d more expansions", skipped), pos.notes[len(pos.notes)-1])
+	}
+	return pos
+}
+
+func (p *Parser) report(pos position, severity Severity, format string, args ...interface{}) {
+	p.Diagnostics = append(p.Diagnostics, Diagnostic{
+		File:     pos.file,
+		Line:     pos.line,
+		Col:      pos.col,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+		source:   pos.source,
+		notes:    pos.notes,
+	})
+}
+
+// errorf reports an error at a column of the line being parsed.
+func (p *Parser) errorf(col int, format string, args ...interface{}) {
+	p.report(p.pos(col), SeverityError, format, args...)
+}
+
+func (p *Parser) warnf(col int, format string, args ...interface{}) {
+	p.report(p.pos(col), SeverityWarning, format, args...)
+}
+
+// HasErrors tells whether any of the diagnostics is an error.
+func (p *Parser) HasErrors() bool {
+	for _, d := range p.Diagnostics {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteDiagnostics prints all diagnostics, followed by the number of errors
+// and warnings.
+func (p *Parser) WriteDiagnostics(w io.Writer) {
+	if len(p.Diagnostics) == 0 {
+		return
+	}
+	errors, warnings := 0, 0
+	for _, d := range p.Diagnostics {
+		fmt.Fprintln(w, d.Format())
+		if d.Severity == SeverityError {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+	fmt.Fprintf(w, "%d error(s), %d warning(s)\n", errors, warnings)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"syscall"
+)
+
+// ER is the error register. File instructions store one of the error codes
+// below in it, or ENONE when they succeed.
+const ER = 19
+
+// Error codes reported to programs in the error register.
+const (
+	ENONE     uint32 = iota // No error
+	ENOENT                  // File or folder not found
+	EACCES                  // Permission denied
+	EBADF                   // Bad file descriptor
+	EEOF                    // End of file
+	ENOSPC                  // No space left, quota exceeded or out of memory
+	EISDIR                  // Is a folder
+	ENOTDIR                 // Not a folder
+	EEXIST                  // File already exists
+	ENOTEMPTY               // Folder not empty
+	EROFS                   // Read-only filesystem
+	EMFILE                  // Too many open files
+	EINVAL                  // Invalid argument
+	ENOTSUP                 // Operation not supported
+	EBUSY                   // Filesystem or mount point busy
+	EXDEV                   // Cannot move files between mounts
+	EIO                     // Any other error
+	EAGAIN                  // Try again later
+)
+
+var (
+	ErrIsDir       = errors.New("is a directory")
+	ErrNotDir      = errors.New("not a directory")
+	ErrNotEmpty    = errors.New("directory not empty")
+	ErrBusy        = errors.New("filesystem is busy")
+	ErrCrossDevice = errors.New("cannot rename across mounts")
+	ErrInvalid     = errors.New("invalid argument")
+)
+
+var errorCodes = []struct {
+	code uint32
+	errs []error
+}{
+	{EEOF, []error{io.EOF, io.ErrUnexpectedEOF}},
+	{EBADF, []error{ErrBadFileDescriptor, fs.ErrClosed}},
+	{EMFILE, []error{ErrTooManyFiles, syscall.EMFILE}},
+	{ENOENT, []error{fs.ErrNotExist}},
+	{EEXIST, []error{fs.ErrExist}},
+	{EROFS, []error{ErrReadOnly, syscall.EROFS}},
+	{EACCES, []error{fs.ErrPermission, ErrPathEscapes}},
+	{ENOSPC, []error{ErrNoSpace, ErrQuotaExceeded, ErrOutOfMemory, syscall.ENOSPC}},
+	{EISDIR, []error{ErrIsDir, syscall.EISDIR}},
+	{ENOTDIR, []error{ErrNotDir, syscall.ENOTDIR}},
+	{ENOTEMPTY, []error{ErrNotEmpty, syscall.ENOTEMPTY}},
+	{ENOTSUP, []error{ErrNotSupported, errors.ErrUnsupported}},
+	{EBUSY, []error{ErrBusy, ErrProgramBusy, syscall.EBUSY}},
+	{EXDEV, []error{ErrCrossDevice, syscall.EXDEV}},
+	{EINVAL, []error{ErrInvalid, fs.ErrInvalid, syscall.EINVAL}},
+	{EAGAIN, []error{ErrTryAgain}},
+}
+
+// ErrorNames are the names of the error codes, as used in traces and fault
+// specs.
+var ErrorNames = []string{
+	"ENONE", "ENOENT", "EACCES", "EBADF", "EEOF", "ENOSPC", "EISDIR", "ENOTDIR", "EEXIST",
+	"ENOTEMPTY", "EROFS", "EMFILE", "EINVAL", "ENOTSUP", "EBUSY", "EXDEV", "EIO", "EAGAIN",
+}
+
+// ErrorForCode returns an error that ErrorCode maps back to code.
+func ErrorForCode(code uint32) error {
+	for _, c := range errorCodes {
+		if c.code == code {
+			return c.errs[0]
+		}
+	}
+	return errors.New("input/output error")
+}
+
+// ErrorCode maps an error returned by a VFS to the error code programs see.
+func ErrorCode(err error) uint32 {
+	if err == nil {
+		return ENONE
+	}
+	for _, c := range errorCodes {
+		for _, e := range c.errs {
+			if errors.Is(err, e) {
+				return c.code
+			}
+		}
+	}
+	return EIO
+}
+
+// SetError stores the error code of err in the error register.
+func (c *CPU) SetError(err error) {
+	c.Registers[ER] = ErrorCode(err)
+}
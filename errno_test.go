@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestErrorRegister checks that instructions outside of the file instructions
+// also store their error code in ER, instead of leaving the code of the
+// failed OPEN before them.
+func TestErrorRegister(t *testing.T) {
+	tests := []struct {
+		instruction string
+		want        uint32
+	}{
+		{"UNLOAD 0", EBUSY},
+		{"UNLOAD 7", EINVAL},
+		{"PROGINFO 7 R1 R2", EINVAL},
+		{"PROGINFO 0 R1 R2", ENONE},
+		{"MUNMAP R3", EINVAL},
+		{"SHMOPEN [name] 0", EINVAL},
+		{"SHMMAP 7 R1", EINVAL},
+		{"SHMUNLINK 7", EINVAL},
+	}
+	for _, tt := range tests {
+		program := fmt.Sprintf(`
+.DATA
+    name DB "missing.txt", 0
+.TEXT
+    OPEN R1 [name]
+    %s
+    HLT
+`, tt.instruction)
+		c := NewCPU()
+		c.FileSystem = NewMemoryVFS()
+		c.LoadProgram(assemble(t, program))
+		runUntilHalted(t, c)
+		if got := c.Registers[19]; got != tt.want {
+			t.Errorf("%s: ER = %s, want %s", tt.instruction, ErrorNames[got], ErrorNames[tt.want])
+		}
+	}
+}
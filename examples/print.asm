@@ -1,4 +1,4 @@
-; Requires compiling together with std.asm
+INCLUDE "std.asm"
 
 .DATA
   string DB "Hello, World!\n", 0
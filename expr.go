@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Constant is a value defined with EQU or =. Its expression is evaluated
+// when the constant is used, so it can refer to labels defined later.
+type Constant struct {
+	Name string
+	Expr string
+
+	here   func() uint32
+	lookup func(string) (uint32, error)
+}
+
+// errUnknownSymbol is returned for symbols that are not defined, or whose
+// value is not known yet.
+type errUnknownSymbol struct {
+	name string
+}
+
+func (e *errUnknownSymbol) Error() string {
+	return "unknown symbol " + e.name
+}
+
+// exprParser evaluates a constant expression. The operators follow the
+// precedence of C, from lowest to highest:
+//
+//	|
+//	&
+//	<< >>
+//	+ -
+//	* / %
+//	unary - ~ +
+//
+// Operands are numbers, character literals like 'A', symbols, $ for the
+// current address, and expressions in parentheses. All arithmetic is done
+// on 32-bit unsigned values and wraps around.
+type exprParser struct {
+	s    string
+	i    int
+	here func() uint32
+	// Without a lookup function, symbols and $ are 0, which only checks the
+	// syntax
+	lookup func(name string) (uint32, error)
+}
+
+func (e *exprParser) skipSpace() {
+	for e.i < len(e.s) && (e.s[e.i] == ' ' || e.s[e.i] == '\t') {
+		e.i++
+	}
+}
+
+// peek returns the next operator, if it is one of ops.
+func (e *exprParser) peek(ops ...string) string {
+	e.skipSpace()
+	for _, op := range ops {
+		if strings.HasPrefix(e.s[e.i:], op) {
+			return op
+		}
+	}
+	return ""
+}
+
+func (e *exprParser) binary(level int) (uint32, error) {
+	levels := [][]string{{"|"}, {"&"}, {"<<", ">>"}, {"+", "-"}, {"*", "/", "%"}}
+	if level == len(levels) {
+		return e.unary()
+	}
+	left, err := e.binary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := e.peek(levels[level]...)
+		if op == "" {
+			return left, nil
+		}
+		e.i += len(op)
+		right, err := e.binary(level + 1)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "|":
+			left |= right
+		case "&":
+			left &= right
+		case "<<":
+			left <<= right
+		case ">>":
+			left >>= right
+		case "+":
+			left += right
+		case "-":
+			left -= right
+		case "*":
+			left *= right
+		case "/", "%":
+			if right == 0 {
+				if e.lookup == nil {
+					// Symbols are 0 when only checking the syntax
+					continue
+				}
+				return 0, errors.New("division by zero")
+			}
+			if op == "/" {
+				left /= right
+			} else {
+				left %= right
+			}
+		}
+	}
+}
+
+func (e *exprParser) unary() (uint32, error) {
+	switch e.peek("-", "~", "+") {
+	case "-":
+		e.i++
+		v, err := e.unary()
+		return -v, err
+	case "~":
+		e.i++
+		v, err := e.unary()
+		return ^v, err
+	case "+":
+		e.i++
+		return e.unary()
+	}
+	return e.primary()
+}
+
+func (e *exprParser) primary() (uint32, error) {
+	e.skipSpace()
+	if e.i == len(e.s) {
+		return 0, errors.New("expected a value at the end of the expression")
+	}
+	start := e.i
+	c := e.s[e.i]
+	switch {
+	case c == '(':
+		e.i++
+		v, err := e.binary(0)
+		if err != nil {
+			return 0, err
+		}
+		if e.peek(")") == "" {
+			return 0, errors.New("missing )")
+		}
+		e.i++
+		return v, nil
+	case c == '$':
+		e.i++
+		if e.here == nil || e.lookup == nil {
+			return 0, nil
+		}
+		return e.here(), nil
+	case c == '\'':
+		v, n, err := parseCharLiteral(e.s[e.i:])
+		e.i += n
+		return v, err
+	case c >= '0' && c <= '9':
+		for e.i < len(e.s) && isSymbolChar(e.s[e.i]) && e.s[e.i] != '.' && e.s[e.i] != '@' {
+			e.i++
+		}
+		v, err := strconv.ParseUint(e.s[start:e.i], 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %s", e.s[start:e.i])
+		}
+		return uint32(v), nil
+	case isSymbolChar(c):
+		for e.i < len(e.s) && isSymbolChar(e.s[e.i]) {
+			e.i++
+		}
+		if e.lookup == nil {
+			return 0, nil
+		}
+		return e.lookup(e.s[start:e.i])
+	}
+	return 0, fmt.Errorf("unexpected %q in expression", c)
+}
+
+// parseCharLiteral parses a character literal like 'A' or '\n' at the start
+// of s, and returns its value and length.
+func parseCharLiteral(s string) (uint32, int, error) {
+	if len(s) >= 4 && s[1] == '\\' && s[3] == '\'' {
+		switch s[2] {
+		case 'n':
+			return '\n', 4, nil
+		case 'r':
+			return '\r', 4, nil
+		case 't':
+			return '\t', 4, nil
+		case '0':
+			return 0, 4, nil
+		default:
+			return uint32(s[2]), 4, nil
+		}
+	}
+	if len(s) >= 3 && s[1] != '\\' && s[2] == '\'' {
+		return uint32(s[1]), 3, nil
+	}
+	return 0, 1, fmt.Errorf("invalid character literal")
+}
+
+// evalExpr evaluates an expression. Without a lookup function, it only
+// checks the syntax.
+func evalExpr(s string, here func() uint32, lookup func(string) (uint32, error)) (uint32, error) {
+	e := &exprParser{s: s, here: here, lookup: lookup}
+	v, err := e.binary(0)
+	if err == nil {
+		if e.skipSpace(); e.i < len(e.s) {
+			err = fmt.Errorf("unexpected %q in expression", e.s[e.i:])
+		}
+	}
+	return v, err
+}
+
+// here returns the current address. In the data section, that is the
+// address of the next data, which is only known at the end of the file.
+func (p *Parser) here() func() uint32 {
+	sector := p.CurrentSector
+	if p.CurrentSection == "data" || p.CurrentSection == "DATA" {
+		index := len(sector.Data)
+		return func() uint32 {
+			if index < len(sector.Data) {
+				return sector.Data[index].Address
+			}
+			return sector.BaseAddress + uint32(len(sector.Program))
+		}
+	}
+	addr := sector.BaseAddress + uint32(len(sector.Program))
+	return func() uint32 { return addr }
+}
+
+// evalLater checks the syntax of an expression at column col, and calls set
+// with its value once all files are parsed. It returns false if the
+// expression is invalid.
+func (p *Parser) evalLater(s string, col int, set func(uint32)) bool {
+	if _, err := evalExpr(s, nil, nil); err != nil {
+		p.errorf(col, "%v", err)
+		return false
+	}
+	if v, err := strconv.ParseUint(strings.TrimSpace(s), 0, 32); err == nil {
+		set(uint32(v))
+		return true
+	}
+	pos := p.pos(col)
+	here, lookup := p.here(), p.lookup()
+	p.CurrentSector.PostParse = append(p.CurrentSector.PostParse, func() {
+		v, err := evalExpr(s, here, lookup)
+		if err != nil {
+			p.report(pos, SeverityError, "%v", err)
+			return
+		}
+		set(v)
+	})
+	return true
+}
+
+// evalNow evaluates an expression that is needed right away, like the
+// address of ORG. Only constants and labels defined before can be used.
+func (p *Parser) evalNow(s string, col int) (uint32, bool) {
+	v, err := evalExpr(s, p.here(), p.lookup())
+	if err != nil {
+		var unknown *errUnknownSymbol
+		if errors.As(err, &unknown) {
+			p.errorf(col, "%v, only constants and labels defined before can be used here", err)
+		} else {
+			p.errorf(col, "%v", err)
+		}
+		return 0, false
+	}
+	return v, true
+}
+
+// parseConstant handles NAME EQU <expr> and NAME = <expr>. It returns false
+// if the line does not define a constant.
+func (p *Parser) parseConstant(line string) bool {
+	line = stripComment(line)
+	var name, expr string
+	exprOffset := 0
+	if fields := splitFields(line); len(fields) >= 3 && fields[1].text == "EQU" {
+		name, exprOffset = fields[0].text, fields[2].offset
+		expr = line[exprOffset:]
+	} else if i := strings.IndexByte(line, '='); i > 0 && isSymbol(strings.TrimSpace(line[:i])) {
+		name, exprOffset = strings.TrimSpace(line[:i]), i+1
+		expr = line[exprOffset:]
+	} else {
+		return false
+	}
+	exprOffset += len(expr) - len(strings.TrimLeft(expr, " \t"))
+	if _, err := evalExpr(expr, nil, nil); err != nil {
+		p.errorf(p.col(exprOffset), "%v", err)
+		return true
+	}
+	name = p.qualify(name)
+	if !p.define(name, p.col(0)) {
+		return true
+	}
+	p.scope.constants[name] = &Constant{Name: name, Expr: strings.TrimSpace(expr), here: p.here(), lookup: p.lookup()}
+	return true
+}
+
+func isSymbol(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isSymbolChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// stripComment removes a comment from the end of a line, leaving semicolons
+// in quotes alone.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote != 0 && line[i] == '\\':
+			i++
+		case quote != 0 && line[i] == quote:
+			quote = 0
+		case quote == 0 && (line[i] == '"' || line[i] == '\''):
+			quote = line[i]
+		case quote == 0 && line[i] == ';':
+			return line[:i]
+		}
+	}
+	return line
+}
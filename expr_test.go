@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvalExpr(t *testing.T) {
+	symbols := map[string]uint32{
+		"SCREEN":     0xFFFFF000,
+		"WIDTH":      40,
+		"zero":       0,
+		"print.loop": 0x1234,
+	}
+	here := func() uint32 { return 0x100 }
+	lookup := func(name string) (uint32, error) {
+		if v, ok := symbols[name]; ok {
+			return v, nil
+		}
+		return 0, &errUnknownSymbol{name}
+	}
+
+	tests := []struct {
+		expr string
+		want uint32
+		err  string
+	}{
+		// Precedence and associativity
+		{expr: "1 + 2 * 3", want: 7},
+		{expr: "(1 + 2) * 3", want: 9},
+		{expr: "10 - 4 - 3", want: 3},
+		{expr: "100 / 10 / 5", want: 2},
+		{expr: "17 % 5 * 2", want: 4},
+		{expr: "1 << 2 + 1", want: 8},
+		{expr: "1 + 2 << 3", want: 24},
+		{expr: "0xF0 | 0x0F & 0x3C", want: 0xFC},
+		{expr: "6 & 3 | 8", want: 10},
+		{expr: "0x100 >> 4 & 0xF", want: 0},
+		{expr: "-2 * 3", want: 0xFFFFFFFA},
+		{expr: "~0 >> 28", want: 0xF},
+		{expr: "- -5", want: 5},
+		{expr: "+5", want: 5},
+		{expr: "((((7))))", want: 7},
+
+		// Values
+		{expr: "0x10 + 10", want: 26},
+		{expr: "'A' + 1", want: 'B'},
+		{expr: "'\\n'", want: '\n'},
+		{expr: "SCREEN + WIDTH * 2", want: 0xFFFFF050},
+		{expr: "print.loop", want: 0x1234},
+
+		// The current address
+		{expr: "$", want: 0x100},
+		{expr: "$ + 4", want: 0x104},
+		{expr: "SCREEN - $", want: 0xFFFFEF00},
+		{expr: "($ + 0xFF) & ~0xFF", want: 0x100},
+
+		// Wrapping
+		{expr: "0 - 1", want: 0xFFFFFFFF},
+		{expr: "0xFFFFFFFF + 2", want: 1},
+		{expr: "0x10000 * 0x10000", want: 0},
+
+		// Errors
+		{expr: "1 / 0", err: "division by zero"},
+		{expr: "1 % (2 - 2)", err: "division by zero"},
+		{expr: "WIDTH / zero", err: "division by zero"},
+		{expr: "MISSING + 1", err: "unknown symbol MISSING"},
+		{expr: "(1 + 2", err: "missing )"},
+		{expr: "1 +", err: "expected a value"},
+		{expr: "1 2", err: "unexpected"},
+		{expr: "0x1G", err: "invalid number"},
+		{expr: "0x100000000", err: "invalid number"},
+		{expr: "'ab'", err: "invalid character literal"},
+		{expr: "#3", err: "unexpected"},
+	}
+	for _, tt := range tests {
+		got, err := evalExpr(tt.expr, here, lookup)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("evalExpr(%q): got error %v, want %q", tt.expr, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("evalExpr(%q): %v", tt.expr, err)
+		} else if got != tt.want {
+			t.Errorf("evalExpr(%q) = %#x, want %#x", tt.expr, got, tt.want)
+		}
+	}
+}
+
+// TestEvalExprSyntax checks expressions without a lookup function, which
+// only checks the syntax, so unknown symbols and division by zero pass.
+func TestEvalExprSyntax(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{"LATER + 4", true},
+		{"$ - start", true},
+		{"1 / LATER", true},
+		{"1 / 0", true},
+		{"(LATER", false},
+		{"LATER +", false},
+		{"LATER LATER", false},
+	}
+	for _, tt := range tests {
+		if _, err := evalExpr(tt.expr, nil, nil); (err == nil) != tt.ok {
+			t.Errorf("evalExpr(%q) without lookup: got error %v, want ok = %v", tt.expr, err, tt.ok)
+		}
+	}
+}
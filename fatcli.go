@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultFATImageSize is the size of a 1.44MB floppy disk.
+const DefaultFATImageSize = 1474560
+
+const fatUsage = `usage:
+  VM fat create <image> [size]                create an empty image, size in bytes or with a K or M suffix
+  VM fat put <image> <file or folder> [path]  copy a file or folder from the host into the image
+  VM fat get <image> <path> <file>            copy a file from the image to the host
+  VM fat ls <image> [path]                    list a folder of the image`
+
+// runFATCommand handles "VM fat ...", which creates and fills FAT images on
+// the host.
+func runFATCommand(args []string) error {
+	if len(args) < 2 {
+		return errors.New(fatUsage)
+	}
+	cmd, image, args := args[0], args[1], args[2:]
+
+	if cmd == "create" {
+		size := int64(DefaultFATImageSize)
+		if len(args) > 0 {
+			var err error
+			if size, err = parseSize(args[0]); err != nil {
+				return err
+			}
+		}
+		return FormatFAT(image, size)
+	}
+
+	vfs, err := OpenFAT(image)
+	if err != nil {
+		return err
+	}
+	defer vfs.CloseImage()
+
+	switch cmd {
+	case "put":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New(fatUsage)
+		}
+		dest := "/" + filepath.Base(args[0])
+		if len(args) == 2 {
+			dest = args[1]
+		}
+		return fatPut(vfs, args[0], dest)
+	case "get":
+		if len(args) != 2 {
+			return errors.New(fatUsage)
+		}
+		return fatGet(vfs, args[0], args[1])
+	case "ls":
+		dir := "/"
+		if len(args) > 0 {
+			dir = args[0]
+		}
+		entries, err := vfs.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range entries {
+			if info.Mode.IsDir() {
+				fmt.Printf("%10s %s/\n", "", info.Name)
+			} else {
+				fmt.Printf("%10d %s\n", info.Size, info.Name)
+			}
+		}
+		return nil
+	}
+	return errors.New(fatUsage)
+}
+
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(strings.ToUpper(s), "K"):
+		mult = 1024
+	case strings.HasSuffix(strings.ToUpper(s), "M"):
+		mult = 1024 * 1024
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// fatPut copies a file, or a folder with everything in it, into the image.
+func fatPut(vfs *FATVFS, src string, dest string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dest, filepath.ToSlash(rel))
+		if d.IsDir() {
+			return vfs.Mkdir(target)
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		file, err := vfs.Create(target)
+		if err != nil {
+			return fmt.Errorf("%s: %w", target, err)
+		}
+		defer vfs.Close(file)
+		if _, err := vfs.Write(file, data); err != nil {
+			return fmt.Errorf("%s: %w", target, err)
+		}
+		return nil
+	})
+}
+
+func fatGet(vfs *FATVFS, src string, dest string) error {
+	file, err := vfs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer vfs.Close(file)
+	info, err := vfs.Stat(src)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, info.Size)
+	if _, err := vfs.ReadAt(file, data, 0); err != nil && err != io.EOF {
+		return err
+	}
+	return os.WriteFile(dest, data, 0644)
+}
@@ -0,0 +1,1022 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fatEntrySize = 32
+	fatAttrRO    = 0x01
+	fatAttrLabel = 0x08
+	fatAttrDir   = 0x10
+	fatAttrFile  = 0x20
+	fatDeleted   = 0xE5
+)
+
+var (
+	ErrNoSpace    = errors.New("no space left on device")
+	ErrCorruptFAT = errors.New("corrupt FAT filesystem")
+)
+
+// FATVFS reads and writes a FAT12 or FAT16 disk image, so files can be
+// exchanged with other tools. Only short 8.3 file names are supported, long
+// file name entries written by other tools are skipped. Changes are written to
+// the image right away.
+type FATVFS struct {
+	mu       sync.Mutex
+	img      *os.File
+	ReadOnly bool
+	Type     int
+
+	bytesPerSector    uint32
+	sectorsPerCluster uint32
+	numFATs           uint32
+	sectorsPerFAT     uint32
+	rootEntries       uint32
+	clusterSize       uint32
+	clusterCount      uint32
+	fatStart          int64
+	rootStart         int64
+	dataStart         int64
+	fat               []byte
+	nextFree          uint32
+	nodes             map[int64]*fatNode
+}
+
+// fatNode is an open file, shared by everyone who opened the same directory
+// entry so they all see the same size.
+type fatNode struct {
+	entry   int64
+	cluster uint32
+	size    uint32
+	refs    int
+	removed bool
+}
+
+type FATFile struct {
+	Name   string
+	node   *fatNode
+	offset int64
+}
+
+func (f *FATFile) FileName() string {
+	return f.Name
+}
+
+// fatDirEntry is a directory entry as found on disk. offset is where its 32
+// bytes are stored in the image, the root folder has no entry and uses -1.
+type fatDirEntry struct {
+	name    string
+	attr    byte
+	cluster uint32
+	size    uint32
+	offset  int64
+}
+
+func (e *fatDirEntry) IsDir() bool {
+	return e.attr&fatAttrDir != 0
+}
+
+func (e *fatDirEntry) info() *FileInfo {
+	if e.IsDir() {
+		return &FileInfo{Name: e.name, Mode: os.ModeDir | 0755}
+	}
+	mode := os.FileMode(0644)
+	if e.attr&fatAttrRO != 0 {
+		mode = 0444
+	}
+	return &FileInfo{Name: e.name, Size: int64(e.size), Mode: mode}
+}
+
+// OpenFAT opens a FAT12 or FAT16 image. Images that cannot be written to are
+// opened read-only.
+func OpenFAT(filename string) (*FATVFS, error) {
+	vfs := &FATVFS{nodes: make(map[int64]*fatNode)}
+	img, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrPermission) {
+		img, err = os.Open(filename)
+		vfs.ReadOnly = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	vfs.img = img
+	if err := vfs.readBootSector(); err != nil {
+		img.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return vfs, nil
+}
+
+func (vfs *FATVFS) readBootSector() error {
+	boot := make([]byte, 512)
+	if _, err := vfs.img.ReadAt(boot, 0); err != nil {
+		return err
+	}
+	if boot[510] != 0x55 || boot[511] != 0xAA {
+		return fmt.Errorf("missing boot sector signature: %w", ErrCorruptFAT)
+	}
+	vfs.bytesPerSector = uint32(binary.LittleEndian.Uint16(boot[11:]))
+	vfs.sectorsPerCluster = uint32(boot[13])
+	reserved := uint32(binary.LittleEndian.Uint16(boot[14:]))
+	vfs.numFATs = uint32(boot[16])
+	vfs.rootEntries = uint32(binary.LittleEndian.Uint16(boot[17:]))
+	totalSectors := uint32(binary.LittleEndian.Uint16(boot[19:]))
+	if totalSectors == 0 {
+		totalSectors = binary.LittleEndian.Uint32(boot[32:])
+	}
+	vfs.sectorsPerFAT = uint32(binary.LittleEndian.Uint16(boot[22:]))
+
+	switch vfs.bytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("invalid sector size %d: %w", vfs.bytesPerSector, ErrCorruptFAT)
+	}
+	if vfs.sectorsPerCluster == 0 || vfs.sectorsPerCluster&(vfs.sectorsPerCluster-1) != 0 || vfs.numFATs == 0 {
+		return fmt.Errorf("invalid BIOS parameter block: %w", ErrCorruptFAT)
+	}
+	if vfs.sectorsPerFAT == 0 {
+		return errors.New("FAT32 images are not supported")
+	}
+
+	rootSectors := (vfs.rootEntries*fatEntrySize + vfs.bytesPerSector - 1) / vfs.bytesPerSector
+	dataSector := reserved + vfs.numFATs*vfs.sectorsPerFAT + rootSectors
+	if dataSector >= totalSectors {
+		return fmt.Errorf("no room for data: %w", ErrCorruptFAT)
+	}
+	vfs.clusterSize = vfs.bytesPerSector * vfs.sectorsPerCluster
+	vfs.clusterCount = (totalSectors - dataSector) / vfs.sectorsPerCluster
+	switch {
+	case vfs.clusterCount < 4085:
+		vfs.Type = 12
+	case vfs.clusterCount < 65525:
+		vfs.Type = 16
+	default:
+		return errors.New("FAT32 images are not supported")
+	}
+
+	vfs.fatStart = int64(reserved) * int64(vfs.bytesPerSector)
+	vfs.rootStart = vfs.fatStart + int64(vfs.numFATs*vfs.sectorsPerFAT)*int64(vfs.bytesPerSector)
+	vfs.dataStart = int64(dataSector) * int64(vfs.bytesPerSector)
+	vfs.fat = make([]byte, vfs.sectorsPerFAT*vfs.bytesPerSector)
+	if need := (vfs.clusterCount + 2) * uint32(vfs.Type) / 8; need+1 > uint32(len(vfs.fat)) {
+		return fmt.Errorf("FAT is too small for %d clusters: %w", vfs.clusterCount, ErrCorruptFAT)
+	}
+	if _, err := vfs.img.ReadAt(vfs.fat, vfs.fatStart); err != nil {
+		return err
+	}
+	vfs.nextFree = 2
+	return nil
+}
+
+// CloseImage closes the image file. Files opened through the VFS must be
+// closed first.
+func (vfs *FATVFS) CloseImage() error {
+	return vfs.img.Close()
+}
+
+func (vfs *FATVFS) endOfChain() uint32 {
+	if vfs.Type == 12 {
+		return 0xFF8
+	}
+	return 0xFFF8
+}
+
+func (vfs *FATVFS) getFAT(n uint32) uint32 {
+	if vfs.Type == 12 {
+		v := uint32(binary.LittleEndian.Uint16(vfs.fat[n*3/2:]))
+		if n%2 == 1 {
+			return v >> 4
+		}
+		return v & 0xFFF
+	}
+	return uint32(binary.LittleEndian.Uint16(vfs.fat[n*2:]))
+}
+
+// setFAT changes an entry in every copy of the FAT.
+func (vfs *FATVFS) setFAT(n uint32, v uint32) error {
+	var off uint32
+	if vfs.Type == 12 {
+		off = n * 3 / 2
+		old := binary.LittleEndian.Uint16(vfs.fat[off:])
+		if n%2 == 1 {
+			binary.LittleEndian.PutUint16(vfs.fat[off:], old&0x000F|uint16(v&0xFFF)<<4)
+		} else {
+			binary.LittleEndian.PutUint16(vfs.fat[off:], old&0xF000|uint16(v&0xFFF))
+		}
+	} else {
+		off = n * 2
+		binary.LittleEndian.PutUint16(vfs.fat[off:], uint16(v))
+	}
+	for i := uint32(0); i < vfs.numFATs; i++ {
+		start := vfs.fatStart + int64(i*vfs.sectorsPerFAT*vfs.bytesPerSector)
+		if _, err := vfs.img.WriteAt(vfs.fat[off:off+2], start+int64(off)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vfs *FATVFS) clusterOffset(c uint32) int64 {
+	return vfs.dataStart + int64(c-2)*int64(vfs.clusterSize)
+}
+
+// chain returns the clusters of a file or folder starting at start.
+func (vfs *FATVFS) chain(start uint32) ([]uint32, error) {
+	var clusters []uint32
+	for c := start; c != 0 && c < vfs.endOfChain(); c = vfs.getFAT(c) {
+		if c < 2 || c >= vfs.clusterCount+2 || uint32(len(clusters)) > vfs.clusterCount {
+			return nil, fmt.Errorf("invalid cluster chain: %w", ErrCorruptFAT)
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, nil
+}
+
+// allocCluster takes a free cluster, fills it with zeros and appends it to the
+// chain ending at prev, if prev is not 0.
+func (vfs *FATVFS) allocCluster(prev uint32) (uint32, error) {
+	for i := uint32(0); i < vfs.clusterCount; i++ {
+		c := (vfs.nextFree-2+i)%vfs.clusterCount + 2
+		if vfs.getFAT(c) != 0 {
+			continue
+		}
+		if _, err := vfs.img.WriteAt(make([]byte, vfs.clusterSize), vfs.clusterOffset(c)); err != nil {
+			return 0, err
+		}
+		if err := vfs.setFAT(c, 0xFFFF); err != nil {
+			return 0, err
+		}
+		if prev != 0 {
+			if err := vfs.setFAT(prev, c); err != nil {
+				return 0, err
+			}
+		}
+		vfs.nextFree = c + 1
+		return c, nil
+	}
+	return 0, ErrNoSpace
+}
+
+func (vfs *FATVFS) freeChain(start uint32) error {
+	clusters, err := vfs.chain(start)
+	if err != nil {
+		return err
+	}
+	for _, c := range clusters {
+		if err := vfs.setFAT(c, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeName converts a name to the space padded 8.3 form stored on disk.
+func encodeName(name string) ([11]byte, error) {
+	var raw [11]byte
+	for i := range raw {
+		raw[i] = ' '
+	}
+	if name == "." || name == ".." {
+		copy(raw[:], name)
+		return raw, nil
+	}
+	upper := strings.ToUpper(name)
+	base, ext, _ := strings.Cut(upper, ".")
+	if base == "" || len(base) > 8 || len(ext) > 3 || strings.Contains(ext, ".") {
+		return raw, fmt.Errorf("%q is not an 8.3 file name: %w", name, ErrInvalid)
+	}
+	for _, r := range base + ext {
+		if r > 0x7E || r < '!' || strings.ContainsRune("\"*+,/:;<=>?[\\]|", r) {
+			return raw, fmt.Errorf("%q is not an 8.3 file name: %w", name, ErrInvalid)
+		}
+	}
+	copy(raw[:8], base)
+	copy(raw[8:], ext)
+	if raw[0] == fatDeleted {
+		raw[0] = 0x05
+	}
+	return raw, nil
+}
+
+func decodeName(raw []byte) string {
+	base := []byte(strings.TrimRight(string(raw[:8]), " "))
+	if len(base) > 0 && base[0] == 0x05 {
+		base[0] = fatDeleted
+	}
+	ext := strings.TrimRight(string(raw[8:11]), " ")
+	if ext == "" {
+		return string(base)
+	}
+	return string(base) + "." + ext
+}
+
+func fatTimestamp(t time.Time) (uint16, uint16) {
+	date := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	clock := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	return date, clock
+}
+
+func newDirEntry(name [11]byte, attr byte, cluster uint32, size uint32) []byte {
+	raw := make([]byte, fatEntrySize)
+	copy(raw, name[:])
+	raw[11] = attr
+	date, clock := fatTimestamp(time.Now())
+	binary.LittleEndian.PutUint16(raw[14:], clock)
+	binary.LittleEndian.PutUint16(raw[16:], date)
+	binary.LittleEndian.PutUint16(raw[18:], date)
+	binary.LittleEndian.PutUint16(raw[22:], clock)
+	binary.LittleEndian.PutUint16(raw[24:], date)
+	binary.LittleEndian.PutUint16(raw[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(raw[28:], size)
+	return raw
+}
+
+// dirSlots returns the offsets of all entry slots of a folder. Cluster 0 is
+// the root folder, which has a fixed number of slots.
+func (vfs *FATVFS) dirSlots(dir uint32) ([]int64, error) {
+	var slots []int64
+	if dir == 0 {
+		for i := uint32(0); i < vfs.rootEntries; i++ {
+			slots = append(slots, vfs.rootStart+int64(i*fatEntrySize))
+		}
+		return slots, nil
+	}
+	clusters, err := vfs.chain(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range clusters {
+		for i := uint32(0); i < vfs.clusterSize/fatEntrySize; i++ {
+			slots = append(slots, vfs.clusterOffset(c)+int64(i*fatEntrySize))
+		}
+	}
+	return slots, nil
+}
+
+// readDir returns the entries of a folder, including "." and "..".
+func (vfs *FATVFS) readDir(dir uint32) ([]*fatDirEntry, error) {
+	slots, err := vfs.dirSlots(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*fatDirEntry
+	raw := make([]byte, fatEntrySize)
+	for _, off := range slots {
+		if _, err := vfs.img.ReadAt(raw, off); err != nil {
+			return nil, err
+		}
+		if raw[0] == 0 {
+			break
+		}
+		if raw[0] == fatDeleted || raw[11]&fatAttrLabel != 0 {
+			continue
+		}
+		entries = append(entries, &fatDirEntry{
+			name:    decodeName(raw),
+			attr:    raw[11],
+			cluster: uint32(binary.LittleEndian.Uint16(raw[26:])),
+			size:    binary.LittleEndian.Uint32(raw[28:]),
+			offset:  off,
+		})
+	}
+	return entries, nil
+}
+
+func (vfs *FATVFS) find(dir uint32, name string) (*fatDirEntry, error) {
+	entries, err := vfs.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if strings.EqualFold(e.name, name) {
+			return e, nil
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+// lookup finds the entry of a path. Names are compared without case.
+func (vfs *FATVFS) lookup(name string) (*fatDirEntry, error) {
+	entry := &fatDirEntry{name: "/", attr: fatAttrDir, offset: -1}
+	for _, part := range strings.Split(cleanPath(name), "/") {
+		if part == "" {
+			continue
+		}
+		if !entry.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+		next, err := vfs.find(entry.cluster, part)
+		if err != nil {
+			return nil, err
+		}
+		entry = next
+	}
+	return entry, nil
+}
+
+func (vfs *FATVFS) lookupDir(name string) (*fatDirEntry, error) {
+	entry, err := vfs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.IsDir() {
+		return nil, ErrNotDir
+	}
+	return entry, nil
+}
+
+// addEntry stores a directory entry in the first free slot of a folder,
+// growing the folder if it is full. The root folder cannot grow.
+func (vfs *FATVFS) addEntry(dir uint32, raw []byte) (int64, error) {
+	slots, err := vfs.dirSlots(dir)
+	if err != nil {
+		return 0, err
+	}
+	b := make([]byte, 1)
+	for _, off := range slots {
+		if _, err := vfs.img.ReadAt(b, off); err != nil {
+			return 0, err
+		}
+		if b[0] == 0 || b[0] == fatDeleted {
+			_, err := vfs.img.WriteAt(raw, off)
+			return off, err
+		}
+	}
+	if dir == 0 {
+		return 0, ErrNoSpace
+	}
+	clusters, err := vfs.chain(dir)
+	if err != nil {
+		return 0, err
+	}
+	c, err := vfs.allocCluster(clusters[len(clusters)-1])
+	if err != nil {
+		return 0, err
+	}
+	off := vfs.clusterOffset(c)
+	_, err = vfs.img.WriteAt(raw, off)
+	return off, err
+}
+
+// updateEntry stores the first cluster and size of a file in its entry.
+func (vfs *FATVFS) updateEntry(offset int64, cluster uint32, size uint32) error {
+	raw := make([]byte, 10)
+	date, clock := fatTimestamp(time.Now())
+	binary.LittleEndian.PutUint16(raw[0:], clock)
+	binary.LittleEndian.PutUint16(raw[2:], date)
+	binary.LittleEndian.PutUint16(raw[4:], uint16(cluster))
+	binary.LittleEndian.PutUint32(raw[6:], size)
+	_, err := vfs.img.WriteAt(raw, offset+22)
+	return err
+}
+
+func (vfs *FATVFS) openNode(e *fatDirEntry) *fatNode {
+	node, ok := vfs.nodes[e.offset]
+	if !ok {
+		node = &fatNode{entry: e.offset, cluster: e.cluster, size: e.size}
+		vfs.nodes[e.offset] = node
+	}
+	node.refs++
+	return node
+}
+
+func (vfs *FATVFS) Open(name string) (interface{}, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	entry, err := vfs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.IsDir() {
+		return nil, ErrIsDir
+	}
+	return &FATFile{Name: cleanPath(name), node: vfs.openNode(entry)}, nil
+}
+
+func (vfs *FATVFS) Close(file interface{}) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	node := file.(*FATFile).node
+	node.refs--
+	if node.refs > 0 {
+		return nil
+	}
+	if node.removed {
+		return vfs.freeChain(node.cluster)
+	}
+	delete(vfs.nodes, node.entry)
+	return nil
+}
+
+// Create creates an empty file, truncating it if it already exists. The
+// parent folder has to exist.
+func (vfs *FATVFS) Create(name string) (interface{}, error) {
+	if vfs.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	dir, base := splitPath(name)
+	parent, err := vfs.lookupDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := vfs.find(parent.cluster, base)
+	if err == nil {
+		if entry.IsDir() {
+			return nil, ErrIsDir
+		}
+		if err := vfs.freeChain(entry.cluster); err != nil {
+			return nil, err
+		}
+		if err := vfs.updateEntry(entry.offset, 0, 0); err != nil {
+			return nil, err
+		}
+		entry.cluster, entry.size = 0, 0
+		if node, ok := vfs.nodes[entry.offset]; ok {
+			node.cluster, node.size = 0, 0
+		}
+	} else {
+		raw, err := encodeName(base)
+		if err != nil {
+			return nil, err
+		}
+		off, err := vfs.addEntry(parent.cluster, newDirEntry(raw, fatAttrFile, 0, 0))
+		if err != nil {
+			return nil, err
+		}
+		entry = &fatDirEntry{name: base, attr: fatAttrFile, offset: off}
+	}
+	return &FATFile{Name: cleanPath(name), node: vfs.openNode(entry)}, nil
+}
+
+// Remove removes a file or an empty folder. The clusters of a file that is
+// still open are only freed once it is closed.
+func (vfs *FATVFS) Remove(name string) error {
+	if vfs.ReadOnly {
+		return ErrReadOnly
+	}
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	entry, err := vfs.lookup(name)
+	if err != nil {
+		return err
+	}
+	if entry.offset < 0 {
+		return fmt.Errorf("cannot remove the root folder: %w", ErrBusy)
+	}
+	if entry.IsDir() {
+		if empty, err := vfs.isEmpty(entry.cluster); err != nil {
+			return err
+		} else if !empty {
+			return ErrNotEmpty
+		}
+	}
+	if node, ok := vfs.nodes[entry.offset]; ok {
+		node.removed = true
+		delete(vfs.nodes, entry.offset)
+	} else if err := vfs.freeChain(entry.cluster); err != nil {
+		return err
+	}
+	_, err = vfs.img.WriteAt([]byte{fatDeleted}, entry.offset)
+	return err
+}
+
+func (vfs *FATVFS) isEmpty(dir uint32) (bool, error) {
+	entries, err := vfs.readDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.name != "." && e.name != ".." {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Rename moves a file or folder. An existing file at the new name is
+// replaced, just like an empty folder if a folder is moved there.
+func (vfs *FATVFS) Rename(oldName string, newName string) error {
+	if vfs.ReadOnly {
+		return ErrReadOnly
+	}
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	oldName, newName = cleanPath(oldName), cleanPath(newName)
+	entry, err := vfs.lookup(oldName)
+	if err != nil {
+		return err
+	}
+	if entry.offset < 0 {
+		return fmt.Errorf("cannot rename the root folder: %w", ErrBusy)
+	}
+	if entry.IsDir() && strings.HasPrefix(strings.ToUpper(newName)+"/", strings.ToUpper(oldName)+"/") {
+		return fmt.Errorf("cannot move a directory into itself: %w", ErrInvalid)
+	}
+	dir, base := splitPath(newName)
+	parent, err := vfs.lookupDir(dir)
+	if err != nil {
+		return err
+	}
+	raw, err := encodeName(base)
+	if err != nil {
+		return err
+	}
+
+	if target, err := vfs.find(parent.cluster, base); err == nil && target.offset != entry.offset {
+		if target.IsDir() != entry.IsDir() {
+			return fmt.Errorf("cannot replace a file with a directory or the other way around: %w", ErrInvalid)
+		}
+		if target.IsDir() {
+			if empty, err := vfs.isEmpty(target.cluster); err != nil {
+				return err
+			} else if !empty {
+				return ErrNotEmpty
+			}
+		}
+		if node, ok := vfs.nodes[target.offset]; ok {
+			node.removed = true
+			delete(vfs.nodes, target.offset)
+		} else if err := vfs.freeChain(target.cluster); err != nil {
+			return err
+		}
+		if _, err := vfs.img.WriteAt([]byte{fatDeleted}, target.offset); err != nil {
+			return err
+		}
+	}
+
+	old := make([]byte, fatEntrySize)
+	if _, err := vfs.img.ReadAt(old, entry.offset); err != nil {
+		return err
+	}
+	first := old[0]
+	copy(old, raw[:])
+	// Mark the old slot as deleted first, so renaming a file within its
+	// folder can reuse the slot
+	if _, err := vfs.img.WriteAt([]byte{fatDeleted}, entry.offset); err != nil {
+		return err
+	}
+	off, err := vfs.addEntry(parent.cluster, old)
+	if err != nil {
+		vfs.img.WriteAt([]byte{first}, entry.offset)
+		return err
+	}
+	if node, ok := vfs.nodes[entry.offset]; ok {
+		delete(vfs.nodes, entry.offset)
+		node.entry = off
+		vfs.nodes[off] = node
+	}
+	if entry.IsDir() {
+		// Point ".." to the new parent folder
+		if dotdot, err := vfs.find(entry.cluster, ".."); err == nil {
+			return vfs.updateEntry(dotdot.offset, parent.cluster, 0)
+		}
+	}
+	return nil
+}
+
+// Mkdir creates a folder and all of its missing parents.
+func (vfs *FATVFS) Mkdir(name string) error {
+	if vfs.ReadOnly {
+		return ErrReadOnly
+	}
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	dir := uint32(0)
+	for _, part := range strings.Split(cleanPath(name), "/") {
+		if part == "" {
+			continue
+		}
+		entry, err := vfs.find(dir, part)
+		if err == nil {
+			if !entry.IsDir() {
+				return ErrNotDir
+			}
+			dir = entry.cluster
+			continue
+		}
+		raw, err := encodeName(part)
+		if err != nil {
+			return err
+		}
+		c, err := vfs.allocCluster(0)
+		if err != nil {
+			return err
+		}
+		dot, _ := encodeName(".")
+		dotdot, _ := encodeName("..")
+		if _, err := vfs.img.WriteAt(newDirEntry(dot, fatAttrDir, c, 0), vfs.clusterOffset(c)); err != nil {
+			return err
+		}
+		if _, err := vfs.img.WriteAt(newDirEntry(dotdot, fatAttrDir, dir, 0), vfs.clusterOffset(c)+fatEntrySize); err != nil {
+			return err
+		}
+		if _, err := vfs.addEntry(dir, newDirEntry(raw, fatAttrDir, c, 0)); err != nil {
+			vfs.freeChain(c)
+			return err
+		}
+		dir = c
+	}
+	return nil
+}
+
+func (vfs *FATVFS) Stat(name string) (*FileInfo, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	entry, err := vfs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if node, ok := vfs.nodes[entry.offset]; ok {
+		entry.size = node.size
+	}
+	return entry.info(), nil
+}
+
+func (vfs *FATVFS) ReadDir(name string) ([]*FileInfo, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	dir, err := vfs.lookupDir(name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := vfs.readDir(dir.cluster)
+	if err != nil {
+		return nil, err
+	}
+	var fileInfos []*FileInfo
+	for _, e := range entries {
+		if e.name == "." || e.name == ".." {
+			continue
+		}
+		if node, ok := vfs.nodes[e.offset]; ok {
+			e.size = node.size
+		}
+		fileInfos = append(fileInfos, e.info())
+	}
+	sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name < fileInfos[j].Name })
+	return fileInfos, nil
+}
+
+func (vfs *FATVFS) Read(file interface{}, b []byte) (int, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	f := file.(*FATFile)
+	n, err := vfs.readAt(f, b, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (vfs *FATVFS) Write(file interface{}, b []byte) (int, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	f := file.(*FATFile)
+	n, err := vfs.writeAt(f, b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (vfs *FATVFS) ReadAt(file interface{}, b []byte, off int64) (int, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	return vfs.readAt(file.(*FATFile), b, off)
+}
+
+func (vfs *FATVFS) readAt(f *FATFile, b []byte, off int64) (int, error) {
+	node := f.node
+	if off < 0 {
+		return 0, ErrInvalid
+	}
+	if off >= int64(node.size) {
+		return 0, io.EOF
+	}
+	clusters, err := vfs.chain(node.cluster)
+	if err != nil {
+		return 0, err
+	}
+	length := int64(len(b))
+	if off+length > int64(node.size) {
+		length = int64(node.size) - off
+	}
+	n, err := vfs.transfer(clusters, b[:length], off, false)
+	if err == nil && n < len(b) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (vfs *FATVFS) WriteAt(file interface{}, b []byte, off int64) (int, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	return vfs.writeAt(file.(*FATFile), b, off)
+}
+
+func (vfs *FATVFS) writeAt(f *FATFile, b []byte, off int64) (int, error) {
+	if vfs.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	node := f.node
+	if off < 0 {
+		return 0, ErrInvalid
+	}
+	end := off + int64(len(b))
+	if end > 0xFFFFFFFF {
+		return 0, fmt.Errorf("file too large: %w", ErrNoSpace)
+	}
+	clusters, err := vfs.chain(node.cluster)
+	if err != nil {
+		return 0, err
+	}
+	// When the disk fills up, as much as fits is written and the clusters
+	// allocated so far are kept, so they are freed with the file
+	var allocErr error
+	for int64(len(clusters))*int64(vfs.clusterSize) < end {
+		prev := uint32(0)
+		if len(clusters) > 0 {
+			prev = clusters[len(clusters)-1]
+		}
+		c, err := vfs.allocCluster(prev)
+		if err != nil {
+			allocErr = err
+			break
+		}
+		if node.cluster == 0 {
+			node.cluster = c
+		}
+		clusters = append(clusters, c)
+	}
+	if capacity := int64(len(clusters)) * int64(vfs.clusterSize); end > capacity {
+		b = b[:max(capacity-off, 0)]
+	}
+	n, err := vfs.transfer(clusters, b, off, true)
+	if size := uint32(off) + uint32(n); size > node.size && (n > 0 || allocErr == nil) {
+		node.size = size
+	}
+	if !node.removed {
+		if uerr := vfs.updateEntry(node.entry, node.cluster, node.size); err == nil {
+			err = uerr
+		}
+	}
+	if err == nil {
+		err = allocErr
+	}
+	return n, err
+}
+
+// transfer reads or writes b at offset off of the file made up of clusters.
+func (vfs *FATVFS) transfer(clusters []uint32, b []byte, off int64, write bool) (int, error) {
+	done := 0
+	for done < len(b) {
+		pos := off + int64(done)
+		c := clusters[pos/int64(vfs.clusterSize)]
+		inner := pos % int64(vfs.clusterSize)
+		chunk := b[done:]
+		if rest := int64(vfs.clusterSize) - inner; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		var n int
+		var err error
+		if write {
+			n, err = vfs.img.WriteAt(chunk, vfs.clusterOffset(c)+inner)
+		} else {
+			n, err = vfs.img.ReadAt(chunk, vfs.clusterOffset(c)+inner)
+		}
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+func (vfs *FATVFS) Seek(file interface{}, off int64, whence int) (int64, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	f := file.(*FATFile)
+	switch whence {
+	case io.SeekCurrent:
+		off += f.offset
+	case io.SeekEnd:
+		off += int64(f.node.size)
+	}
+	if off < 0 {
+		return 0, ErrInvalid
+	}
+	f.offset = off
+	return off, nil
+}
+
+func (vfs *FATVFS) LoadBinary(file interface{}, mm *MemoryManager) (*ProgramInfo, error) {
+	data := make([]byte, file.(*FATFile).node.size)
+	if _, err := vfs.ReadAt(file, data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return loadBytecode(data, mm)
+}
+
+// FormatFAT creates a new, empty image of the given size. Images with less
+// than 4085 clusters use FAT12, larger ones FAT16.
+func FormatFAT(filename string, size int64) error {
+	const bytesPerSector = 512
+	const reserved = 1
+	const numFATs = 2
+	totalSectors := size / bytesPerSector
+	rootEntries := int64(512)
+	if size <= 2880*1024 {
+		rootEntries = 224
+	}
+	rootSectors := rootEntries * fatEntrySize / bytesPerSector
+
+	var sectorsPerCluster, sectorsPerFAT, clusters int64
+	fatType := 0
+	for spc := int64(1); spc <= 64 && fatType == 0; spc *= 2 {
+		fatSectors := int64(1)
+		for {
+			data := totalSectors - reserved - numFATs*fatSectors - rootSectors
+			if data < spc {
+				return errors.New("image is too small")
+			}
+			clusters = data / spc
+			need := (clusters + 2) * 2
+			if clusters < 4085 {
+				need = ((clusters+2)*3 + 1) / 2
+			}
+			needSectors := (need + bytesPerSector - 1) / bytesPerSector
+			if needSectors <= fatSectors {
+				break
+			}
+			fatSectors = needSectors
+		}
+		if clusters < 65525 {
+			sectorsPerCluster, sectorsPerFAT = spc, fatSectors
+			fatType = 16
+			if clusters < 4085 {
+				fatType = 12
+			}
+		}
+	}
+	if fatType == 0 {
+		return errors.New("image is too large for FAT16")
+	}
+
+	boot := make([]byte, bytesPerSector)
+	copy(boot, []byte{0xEB, 0x3C, 0x90})
+	copy(boot[3:], "VYPALVM ")
+	binary.LittleEndian.PutUint16(boot[11:], bytesPerSector)
+	boot[13] = byte(sectorsPerCluster)
+	binary.LittleEndian.PutUint16(boot[14:], reserved)
+	boot[16] = numFATs
+	binary.LittleEndian.PutUint16(boot[17:], uint16(rootEntries))
+	if totalSectors < 0x10000 {
+		binary.LittleEndian.PutUint16(boot[19:], uint16(totalSectors))
+	} else {
+		binary.LittleEndian.PutUint32(boot[32:], uint32(totalSectors))
+	}
+	boot[21] = 0xF8
+	binary.LittleEndian.PutUint16(boot[22:], uint16(sectorsPerFAT))
+	binary.LittleEndian.PutUint16(boot[24:], 32)
+	binary.LittleEndian.PutUint16(boot[26:], 2)
+	boot[36] = 0x80
+	boot[38] = 0x29
+	binary.LittleEndian.PutUint32(boot[39:], uint32(time.Now().Unix()))
+	copy(boot[43:], "NO NAME    ")
+	copy(boot[54:], fmt.Sprintf("FAT%d   ", fatType))
+	boot[510], boot[511] = 0x55, 0xAA
+
+	fat := make([]byte, sectorsPerFAT*bytesPerSector)
+	if fatType == 12 {
+		copy(fat, []byte{0xF8, 0xFF, 0xFF})
+	} else {
+		copy(fat, []byte{0xF8, 0xFF, 0xFF, 0xFF})
+	}
+
+	img, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = img.Truncate(totalSectors * bytesPerSector)
+	if err == nil {
+		_, err = img.WriteAt(boot, 0)
+	}
+	for i := int64(0); i < numFATs && err == nil; i++ {
+		_, err = img.WriteAt(fat, (reserved+i*sectorsPerFAT)*bytesPerSector)
+	}
+	if cerr := img.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
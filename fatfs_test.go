@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newFATImage formats an image of the given size in a temporary folder and
+// opens it.
+func newFATImage(t *testing.T, size int64) (*FATVFS, string) {
+	t.Helper()
+	image := filepath.Join(t.TempDir(), "disk.img")
+	if err := FormatFAT(image, size); err != nil {
+		t.Fatal(err)
+	}
+	vfs, err := OpenFAT(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { vfs.CloseImage() })
+	return vfs, image
+}
+
+func TestFATPutGet(t *testing.T) {
+	tests := []struct {
+		name string
+		size int64
+		dest string
+		data []byte
+	}{
+		{"empty file on a floppy", DefaultFATImageSize, "/EMPTY.TXT", nil},
+		{"small file on a floppy", DefaultFATImageSize, "/hello.txt", []byte("hello world")},
+		{"several clusters on a floppy", DefaultFATImageSize, "/big.bin", bytes.Repeat([]byte("0123456789"), 2000)},
+		{"several clusters on FAT16", 16 * 1024 * 1024, "/big.bin", bytes.Repeat([]byte("abcdefgh"), 10000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vfs, image := newFATImage(t, tt.size)
+			src := filepath.Join(t.TempDir(), "src")
+			if err := os.WriteFile(src, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := fatPut(vfs, src, tt.dest); err != nil {
+				t.Fatal(err)
+			}
+			vfs.CloseImage()
+
+			// Read the file back from a freshly opened image, so it has to
+			// come from the disk
+			vfs, err := OpenFAT(image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vfs.CloseImage()
+			dest := filepath.Join(t.TempDir(), "dest")
+			if err := fatGet(vfs, tt.dest, dest); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("got %d bytes back, want %d", len(got), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestFATFullDisk(t *testing.T) {
+	vfs, _ := newFATImage(t, 64*1024)
+	file, err := vfs.Create("/FULL.BIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := vfs.Write(file, make([]byte, 128*1024))
+	if !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("writing more than the disk holds: got %v, want %v", err, ErrNoSpace)
+	}
+	vfs.Close(file)
+	if info, err := vfs.Stat("/FULL.BIN"); err != nil || n == 0 || info.Size != int64(n) {
+		t.Fatalf("wrote %d bytes until the disk was full, but the file has %v bytes (%v)", n, info, err)
+	}
+
+	// Small files still fit into the root folder, but not into the data area
+	other, err := vfs.Create("/OTHER.BIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vfs.Write(other, []byte("x")); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("writing to a full disk: got %v, want %v", err, ErrNoSpace)
+	}
+	vfs.Close(other)
+
+	// Removing the file frees its clusters again
+	if err := vfs.Remove("/FULL.BIN"); err != nil {
+		t.Fatal(err)
+	}
+	other, err = vfs.Open("/OTHER.BIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vfs.Close(other)
+	if _, err := vfs.Write(other, make([]byte, 32*1024)); err != nil {
+		t.Fatalf("writing after freeing space: %v", err)
+	}
+}
+
+func TestFATRootFolderFull(t *testing.T) {
+	vfs, _ := newFATImage(t, DefaultFATImageSize)
+	for i := 0; ; i++ {
+		name := "/" + string(rune('A'+i/26%26)) + string(rune('A'+i%26)) + ".TXT"
+		file, err := vfs.Create(name)
+		if errors.Is(err, ErrNoSpace) {
+			if i != 224 {
+				t.Errorf("root folder full after %d files, want 224", i)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		vfs.Close(file)
+		if i > 224 {
+			t.Fatal("root folder never filled up")
+		}
+	}
+}
+
+func TestFATShortNames(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		ok   bool
+	}{
+		{"readme.txt", "README  TXT", true},
+		{"A", "A          ", true},
+		{"12345678.abc", "12345678ABC", true},
+		{"makefile", "MAKEFILE   ", true},
+		{"~tmp$.b-1", "~TMP$   B-1", true},
+		{"\xe5a.txt", "", false},
+		{"123456789.txt", "", false},
+		{"file.text", "", false},
+		{"a.b.c", "", false},
+		{".hidden", "", false},
+		{"has space.txt", "", false},
+		{"what?.txt", "", false},
+		{"plus+.txt", "", false},
+	}
+	vfs, _ := newFATImage(t, DefaultFATImageSize)
+	for _, tt := range tests {
+		raw, err := encodeName(tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("encodeName(%q): got error %v, want ok = %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("encodeName(%q): got %v, want %v", tt.name, err, ErrInvalid)
+			}
+			if _, err := vfs.Create("/" + tt.name); !errors.Is(err, ErrInvalid) {
+				t.Errorf("Create(%q): got %v, want %v", tt.name, err, ErrInvalid)
+			}
+			continue
+		}
+		if string(raw[:]) != tt.raw {
+			t.Errorf("encodeName(%q) = %q, want %q", tt.name, raw, tt.raw)
+		}
+
+		// Names are stored in upper case but found in any case
+		file, err := vfs.Create("/" + tt.name)
+		if err != nil {
+			t.Errorf("Create(%q): %v", tt.name, err)
+			continue
+		}
+		vfs.Close(file)
+		info, err := vfs.Stat("/" + tt.name)
+		if err != nil {
+			t.Errorf("Stat(%q): %v", tt.name, err)
+			continue
+		}
+		if info.Name != decodeName(raw[:]) {
+			t.Errorf("Stat(%q).Name = %q, want %q", tt.name, info.Name, decodeName(raw[:]))
+		}
+	}
+}
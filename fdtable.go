@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// DefaultMaxFiles is the default number of file descriptors a CPU can have
+// open at the same time.
+const DefaultMaxFiles = 64
+
+var (
+	ErrBadFileDescriptor = errors.New("bad file descriptor")
+	ErrTooManyFiles      = errors.New("too many open files")
+)
+
+// OpenFile is a file opened through a VFS. Descriptors created with DUP and
+// DUP2 share the same OpenFile, and with it the file position.
+type OpenFile struct {
+	FS   VFS
+	File interface{}
+	refs int
+}
+
+// FileTable maps file descriptors to open files. New descriptors always get
+// the lowest number that is not in use.
+type FileTable struct {
+	Files map[uint32]*OpenFile
+	Limit uint32
+}
+
+func NewFileTable(limit uint32) *FileTable {
+	return &FileTable{
+		Files: make(map[uint32]*OpenFile),
+		Limit: limit,
+	}
+}
+
+func (t *FileTable) lowestFree() (uint32, error) {
+	for fd := uint32(0); fd < t.Limit; fd++ {
+		if _, ok := t.Files[fd]; !ok {
+			return fd, nil
+		}
+	}
+	return 0, ErrTooManyFiles
+}
+
+// Add stores a file that was just opened and returns its descriptor. If the
+// table is full the file is closed again.
+func (t *FileTable) Add(fs VFS, file interface{}) (uint32, error) {
+	fd, err := t.lowestFree()
+	if err != nil {
+		fs.Close(file)
+		return 0, err
+	}
+	t.Files[fd] = &OpenFile{FS: fs, File: file, refs: 1}
+	return fd, nil
+}
+
+func (t *FileTable) Get(fd uint32) (*OpenFile, error) {
+	f, ok := t.Files[fd]
+	if !ok {
+		return nil, ErrBadFileDescriptor
+	}
+	return f, nil
+}
+
+// Close removes a descriptor. The file itself is only closed once no other
+// descriptor refers to it.
+func (t *FileTable) Close(fd uint32) error {
+	f, ok := t.Files[fd]
+	if !ok {
+		return ErrBadFileDescriptor
+	}
+	delete(t.Files, fd)
+	f.refs--
+	if f.refs > 0 {
+		return nil
+	}
+	return f.FS.Close(f.File)
+}
+
+// LastRef reports whether fd is the only descriptor of its open file, so
+// closing it closes the file.
+func (t *FileTable) LastRef(fd uint32) bool {
+	f, ok := t.Files[fd]
+	return ok && f.refs == 1
+}
+
+// Dup creates a new descriptor for the same open file.
+func (t *FileTable) Dup(fd uint32) (uint32, error) {
+	f, err := t.Get(fd)
+	if err != nil {
+		return 0, err
+	}
+	newFD, err := t.lowestFree()
+	if err != nil {
+		return 0, err
+	}
+	f.refs++
+	t.Files[newFD] = f
+	return newFD, nil
+}
+
+// Dup2 makes newFD refer to the same open file as fd, closing whatever newFD
+// referred to before.
+func (t *FileTable) Dup2(fd uint32, newFD uint32) error {
+	f, err := t.Get(fd)
+	if err != nil {
+		return err
+	}
+	if newFD >= t.Limit {
+		return ErrBadFileDescriptor
+	}
+	if fd == newFD {
+		return nil
+	}
+	if _, ok := t.Files[newFD]; ok {
+		t.Close(newFD)
+	}
+	f.refs++
+	t.Files[newFD] = f
+	return nil
+}
+
+// FDs returns all descriptors in use, in ascending order.
+func (t *FileTable) FDs() []uint32 {
+	fds := make([]uint32, 0, len(t.Files))
+	for fd := range t.Files {
+		fds = append(fds, fd)
+	}
+	sort.Slice(fds, func(i, j int) bool { return fds[i] < fds[j] })
+	return fds
+}
+
+func (t *FileTable) CloseAll() {
+	for _, fd := range t.FDs() {
+		t.Close(fd)
+	}
+}
+
+// CloseFile closes a file descriptor. If this is the last descriptor of the
+// file, memory mappings of the file are written back and removed first, and
+// asynchronous requests that were not carried out yet are cancelled.
+func (c *CPU) CloseFile(fd uint32) error {
+	if c.FileTable.LastRef(fd) {
+		c.MemoryManager.UnmapFile(c.FileTable.Files[fd].File)
+		c.AsyncIO.Cancel(c.FileTable.Files[fd])
+	}
+	return c.FileTable.Close(fd)
+}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 )
 
+// VFS is a filesystem the VM can use. Implementations must be safe for
+// concurrent use, since AREAD and AWRITE are carried out on a host goroutine
+// while the program keeps using the filesystem.
 type VFS interface {
 	Open(string) (interface{}, error)
 	Close(interface{}) error
 	Create(string) (interface{}, error)
 	Remove(string) error
+	Rename(string, string) error
+	Mkdir(string) error
 	Stat(string) (*FileInfo, error)
 	ReadDir(string) ([]*FileInfo, error)
 	Read(interface{}, []byte) (int, error)
@@ -18,19 +28,85 @@ type VFS interface {
 	ReadAt(interface{}, []byte, int64) (int, error)
 	WriteAt(interface{}, []byte, int64) (int, error)
 	Seek(interface{}, int64, int) (int64, error)
-	LoadBinary(interface{}, *MemoryManager) uint32
+	LoadBinary(interface{}, *MemoryManager) (*ProgramInfo, error)
 }
 
+// NewVFSFromSpec creates the VFS driver described by spec, which is either
+// "folder", "memory", "tar:<archive>", "zip:<archive>" or "fat:<image>". The folder driver
+// uses root as its root folder, and the memory driver is preloaded from it if
+// it exists. Both also accept a different root as "folder:<root>".
+func NewVFSFromSpec(spec string, root string) (VFS, error) {
+	kind, arg, hasArg := strings.Cut(spec, ":")
+	if hasArg && (kind == "folder" || kind == "memory") {
+		root = arg
+	}
+	switch kind {
+	case "folder":
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			if err := os.Mkdir(root, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create root folder: %w", err)
+			}
+		}
+		return &FolderBasedVFS{Root: root}, nil
+	case "memory":
+		vfs := NewMemoryVFS()
+		if info, err := os.Stat(root); err == nil {
+			if info.IsDir() {
+				err = vfs.LoadDir(root)
+			} else {
+				err = vfs.LoadArchive(root)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to preload memory filesystem: %w", err)
+			}
+		}
+		return vfs, nil
+	case "fat":
+		return OpenFAT(arg)
+	case "tar", "zip":
+		if !strings.HasSuffix(arg, "."+kind) {
+			return nil, fmt.Errorf("%s filesystem needs a .%s file", kind, kind)
+		}
+		return NewArchiveVFS(arg)
+	}
+	return nil, fmt.Errorf("unknown filesystem type %q", spec)
+}
+
+// MaxTransferLength is the most bytes a single PREAD, PWRITE, AREAD or AWRITE
+// can transfer, so a program cannot make the host allocate arbitrarily large
+// buffers.
+const MaxTransferLength = 1 << 20
+
+// MaxDirEntryName is the longest file name READDIR writes to memory, longer
+// names are cut off.
+const MaxDirEntryName = 255
+
 type FileInfo struct {
 	Name string
 	Size int64
 	Mode os.FileMode
 }
 
+// FolderBasedVFS serves the files in a folder on the host. Every path is
+// resolved inside Root, including symlinks, so the guest cannot reach any file
+// outside of it. Quota limits the total number of bytes files can grow by, 0
+// means no limit.
 type FolderBasedVFS struct {
-	Root string
+	Root     string
+	ReadOnly bool
+	Quota    int64
+	Written  int64
+	mu       sync.Mutex
 }
 
+var (
+	ErrPathEscapes   = errors.New("path escapes from the filesystem root")
+	ErrQuotaExceeded = errors.New("filesystem quota exceeded")
+)
+
+// maxSymlinks is the number of symlinks followed while resolving a single path.
+const maxSymlinks = 40
+
 type FolderBasedFile struct {
 	Name string
 	File *os.File
@@ -60,12 +136,74 @@ func (f *FolderBasedFile) Seek(off int64, whence int) (int64, error) {
 	return f.File.Seek(off, whence)
 }
 
+func (f *FolderBasedFile) FileName() string {
+	return f.Name
+}
+
+// resolve returns the host path of name. Symlinks are followed as long as they
+// stay inside Root, the last element is only followed if followLast is set.
+// Parts of the path that do not exist yet are kept as they are.
+func (vfs *FolderBasedVFS) resolve(name string, followLast bool) (string, error) {
+	var resolved []string
+	pending := strings.Split(filepath.ToSlash(name), "/")
+	links := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", ErrPathEscapes
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		full := filepath.Join(vfs.Root, filepath.Join(resolved...), part)
+		info, err := os.Lstat(full)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 || (len(pending) == 0 && !followLast) {
+			resolved = append(resolved, part)
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links: %w", ErrInvalid)
+		}
+		target, err := os.Readlink(full)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			return "", ErrPathEscapes
+		}
+		pending = append(strings.Split(filepath.ToSlash(target), "/"), pending...)
+	}
+	return filepath.Join(vfs.Root, filepath.Join(resolved...)), nil
+}
+
 func (vfs *FolderBasedVFS) Open(name string) (interface{}, error) {
-	file, err := os.OpenFile(filepath.Join(vfs.Root, name), os.O_RDWR, 0644)
+	p, err := vfs.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	flag := os.O_RDWR
+	if vfs.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(p, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
 	return &FolderBasedFile{
 		Name: name,
 		File: file,
-	}, err
+	}, nil
 }
 
 func (vfs *FolderBasedVFS) Close(file interface{}) error {
@@ -73,28 +211,86 @@ func (vfs *FolderBasedVFS) Close(file interface{}) error {
 }
 
 func (vfs *FolderBasedVFS) Create(name string) (interface{}, error) {
-	file, err := os.Create(name)
+	if vfs.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	p, err := vfs.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
 	return &FolderBasedFile{
 		Name: name,
 		File: file,
-	}, err
+	}, nil
+}
+
+// Mkdir creates a folder and all of its missing parents.
+func (vfs *FolderBasedVFS) Mkdir(name string) error {
+	if vfs.ReadOnly {
+		return ErrReadOnly
+	}
+	p, err := vfs.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, 0755)
 }
 
 func (vfs *FolderBasedVFS) Remove(name string) error {
-	return os.Remove(name)
+	if vfs.ReadOnly {
+		return ErrReadOnly
+	}
+	p, err := vfs.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	if p == filepath.Join(vfs.Root) {
+		return fmt.Errorf("cannot remove the filesystem root: %w", ErrBusy)
+	}
+	return os.Remove(p)
+}
+
+func (vfs *FolderBasedVFS) Rename(oldName string, newName string) error {
+	if vfs.ReadOnly {
+		return ErrReadOnly
+	}
+	oldPath, err := vfs.resolve(oldName, false)
+	if err != nil {
+		return err
+	}
+	newPath, err := vfs.resolve(newName, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
 }
 
 func (vfs *FolderBasedVFS) Stat(name string) (*FileInfo, error) {
-	fileInfo, err := os.Stat(name)
+	p, err := vfs.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
 	return &FileInfo{
-		Name: name,
+		Name: path.Base(cleanPath(name)),
 		Size: fileInfo.Size(),
 		Mode: fileInfo.Mode(),
-	}, err
+	}, nil
 }
 
 func (vfs *FolderBasedVFS) ReadDir(name string) ([]*FileInfo, error) {
-	files, err := os.ReadDir(name)
+	p, err := vfs.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(p)
 	fileInfos := make([]*FileInfo, 0, len(files))
 	for _, file := range files {
 		fileInfo, err := file.Info()
@@ -110,12 +306,44 @@ func (vfs *FolderBasedVFS) ReadDir(name string) ([]*FileInfo, error) {
 	return fileInfos, err
 }
 
+// reserve accounts for n bytes about to be written to f at off, failing if
+// that would exceed the quota. Only bytes past the current end of the file are
+// counted, so overwriting existing data does not use up the quota.
+func (vfs *FolderBasedVFS) reserve(f *FolderBasedFile, off int64, n int) error {
+	if vfs.ReadOnly {
+		return ErrReadOnly
+	}
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	growth := off + int64(n) - info.Size()
+	if growth <= 0 {
+		return nil
+	}
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	if vfs.Quota > 0 && vfs.Written+growth > vfs.Quota {
+		return ErrQuotaExceeded
+	}
+	vfs.Written += growth
+	return nil
+}
+
 func (vfs *FolderBasedVFS) Read(file interface{}, b []byte) (int, error) {
 	return file.(*FolderBasedFile).Read(b)
 }
 
 func (vfs *FolderBasedVFS) Write(file interface{}, b []byte) (int, error) {
-	return file.(*FolderBasedFile).Write(b)
+	f := file.(*FolderBasedFile)
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if err := vfs.reserve(f, off, len(b)); err != nil {
+		return 0, err
+	}
+	return f.Write(b)
 }
 
 func (vfs *FolderBasedVFS) ReadAt(file interface{}, b []byte, off int64) (int, error) {
@@ -123,29 +351,39 @@ func (vfs *FolderBasedVFS) ReadAt(file interface{}, b []byte, off int64) (int, e
 }
 
 func (vfs *FolderBasedVFS) WriteAt(file interface{}, b []byte, off int64) (int, error) {
-	return file.(*FolderBasedFile).WriteAt(b, off)
+	f := file.(*FolderBasedFile)
+	if err := vfs.reserve(f, off, len(b)); err != nil {
+		return 0, err
+	}
+	return f.WriteAt(b, off)
 }
 
 func (vfs *FolderBasedVFS) Seek(file interface{}, off int64, whence int) (int64, error) {
 	return file.(*FolderBasedFile).Seek(off, whence)
 }
 
-func (vfs *FolderBasedVFS) LoadBinary(file interface{}, mm *MemoryManager) uint32 {
+func (vfs *FolderBasedVFS) LoadBinary(file interface{}, mm *MemoryManager) (*ProgramInfo, error) {
 	f := file.(*FolderBasedFile)
 	l, err := f.File.Seek(0, io.SeekEnd)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	f.File.Seek(0, io.SeekStart)
 	data := make([]byte, l)
 	_, err = f.File.Read(data)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
+	return loadBytecode(data, mm)
+}
+
+// loadBytecode loads the program in data into memory. It is shared by the VFS
+// drivers once they have read the whole file.
+func loadBytecode(data []byte, mm *MemoryManager) (*ProgramInfo, error) {
 	bc, err := DecodeBytecode(data)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	program := mm.NewProgram()
@@ -156,5 +394,8 @@ func (vfs *FolderBasedVFS) LoadBinary(file interface{}, mm *MemoryManager) uint3
 		}
 	}
 
-	return mm.LoadProgram(program)
+	if _, err := mm.LoadProgram(program); err != nil {
+		return nil, err
+	}
+	return program, nil
 }
@@ -0,0 +1,140 @@
+package main
+
+// Fork returns an independent copy of the machine. Physical memory is shared
+// copy-on-write with the original, so forking is cheap no matter how much
+// memory is in use. Registers, tasks and the file table are copied, with every
+// open file reopened from the VFS so the two machines do not share offsets.
+// The mount table is copied too, so MOUNT and UMOUNT only affect one machine.
+func (c *CPU) Fork() (*CPU, error) {
+	if c.AsyncIO.Outstanding() > 0 {
+		return nil, ErrAsyncInProgress
+	}
+	files, fds, err := c.openFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &CPU{
+		Registers:              c.Registers,
+		Halted:                 c.Halted,
+		Fault:                  c.Fault,
+		LastAccessedAddress:    c.LastAccessedAddress,
+		LastInstructionAddress: c.LastInstructionAddress,
+		LeakReport:             c.LeakReport,
+		FileSystem:             cloneMounts(c.FileSystem),
+		InputQueue:             make(chan string),
+		InterruptPending:       c.InterruptPending,
+		InterruptProcessing:    c.InterruptProcessing,
+		OriginalPC:             c.OriginalPC,
+		InterruptVector:        c.InterruptVector,
+		InterruptData:          c.InterruptData,
+		InterruptReturned:      make(chan bool),
+		Interrupts:             c.queuedInterrupts(),
+	}
+	f.Console = &Console{cpu: f, Cursor: c.Console.Cursor}
+	f.FileTable, err = f.reopenFiles(files, c.FileTable.Limit, f.Console)
+	if err != nil {
+		return nil, err
+	}
+	f.MemoryManager = c.MemoryManager.fork(f, fds)
+	f.Scheduler = c.Scheduler.fork(f)
+	f.AsyncIO = c.AsyncIO.fork()
+
+	go f.KeyboardInputLoop()
+	return f, nil
+}
+
+// cloneMounts returns vfs with the MountVFS in it replaced by a clone, along
+// with new wrappers around the clone.
+func cloneMounts(vfs VFS) VFS {
+	switch v := vfs.(type) {
+	case *MountVFS:
+		return v.Clone()
+	case *TracingVFS:
+		if inner := cloneMounts(v.FS); inner != v.FS {
+			return &TracingVFS{FS: inner, Trace: v.Trace, Faults: v.Faults}
+		}
+	}
+	return vfs
+}
+
+func (mm *MemoryManager) fork(cpu *CPU, fds map[interface{}]uint32) *MemoryManager {
+	// Frames are only ever taken from the front of FreeFrames and appended to
+	// the back, so both copies can share it as long as neither can append in
+	// place.
+	n := len(mm.FreeFrames)
+	mm.FreeFrames = mm.FreeFrames[:n:n]
+
+	f := &MemoryManager{
+		Memory:           mm.Memory.Fork(),
+		cpu:              cpu,
+		PageTable:        make(map[uint32]uint32, len(mm.PageTable)),
+		FreeFrames:       mm.FreeFrames,
+		FrameRefs:        make(map[uint32]uint32, len(mm.FrameRefs)),
+		VirtualStackEnd:  mm.VirtualStackEnd,
+		VirtualHeapStart: mm.VirtualHeapStart,
+		StackSize:        mm.StackSize,
+		Allocations:      make(map[uint32]*Allocation, len(mm.Allocations)),
+		PeakPages:        mm.PeakPages,
+	}
+	for k, v := range mm.PageTable {
+		f.PageTable[k] = v
+	}
+	for k, v := range mm.FrameRefs {
+		f.FrameRefs[k] = v
+	}
+	for k, v := range mm.Allocations {
+		a := *v
+		f.Allocations[k] = &a
+	}
+	for _, p := range mm.Programs {
+		// Unloaded programs leave a hole, which is kept so handles still match
+		var program *ProgramInfo
+		if p != nil {
+			program = new(ProgramInfo)
+			*program = *p
+		}
+		f.Programs = append(f.Programs, program)
+	}
+	for _, s := range mm.SharedMemory {
+		shm := *s
+		shm.Frames = append([]uint32{}, s.Frames...)
+		f.SharedMemory = append(f.SharedMemory, &shm)
+	}
+	for _, m := range mm.Mappings {
+		mapping := &MemoryMapping{
+			Start:  m.Start,
+			Length: m.Length,
+			Dirty:  make(map[uint32]bool, len(m.Dirty)),
+		}
+		for k, v := range m.Dirty {
+			mapping.Dirty[k] = v
+		}
+		if m.Shared != nil {
+			mapping.Shared = f.SharedMemory[m.Shared.Handle]
+		} else {
+			mapping.FS = cpu.FileTable.Files[fds[m.File]].FS
+			mapping.File = cpu.FileTable.Files[fds[m.File]].File
+		}
+		f.Mappings = append(f.Mappings, mapping)
+	}
+	return f
+}
+
+func (s *Scheduler) fork(cpu *CPU) *Scheduler {
+	f := &Scheduler{
+		cpu:       cpu,
+		NextID:    s.NextID,
+		TimeSlice: s.TimeSlice,
+		StackTop:  s.StackTop,
+		ticks:     s.ticks,
+	}
+	for _, t := range s.Tasks {
+		task := *t
+		f.Tasks = append(f.Tasks, &task)
+		if t == s.Current {
+			f.Current = &task
+		}
+	}
+	return f
+}
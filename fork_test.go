@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+// unloadProgram loads a library twice and unloads the first copy, which
+// leaves a hole at handle 1.
+const unloadProgram = `
+.DATA
+    name DB "lib.bin", 0
+.TEXT
+    OPEN R1 [name]
+    LOADBIN R1 R2
+    UNLOAD 1
+    OPEN R1 [name]
+    LOADBIN R1 R2
+    HLT
+`
+
+// newUnloadCPU runs unloadProgram and returns the halted machine.
+func newUnloadCPU(t *testing.T) *CPU {
+	t.Helper()
+	lib, err := EncodeBytecode(assemble(t, ".TEXT\n    HLT\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewMemoryVFS()
+	fs.AddFile("lib.bin", lib)
+	c := NewCPU()
+	c.FileSystem = fs
+	c.LoadProgram(assemble(t, unloadProgram))
+	runUntilHalted(t, c)
+	if c.Registers[15] != 2 {
+		t.Fatalf("second LOADBIN returned handle %d, want 2", c.Registers[15])
+	}
+	return c
+}
+
+func TestForkAfterUnload(t *testing.T) {
+	c := newUnloadCPU(t)
+	f, err := c.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		handle uint32
+		loaded bool
+	}{
+		{0, true},
+		{1, false},
+		{2, true},
+		{3, false},
+	}
+	for _, tt := range tests {
+		want, _ := c.MemoryManager.Program(tt.handle)
+		got, err := f.MemoryManager.Program(tt.handle)
+		if (err == nil) != tt.loaded {
+			t.Errorf("program %d: got error %v, want loaded = %v", tt.handle, err, tt.loaded)
+			continue
+		}
+		if tt.loaded && (got == want || got.Handle != tt.handle || got.BaseAddress != want.BaseAddress) {
+			t.Errorf("program %d in the fork is %+v, want a copy of %+v", tt.handle, got, want)
+		}
+	}
+
+	// Unloading in the fork leaves the original alone
+	if err := f.MemoryManager.UnloadProgram(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.MemoryManager.Program(2); err != nil {
+		t.Errorf("program 2 was unloaded from the original: %v", err)
+	}
+}
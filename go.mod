@@ -2,8 +2,9 @@ module github.com/vyPal/VM
 
 go 1.23.1
 
+require github.com/gizak/termui/v3 v3.1.0
+
 require (
-	github.com/gizak/termui/v3 v3.1.0 // indirect
 	github.com/mattn/go-runewidth v0.0.2 // indirect
 	github.com/mitchellh/go-wordwrap v0.0.0-20150314170334-ad45545899c7 // indirect
 	github.com/nsf/termbox-go v0.0.0-20190121233118-02980233997d // indirect
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parseFileName parses the quoted file name given to INCLUDE or INCBIN.
+func parseFileName(arg string) (string, error) {
+	name, err := strconv.Unquote(arg)
+	if err != nil || name == "" {
+		return "", fmt.Errorf("expected a file name in quotes, got %s", arg)
+	}
+	return name, nil
+}
+
+// findFile looks for a file next to the file being parsed first, and then
+// in the include paths.
+func (p *Parser) findFile(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	dirs := append([]string{filepath.Dir(p.file)}, p.IncludePaths...)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("cannot find %s", name)
+}
+
+// markIncluded records that a file has been parsed into the current scope,
+// and tells whether it had been parsed into it before. Every top-level file
+// has its own scope, so a header shared by several files is parsed once for
+// each of them.
+func (p *Parser) markIncluded(filename string) bool {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		path = filename
+	}
+	if p.scope.included[path] {
+		return true
+	}
+	p.scope.included[path] = true
+	return false
+}
+
+// parseLines parses the lines of a file, keeping track of their positions.
+func (p *Parser) parseLines(filename string, contents []byte) {
+	oldFile, oldLine := p.file, p.line
+	p.file = filename
+	for i, line := range strings.Split(string(contents), "\n") {
+		p.line = i + 1
+		p.ParseLine(strings.TrimSuffix(line, "\r"))
+	}
+	p.file, p.line = oldFile, oldLine
+}
+
+// parseInclude parses another file in place of the INCLUDE line. A file is
+// only included once into each top-level file, so files can include each
+// other freely.
+func (p *Parser) parseInclude(fields []field) {
+	if len(fields) != 2 {
+		p.errorf(p.col(0), "INCLUDE expects 1 file name, got %d", len(fields)-1)
+		return
+	}
+	name, err := parseFileName(fields[1].text)
+	if err == nil {
+		name, err = p.findFile(name)
+	}
+	if err != nil {
+		p.errorf(p.col(fields[1].offset), "%v", err)
+		return
+	}
+	if p.markIncluded(name) {
+		return
+	}
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		p.errorf(p.col(fields[1].offset), "%v", err)
+		return
+	}
+
+	p.expansions = append(p.expansions, expansion{file: p.file, line: p.line})
+	p.parseLines(name, contents)
+	p.checkMacros()
+	p.expansions = p.expansions[:len(p.expansions)-1]
+}
+
+// parseIncbin adds the bytes of a file to the data section, as if they were
+// given to DB.
+func (p *Parser) parseIncbin(name string, arg field) {
+	filename, err := parseFileName(arg.text)
+	if err == nil {
+		filename, err = p.findFile(filename)
+	}
+	var contents []byte
+	if err == nil {
+		contents, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		p.errorf(p.col(arg.offset), "%v", err)
+		return
+	}
+	for _, b := range contents {
+		p.CurrentSector.Data = append(p.CurrentSector.Data, &Data{
+			Name:  name,
+			Size:  1,
+			Value: uint32(b),
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInclude(t *testing.T) {
+	const include = "INCLUDE \"defs.inc\"\n"
+	const useWidth = include + ".TEXT\n    LD R1 WIDTH\n    HLT\n"
+	tests := []struct {
+		name     string
+		files    map[string]string
+		includes []string
+		// r1 is the value of R1 once the program halted, or diags the
+		// formatted diagnostics if it does not assemble
+		r1    uint32
+		diags string
+	}{
+		{
+			name:  "next to the file",
+			files: map[string]string{"test.asm": useWidth, "defs.inc": "WIDTH EQU 40\n"},
+			r1:    40,
+		},
+		{
+			name:     "include path",
+			files:    map[string]string{"test.asm": useWidth, "lib/defs.inc": "WIDTH EQU 40\n"},
+			includes: []string{"lib"},
+			r1:       40,
+		},
+		{
+			name:     "next to the file before the include paths",
+			files:    map[string]string{"test.asm": useWidth, "defs.inc": "WIDTH EQU 40\n", "lib/defs.inc": "WIDTH EQU 80\n"},
+			includes: []string{"lib"},
+			r1:       40,
+		},
+		{
+			name:     "include paths in order",
+			files:    map[string]string{"test.asm": useWidth, "lib/defs.inc": "WIDTH EQU 40\n", "other/defs.inc": "WIDTH EQU 80\n"},
+			includes: []string{"other", "lib"},
+			r1:       80,
+		},
+		{
+			name: "included once",
+			files: map[string]string{
+				"test.asm": "INCLUDE \"a.inc\"\nINCLUDE \"a.inc\"\n.TEXT\n    LD R1 A+B\n    HLT\n",
+				"a.inc":    "INCLUDE \"b.inc\"\nA EQU 1\n",
+				"b.inc":    "INCLUDE \"a.inc\"\nB EQU 2\n",
+			},
+			r1: 3,
+		},
+		{
+			name: "INCBIN from an include path",
+			files: map[string]string{
+				"test.asm":     ".DATA\n    data INCBIN \"data.bin\"\n.TEXT\n    LD R1 [data]\n    HLT\n",
+				"lib/data.bin": "\x01\x02\x03\x04",
+			},
+			includes: []string{"lib"},
+			r1:       0x04030201,
+		},
+		{
+			name:  "missing file",
+			files: map[string]string{"test.asm": include},
+			diags: `test.asm:1:9: error: cannot find defs.inc
+    INCLUDE "defs.inc"
+            ^`,
+		},
+		{
+			name:  "not in the include path",
+			files: map[string]string{"test.asm": include, "lib/defs.inc": "WIDTH EQU 40\n"},
+			diags: `test.asm:1:9: error: cannot find defs.inc
+    INCLUDE "defs.inc"
+            ^`,
+		},
+		{
+			name:  "missing quotes",
+			files: map[string]string{"test.asm": "INCLUDE defs.inc\n"},
+			diags: `test.asm:1:9: error: expected a file name in quotes, got defs.inc
+    INCLUDE defs.inc
+            ^`,
+		},
+		{
+			name:  "missing INCBIN file",
+			files: map[string]string{"test.asm": ".DATA\n    data INCBIN \"data.bin\"\n"},
+			diags: `test.asm:2:17: error: cannot find data.bin
+        data INCBIN "data.bin"
+                    ^`,
+		},
+		{
+			name:  "error in an included file",
+			files: map[string]string{"test.asm": include, "defs.inc": "WIDTH EQU 40 +\n"},
+			diags: `defs.inc:1:11: error: expected a value at the end of the expression
+    WIDTH EQU 40 +
+              ^
+    note: included from test.asm:1`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := parseFiles(t, tt.files, tt.includes, "test.asm")
+			var diags []string
+			for _, d := range p.Diagnostics {
+				diags = append(diags, d.Format())
+			}
+			if got := strings.Join(diags, "\n"); got != tt.diags {
+				t.Fatalf("got diagnostics\n%s\nwant\n%s", got, tt.diags)
+			}
+			if tt.diags != "" {
+				return
+			}
+
+			c := NewCPU()
+			if err := c.LoadProgram(ProgramToBytecode(p)); err != nil {
+				t.Fatal(err)
+			}
+			runUntilHalted(t, c)
+			if c.Registers[1] != tt.r1 {
+				t.Errorf("R1 = %#x, want %#x", c.Registers[1], tt.r1)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
+	"io/fs"
 )
 
 // Oh how I love writing repetative code :D
@@ -23,6 +25,20 @@ const (
 	Imm
 )
 
+func (t OperandType) String() string {
+	switch t {
+	case Reg:
+		return "a register"
+	case DMem:
+		return "a memory address"
+	case IMem:
+		return "an indirect memory address"
+	case Imm:
+		return "an immediate value"
+	}
+	return "an unknown operand"
+}
+
 type RegOperand struct {
 	RegNum byte
 	Size   byte // 0x0 = 32-bit, 0x1 = 16-bit, 0x2 = 8-bit, onlt first 2 bits are used
@@ -1030,6 +1046,7 @@ var instructionSet = map[uint8]*Instruction{
 		Name:   "HLT",
 		Execute: func(cpu *CPU, operands []Operand) {
 			cpu.Halted = true
+			cpu.LeakReport = cpu.MemoryManager.LeakReport()
 		},
 	},
 	0x1B: {
@@ -1071,21 +1088,25 @@ var instructionSet = map[uint8]*Instruction{
 		Name:   "OPEN",
 		Execute: func(cpu *CPU, operands []Operand) {
 			r := operands[0].Value.(*RegOperand)
-			fd := cpu.NextFD
-			var err error
+			var name string
 			switch operands[1].Type {
 			case DMem:
 				cpu.LastAccessedAddress = operands[1].Value.(*DMemOperand).ComputeAddress(cpu)
-				cpu.FileTable[fd], err = cpu.FileSystem.Open(cpu.MemoryManager.ReadMemoryString(operands[1].Value.(*DMemOperand).ComputeAddress(cpu)))
+				name = cpu.MemoryManager.ReadMemoryString(operands[1].Value.(*DMemOperand).ComputeAddress(cpu))
 			case IMem:
 				cpu.LastAccessedAddress = cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu))
-				cpu.FileTable[fd], err = cpu.FileSystem.Open(cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu))))
+				name = cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu)))
 			}
+			var fd uint32
+			file, err := cpu.FileSystem.Open(name)
+			if err == nil {
+				fd, err = cpu.FileTable.Add(cpu.FileSystem, file)
+			}
+			cpu.SetError(err)
 			if err != nil {
 				cpu.Registers[r.RegNum] = 0xFFFFFFFF
 			} else {
-				cpu.Registers[r.RegNum] = uint32(fd)
-				cpu.NextFD++
+				cpu.Registers[r.RegNum] = fd
 			}
 		},
 		Operands: []Operand{
@@ -1113,18 +1134,33 @@ var instructionSet = map[uint8]*Instruction{
 			}
 
 			if length == 0 {
+				cpu.SetError(ErrInvalid)
 				cpu.Registers[0xF] = 0xFFFFFFFF
 				return
 			}
 
 			if operands[1].Type == Reg && length > 1 {
+				cpu.SetError(ErrInvalid)
 				cpu.Registers[0xF] = 0xFFFFFFFF
 				return
 			}
 
-			data := make([]byte, length)
-			n, err := cpu.FileSystem.Read(cpu.FileTable[fd], data)
+			file, err := cpu.FileTable.Get(fd)
 			if err != nil {
+				cpu.SetError(err)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			data := make([]byte, length)
+			n, err := file.FS.Read(file.File, data)
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			cpu.SetError(err)
+			if err == io.EOF {
+				// Reaching the end of the file is not a failure, nothing was read
+				cpu.Registers[0xF] = 0x0
+			} else if err != nil {
 				cpu.Registers[0xF] = 0xFFFFFFFF
 			} else {
 				cpu.Registers[0xF] = uint32(n)
@@ -1170,6 +1206,7 @@ var instructionSet = map[uint8]*Instruction{
 			}
 
 			if length == 0 {
+				cpu.SetError(ErrInvalid)
 				cpu.Registers[0xF] = 0xFFFFFFFF
 				return
 			}
@@ -1178,6 +1215,7 @@ var instructionSet = map[uint8]*Instruction{
 			switch operands[1].Type {
 			case Reg:
 				if length > 1 {
+					cpu.SetError(ErrInvalid)
 					cpu.Registers[0xF] = 0xFFFFFFFF
 					return
 				}
@@ -1194,7 +1232,14 @@ var instructionSet = map[uint8]*Instruction{
 				}
 			}
 
-			n, err := cpu.FileSystem.Write(cpu.FileTable[fd], data)
+			file, err := cpu.FileTable.Get(fd)
+			if err != nil {
+				cpu.SetError(err)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			n, err := file.FS.Write(file.File, data)
+			cpu.SetError(err)
 			if err != nil {
 				cpu.Registers[0xF] = 0xFFFFFFFF
 			} else {
@@ -1226,7 +1271,14 @@ var instructionSet = map[uint8]*Instruction{
 				offset = int64(operands[1].Value.(*ImmOperand).Value)
 			}
 			whence := int(operands[2].Value.(*ImmOperand).Value)
-			_, err := cpu.FileSystem.Seek(cpu.FileTable[fd], offset, whence)
+			file, err := cpu.FileTable.Get(fd)
+			if err != nil {
+				cpu.SetError(err)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			_, err = file.FS.Seek(file.File, offset, whence)
+			cpu.SetError(err)
 			if err != nil {
 				cpu.Registers[0xF] = 0xFFFFFFFF
 			} else {
@@ -1244,7 +1296,19 @@ var instructionSet = map[uint8]*Instruction{
 		Name:   "LOADBIN",
 		Execute: func(cpu *CPU, operands []Operand) {
 			fd := cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
-			cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = cpu.FileSystem.LoadBinary(cpu.FileTable[fd], cpu.MemoryManager)
+			var program *ProgramInfo
+			file, err := cpu.FileTable.Get(fd)
+			if err == nil {
+				program, err = file.FS.LoadBinary(file.File, cpu.MemoryManager)
+			}
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = 0xFFFFFFFF
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = program.StartAddress
+				cpu.Registers[0xF] = program.Handle
+			}
 		},
 		Operands: []Operand{
 			{Type: Reg}, // A - FD
@@ -1256,8 +1320,13 @@ var instructionSet = map[uint8]*Instruction{
 		Name:   "CLOSE",
 		Execute: func(cpu *CPU, operands []Operand) {
 			fd := cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
-			cpu.FileSystem.Close(cpu.FileTable[fd])
-			cpu.FileTable[fd] = nil
+			err := cpu.CloseFile(fd)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = 0x0
+			}
 		},
 		Operands: []Operand{
 			{Type: Reg}, // A - FD
@@ -1283,8 +1352,9 @@ var instructionSet = map[uint8]*Instruction{
 			addr, err := cpu.MemoryManager.Malloc(size)
 			if err != nil {
 				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = addr
 			}
-			cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = addr
 		},
 		Operands: []Operand{
 			{AllowedTypes: []OperandType{Reg, DMem, IMem, Imm}}, // A - Size
@@ -1335,6 +1405,805 @@ var instructionSet = map[uint8]*Instruction{
 			{Type: Imm}, // A - Interrupt Number
 		},
 	},
+	0x26: {
+		Opcode: 0x26,
+		Name:   "SPAWN",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var entry uint32
+			switch operands[0].Type {
+			case DMem:
+				entry = cpu.MemoryManager.ExecuteJump(cpu.Registers[16], operands[0].Value.(*DMemOperand).ComputeAddress(cpu))
+			case IMem:
+				entry = cpu.MemoryManager.ExecuteJump(cpu.Registers[16], cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu)))
+			case Imm:
+				entry = cpu.MemoryManager.ExecuteJump(cpu.Registers[16], operands[0].Value.(*ImmOperand).Value)
+			}
+			cpu.Registers[0xF] = cpu.Scheduler.Spawn(entry)
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{DMem, IMem, Imm}}, // A - Entry
+		},
+	},
+	0x27: {
+		Opcode: 0x27,
+		Name:   "YIELD",
+		Execute: func(cpu *CPU, operands []Operand) {
+			cpu.Scheduler.Yield()
+		},
+	},
+	0x28: {
+		Opcode: 0x28,
+		Name:   "EXIT",
+		Execute: func(cpu *CPU, operands []Operand) {
+			cpu.Scheduler.Exit()
+		},
+	},
+	0x29: {
+		Opcode: 0x29,
+		Name:   "WAIT",
+		Execute: func(cpu *CPU, operands []Operand) {
+			switch operands[0].Type {
+			case Reg:
+				cpu.Scheduler.Wait(cpu.Registers[operands[0].Value.(*RegOperand).RegNum])
+			case Imm:
+				cpu.Scheduler.Wait(operands[0].Value.(*ImmOperand).Value)
+			}
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{Reg, Imm}}, // A - Task ID
+		},
+	},
+	0x2A: {
+		Opcode: 0x2A,
+		Name:   "UNLOAD",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var handle uint32
+			switch operands[0].Type {
+			case Reg:
+				handle = cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			case Imm:
+				handle = operands[0].Value.(*ImmOperand).Value
+			}
+			err := cpu.MemoryManager.UnloadProgram(handle)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = 0x0
+			}
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{Reg, Imm}}, // A - Program handle
+		},
+	},
+	0x2B: {
+		Opcode: 0x2B,
+		Name:   "PROGINFO",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var handle uint32
+			switch operands[0].Type {
+			case Reg:
+				handle = cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			case Imm:
+				handle = operands[0].Value.(*ImmOperand).Value
+			}
+			program, err := cpu.MemoryManager.Program(handle)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = 0xFFFFFFFF
+				cpu.Registers[operands[2].Value.(*RegOperand).RegNum] = 0x0
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = program.BaseAddress
+				cpu.Registers[operands[2].Value.(*RegOperand).RegNum] = program.Size
+				cpu.Registers[0xF] = 0x0
+			}
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{Reg, Imm}}, // A - Program handle
+			{Type: Reg},                             // B - Base address dest
+			{Type: Reg},                             // C - Size dest
+		},
+	},
+	0x2C: {
+		Opcode: 0x2C,
+		Name:   "MMAP",
+		Execute: func(cpu *CPU, operands []Operand) {
+			fd := cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			var length uint32
+			switch operands[1].Type {
+			case Reg:
+				length = cpu.Registers[operands[1].Value.(*RegOperand).RegNum]
+			case Imm:
+				length = operands[1].Value.(*ImmOperand).Value
+			}
+			var addr uint32
+			file, err := cpu.FileTable.Get(fd)
+			if err == nil {
+				addr, err = cpu.MemoryManager.MapFile(file.FS, file.File, length)
+			}
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[operands[2].Value.(*RegOperand).RegNum] = 0xFFFFFFFF
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[operands[2].Value.(*RegOperand).RegNum] = addr
+				cpu.Registers[0xF] = 0x0
+			}
+		},
+		Operands: []Operand{
+			{Type: Reg},                             // A - FD
+			{AllowedTypes: []OperandType{Reg, Imm}}, // B - Length
+			{Type: Reg},                             // C - Dest
+		},
+	},
+	0x2D: {
+		Opcode: 0x2D,
+		Name:   "MUNMAP",
+		Execute: func(cpu *CPU, operands []Operand) {
+			addr := cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			err := cpu.MemoryManager.Unmap(addr)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = 0x0
+			}
+		},
+		Operands: []Operand{
+			{Type: Reg}, // A - Address
+		},
+	},
+	0x2E: {
+		Opcode: 0x2E,
+		Name:   "SHMOPEN",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var name string
+			switch operands[0].Type {
+			case DMem:
+				cpu.LastAccessedAddress = operands[0].Value.(*DMemOperand).ComputeAddress(cpu)
+				name = cpu.MemoryManager.ReadMemoryString(operands[0].Value.(*DMemOperand).ComputeAddress(cpu))
+			case IMem:
+				cpu.LastAccessedAddress = cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu))
+				name = cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu)))
+			}
+			var size uint32
+			switch operands[1].Type {
+			case Reg:
+				size = cpu.Registers[operands[1].Value.(*RegOperand).RegNum]
+			case Imm:
+				size = operands[1].Value.(*ImmOperand).Value
+			}
+			shm, err := cpu.MemoryManager.OpenSharedMemory(name, size)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = shm.Handle
+			}
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{DMem, IMem}}, // A - Name
+			{AllowedTypes: []OperandType{Reg, Imm}},   // B - Size
+		},
+	},
+	0x2F: {
+		Opcode: 0x2F,
+		Name:   "SHMMAP",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var handle uint32
+			switch operands[0].Type {
+			case Reg:
+				handle = cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			case Imm:
+				handle = operands[0].Value.(*ImmOperand).Value
+			}
+			addr, err := cpu.MemoryManager.MapSharedMemory(handle)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = 0xFFFFFFFF
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = addr
+				cpu.Registers[0xF] = 0x0
+			}
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{Reg, Imm}}, // A - Handle
+			{Type: Reg},                             // B - Dest
+		},
+	},
+	0x30: {
+		Opcode: 0x30,
+		Name:   "MOUNT",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var path, spec string
+			switch operands[0].Type {
+			case DMem:
+				cpu.LastAccessedAddress = operands[0].Value.(*DMemOperand).ComputeAddress(cpu)
+				path = cpu.MemoryManager.ReadMemoryString(operands[0].Value.(*DMemOperand).ComputeAddress(cpu))
+			case IMem:
+				cpu.LastAccessedAddress = cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu))
+				path = cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu)))
+			}
+			switch operands[1].Type {
+			case DMem:
+				cpu.LastAccessedAddress = operands[1].Value.(*DMemOperand).ComputeAddress(cpu)
+				spec = cpu.MemoryManager.ReadMemoryString(operands[1].Value.(*DMemOperand).ComputeAddress(cpu))
+			case IMem:
+				cpu.LastAccessedAddress = cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu))
+				spec = cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu)))
+			}
+			mounts, ok := FindMountVFS(cpu.FileSystem)
+			if !ok {
+				cpu.SetError(ErrNotSupported)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			if !cpu.Supervisor() {
+				cpu.SetError(fs.ErrPermission)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			err := mounts.MountSpec(path, spec)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = 0x0
+			}
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{DMem, IMem}}, // A - Path
+			{AllowedTypes: []OperandType{DMem, IMem}}, // B - Filesystem
+		},
+	},
+	0x31: {
+		Opcode: 0x31,
+		Name:   "UMOUNT",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var path string
+			switch operands[0].Type {
+			case DMem:
+				cpu.LastAccessedAddress = operands[0].Value.(*DMemOperand).ComputeAddress(cpu)
+				path = cpu.MemoryManager.ReadMemoryString(operands[0].Value.(*DMemOperand).ComputeAddress(cpu))
+			case IMem:
+				cpu.LastAccessedAddress = cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu))
+				path = cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu)))
+			}
+			var err error
+			mounts, ok := FindMountVFS(cpu.FileSystem)
+			if !ok {
+				err = ErrNotSupported
+			} else if !cpu.Supervisor() {
+				err = fs.ErrPermission
+			} else {
+				err = mounts.Unmount(path)
+			}
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = 0x0
+			}
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{DMem, IMem}}, // A - Path
+		},
+	},
+	0x32: {
+		Opcode: 0x32,
+		Name:   "CREATE",
+		Execute: func(cpu *CPU, operands []Operand) {
+			r := operands[0].Value.(*RegOperand)
+			var name string
+			switch operands[1].Type {
+			case DMem:
+				cpu.LastAccessedAddress = operands[1].Value.(*DMemOperand).ComputeAddress(cpu)
+				name = cpu.MemoryManager.ReadMemoryString(operands[1].Value.(*DMemOperand).ComputeAddress(cpu))
+			case IMem:
+				cpu.LastAccessedAddress = cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu))
+				name = cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu)))
+			}
+			var fd uint32
+			file, err := cpu.FileSystem.Create(name)
+			if err == nil {
+				fd, err = cpu.FileTable.Add(cpu.FileSystem, file)
+			}
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[r.RegNum] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[r.RegNum] = fd
+			}
+		},
+		Operands: []Operand{
+			{Type: Reg}, // A - Dest
+			{AllowedTypes: []OperandType{DMem, IMem}}, // B - Filename
+		},
+	},
+	0x33: {
+		Opcode: 0x33,
+		Name:   "DELETE",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var name string
+			switch operands[0].Type {
+			case DMem:
+				cpu.LastAccessedAddress = operands[0].Value.(*DMemOperand).ComputeAddress(cpu)
+				name = cpu.MemoryManager.ReadMemoryString(operands[0].Value.(*DMemOperand).ComputeAddress(cpu))
+			case IMem:
+				cpu.LastAccessedAddress = cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu))
+				name = cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu)))
+			}
+			err := cpu.FileSystem.Remove(name)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = 0x0
+			}
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{DMem, IMem}}, // A - Filename
+		},
+	},
+	0x34: {
+		Opcode: 0x34,
+		Name:   "STAT",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var name string
+			switch operands[0].Type {
+			case DMem:
+				cpu.LastAccessedAddress = operands[0].Value.(*DMemOperand).ComputeAddress(cpu)
+				name = cpu.MemoryManager.ReadMemoryString(operands[0].Value.(*DMemOperand).ComputeAddress(cpu))
+			case IMem:
+				cpu.LastAccessedAddress = cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu))
+				name = cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu)))
+			}
+			var dest uint32
+			switch operands[1].Type {
+			case DMem:
+				dest = operands[1].Value.(*DMemOperand).ComputeAddress(cpu)
+			case IMem:
+				dest = cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu))
+			}
+			cpu.LastAccessedAddress = dest
+			info, err := cpu.FileSystem.Stat(name)
+			if err != nil {
+				cpu.SetError(err)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			cpu.MemoryManager.WriteMemoryDWord(dest, uint32(info.Size))
+			cpu.MemoryManager.WriteMemoryDWord(dest+4, uint32(info.Mode))
+			cpu.SetError(nil)
+			cpu.Registers[0xF] = 0x0
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{DMem, IMem}}, // A - Filename
+			{AllowedTypes: []OperandType{DMem, IMem}}, // B - Dest
+		},
+	},
+	0x35: {
+		Opcode: 0x35,
+		Name:   "READDIR",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var name string
+			switch operands[0].Type {
+			case DMem:
+				cpu.LastAccessedAddress = operands[0].Value.(*DMemOperand).ComputeAddress(cpu)
+				name = cpu.MemoryManager.ReadMemoryString(operands[0].Value.(*DMemOperand).ComputeAddress(cpu))
+			case IMem:
+				cpu.LastAccessedAddress = cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu))
+				name = cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu)))
+			}
+			var index uint32
+			switch operands[1].Type {
+			case Reg:
+				index = cpu.Registers[operands[1].Value.(*RegOperand).RegNum]
+			case Imm:
+				index = operands[1].Value.(*ImmOperand).Value
+			}
+			var dest uint32
+			switch operands[2].Type {
+			case DMem:
+				dest = operands[2].Value.(*DMemOperand).ComputeAddress(cpu)
+			case IMem:
+				dest = cpu.MemoryManager.ReadMemoryDWord(operands[2].Value.(*IMemOperand).ComputeAddress(cpu))
+			}
+			cpu.LastAccessedAddress = dest
+			entries, err := cpu.FileSystem.ReadDir(name)
+			if err == nil && index >= uint32(len(entries)) {
+				// Listing past the last entry is reported as the end of the folder
+				err = io.EOF
+			}
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			entry := entries[index]
+			entryName := entry.Name
+			if len(entryName) > MaxDirEntryName {
+				entryName = entryName[:MaxDirEntryName]
+			}
+			cpu.MemoryManager.WriteMemoryDWord(dest, uint32(entry.Size))
+			cpu.MemoryManager.WriteMemoryDWord(dest+4, uint32(entry.Mode))
+			for i := 0; i < len(entryName); i++ {
+				cpu.MemoryManager.WriteMemory(dest+8+uint32(i), entryName[i])
+			}
+			cpu.MemoryManager.WriteMemory(dest+8+uint32(len(entryName)), 0)
+			cpu.Registers[0xF] = 0x0
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{DMem, IMem}}, // A - Folder
+			{AllowedTypes: []OperandType{Reg, Imm}},   // B - Index
+			{AllowedTypes: []OperandType{DMem, IMem}}, // C - Dest
+		},
+	},
+	0x36: {
+		Opcode: 0x36,
+		Name:   "PREAD",
+		Execute: func(cpu *CPU, operands []Operand) {
+			fd := cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			var dest uint32
+			switch operands[1].Type {
+			case DMem:
+				dest = operands[1].Value.(*DMemOperand).ComputeAddress(cpu)
+			case IMem:
+				dest = cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu))
+			}
+			cpu.LastAccessedAddress = dest
+			var length uint32
+			switch operands[2].Type {
+			case Reg:
+				length = cpu.Registers[operands[2].Value.(*RegOperand).RegNum]
+			case Imm:
+				length = operands[2].Value.(*ImmOperand).Value
+			}
+			var offset uint32
+			switch operands[3].Type {
+			case Reg:
+				offset = cpu.Registers[operands[3].Value.(*RegOperand).RegNum]
+			case Imm:
+				offset = operands[3].Value.(*ImmOperand).Value
+			}
+			file, err := cpu.FileTable.Get(fd)
+			if err != nil {
+				cpu.SetError(err)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			if length > MaxTransferLength {
+				cpu.SetError(ErrInvalid)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			data := make([]byte, length)
+			n, err := file.FS.ReadAt(file.File, data, int64(offset))
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			cpu.SetError(err)
+			if err != nil && err != io.EOF {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			for i, b := range data[:n] {
+				cpu.MemoryManager.WriteMemory(dest+uint32(i), b)
+			}
+			cpu.Registers[0xF] = uint32(n)
+		},
+		Operands: []Operand{
+			{Type: Reg}, // A - FD
+			{AllowedTypes: []OperandType{DMem, IMem}}, // B - Dest
+			{AllowedTypes: []OperandType{Reg, Imm}},   // C - Length
+			{AllowedTypes: []OperandType{Reg, Imm}},   // D - Offset
+		},
+	},
+	0x37: {
+		Opcode: 0x37,
+		Name:   "PWRITE",
+		Execute: func(cpu *CPU, operands []Operand) {
+			fd := cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			var src uint32
+			switch operands[1].Type {
+			case DMem:
+				src = operands[1].Value.(*DMemOperand).ComputeAddress(cpu)
+			case IMem:
+				src = cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu))
+			}
+			cpu.LastAccessedAddress = src
+			var length uint32
+			switch operands[2].Type {
+			case Reg:
+				length = cpu.Registers[operands[2].Value.(*RegOperand).RegNum]
+			case Imm:
+				length = operands[2].Value.(*ImmOperand).Value
+			}
+			var offset uint32
+			switch operands[3].Type {
+			case Reg:
+				offset = cpu.Registers[operands[3].Value.(*RegOperand).RegNum]
+			case Imm:
+				offset = operands[3].Value.(*ImmOperand).Value
+			}
+			if length > MaxTransferLength {
+				cpu.SetError(ErrInvalid)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			data := cpu.MemoryManager.ReadMemoryN(src, int(length))
+			file, err := cpu.FileTable.Get(fd)
+			if err != nil {
+				cpu.SetError(err)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			n, err := file.FS.WriteAt(file.File, data, int64(offset))
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = uint32(n)
+			}
+		},
+		Operands: []Operand{
+			{Type: Reg}, // A - FD
+			{AllowedTypes: []OperandType{DMem, IMem}}, // B - Source
+			{AllowedTypes: []OperandType{Reg, Imm}},   // C - Length
+			{AllowedTypes: []OperandType{Reg, Imm}},   // D - Offset
+		},
+	},
+	0x38: {
+		Opcode: 0x38,
+		Name:   "RENAME",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var oldName, newName string
+			switch operands[0].Type {
+			case DMem:
+				cpu.LastAccessedAddress = operands[0].Value.(*DMemOperand).ComputeAddress(cpu)
+				oldName = cpu.MemoryManager.ReadMemoryString(operands[0].Value.(*DMemOperand).ComputeAddress(cpu))
+			case IMem:
+				cpu.LastAccessedAddress = cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu))
+				oldName = cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu)))
+			}
+			switch operands[1].Type {
+			case DMem:
+				cpu.LastAccessedAddress = operands[1].Value.(*DMemOperand).ComputeAddress(cpu)
+				newName = cpu.MemoryManager.ReadMemoryString(operands[1].Value.(*DMemOperand).ComputeAddress(cpu))
+			case IMem:
+				cpu.LastAccessedAddress = cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu))
+				newName = cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu)))
+			}
+			err := cpu.FileSystem.Rename(oldName, newName)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = 0x0
+			}
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{DMem, IMem}}, // A - Old name
+			{AllowedTypes: []OperandType{DMem, IMem}}, // B - New name
+		},
+	},
+	0x39: {
+		Opcode: 0x39,
+		Name:   "MKDIR",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var name string
+			switch operands[0].Type {
+			case DMem:
+				cpu.LastAccessedAddress = operands[0].Value.(*DMemOperand).ComputeAddress(cpu)
+				name = cpu.MemoryManager.ReadMemoryString(operands[0].Value.(*DMemOperand).ComputeAddress(cpu))
+			case IMem:
+				cpu.LastAccessedAddress = cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu))
+				name = cpu.MemoryManager.ReadMemoryString(cpu.MemoryManager.ReadMemoryDWord(operands[0].Value.(*IMemOperand).ComputeAddress(cpu)))
+			}
+			err := cpu.FileSystem.Mkdir(name)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = 0x0
+			}
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{DMem, IMem}}, // A - Folder
+		},
+	},
+	0x3A: {
+		Opcode: 0x3A,
+		Name:   "DUP",
+		Execute: func(cpu *CPU, operands []Operand) {
+			fd := cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			newFD, err := cpu.FileTable.Dup(fd)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = newFD
+			}
+		},
+		Operands: []Operand{
+			{Type: Reg}, // A - FD
+			{Type: Reg}, // B - Dest
+		},
+	},
+	0x3B: {
+		Opcode: 0x3B,
+		Name:   "DUP2",
+		Execute: func(cpu *CPU, operands []Operand) {
+			fd := cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			var newFD uint32
+			switch operands[1].Type {
+			case Reg:
+				newFD = cpu.Registers[operands[1].Value.(*RegOperand).RegNum]
+			case Imm:
+				newFD = operands[1].Value.(*ImmOperand).Value
+			}
+			_, err := cpu.FileTable.Get(fd)
+			if err == nil && fd != newFD {
+				// Closing through the CPU writes back mappings of the old file
+				cpu.CloseFile(newFD)
+				err = cpu.FileTable.Dup2(fd, newFD)
+			}
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = 0x0
+			}
+		},
+		Operands: []Operand{
+			{Type: Reg},                             // A - FD
+			{AllowedTypes: []OperandType{Reg, Imm}}, // B - New FD
+		},
+	},
+	0x3C: {
+		Opcode: 0x3C,
+		Name:   "AREAD",
+		Execute: func(cpu *CPU, operands []Operand) {
+			fd := cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			var dest uint32
+			switch operands[1].Type {
+			case DMem:
+				dest = operands[1].Value.(*DMemOperand).ComputeAddress(cpu)
+			case IMem:
+				dest = cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu))
+			}
+			cpu.LastAccessedAddress = dest
+			var length uint32
+			switch operands[2].Type {
+			case Reg:
+				length = cpu.Registers[operands[2].Value.(*RegOperand).RegNum]
+			case Imm:
+				length = operands[2].Value.(*ImmOperand).Value
+			}
+			if length == 0 || length > MaxTransferLength {
+				cpu.SetError(ErrInvalid)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			file, err := cpu.FileTable.Get(fd)
+			if err != nil {
+				cpu.SetError(err)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			id, err := cpu.AsyncIO.Submit(file, false, make([]byte, length), dest)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = id
+			}
+		},
+		Operands: []Operand{
+			{Type: Reg}, // A - FD
+			{AllowedTypes: []OperandType{DMem, IMem}}, // B - Dest
+			{AllowedTypes: []OperandType{Reg, Imm}},   // C - Length
+		},
+	},
+	0x3D: {
+		Opcode: 0x3D,
+		Name:   "AWRITE",
+		Execute: func(cpu *CPU, operands []Operand) {
+			fd := cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			var src uint32
+			switch operands[1].Type {
+			case DMem:
+				src = operands[1].Value.(*DMemOperand).ComputeAddress(cpu)
+			case IMem:
+				src = cpu.MemoryManager.ReadMemoryDWord(operands[1].Value.(*IMemOperand).ComputeAddress(cpu))
+			}
+			cpu.LastAccessedAddress = src
+			var length uint32
+			switch operands[2].Type {
+			case Reg:
+				length = cpu.Registers[operands[2].Value.(*RegOperand).RegNum]
+			case Imm:
+				length = operands[2].Value.(*ImmOperand).Value
+			}
+			if length == 0 || length > MaxTransferLength {
+				cpu.SetError(ErrInvalid)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			file, err := cpu.FileTable.Get(fd)
+			if err != nil {
+				cpu.SetError(err)
+				cpu.Registers[0xF] = 0xFFFFFFFF
+				return
+			}
+			id, err := cpu.AsyncIO.Submit(file, true, cpu.MemoryManager.ReadMemoryN(src, int(length)), src)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = id
+			}
+		},
+		Operands: []Operand{
+			{Type: Reg}, // A - FD
+			{AllowedTypes: []OperandType{DMem, IMem}}, // B - Source
+			{AllowedTypes: []OperandType{Reg, Imm}},   // C - Length
+		},
+	},
+	0x3E: {
+		Opcode: 0x3E,
+		Name:   "ARESULT",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var id uint32
+			switch operands[0].Type {
+			case Reg:
+				id = cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			case Imm:
+				id = operands[0].Value.(*ImmOperand).Value
+			}
+			res, err := cpu.AsyncIO.Result(id)
+			if err != nil {
+				cpu.SetError(err)
+				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = 0xFFFFFFFF
+				return
+			}
+			cpu.Registers[ER] = res.Code
+			if res.Code != ENONE && res.Code != EEOF {
+				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[operands[1].Value.(*RegOperand).RegNum] = res.N
+			}
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{Reg, Imm}}, // A - Request ID
+			{Type: Reg},                             // B - Dest
+		},
+	},
+	0x3F: {
+		Opcode: 0x3F,
+		Name:   "SHMUNLINK",
+		Execute: func(cpu *CPU, operands []Operand) {
+			var handle uint32
+			switch operands[0].Type {
+			case Reg:
+				handle = cpu.Registers[operands[0].Value.(*RegOperand).RegNum]
+			case Imm:
+				handle = operands[0].Value.(*ImmOperand).Value
+			}
+			err := cpu.MemoryManager.UnlinkSharedMemory(handle)
+			cpu.SetError(err)
+			if err != nil {
+				cpu.Registers[0xF] = 0xFFFFFFFF
+			} else {
+				cpu.Registers[0xF] = 0x0
+			}
+		},
+		Operands: []Operand{
+			{AllowedTypes: []OperandType{Reg, Imm}}, // A - Handle
+		},
+	},
 }
 
 func EncodeInstruction(inst *Instruction) []byte {
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxMacroDepth limits how deeply macros can expand other macros, which
+// stops macros that expand themselves.
+const MaxMacroDepth = 64
+
+// Macro is a block of lines defined with MACRO and ENDM. Using its name like
+// an instruction inserts the lines, with the parameters replaced by the
+// arguments.
+type Macro struct {
+	Name   string
+	Params []string
+	Lines  []macroLine
+	// Labels defined by the macro, renamed in every expansion so a macro can
+	// be used more than once
+	Labels []string
+
+	file  string
+	line  int
+	depth int
+}
+
+type macroLine struct {
+	text string
+	line int
+}
+
+// expansion is a macro that is being expanded, or a file that is being
+// included if name is empty, along with where it was used.
+type expansion struct {
+	name string
+	file string
+	line int
+}
+
+// splitArgs splits the arguments of a macro at commas and spaces, stopping at
+// a comment. Brackets and quotes are kept together.
+func splitArgs(line string) []field {
+	return splitOn(line, " \t,")
+}
+
+func isSymbolChar(c byte) bool {
+	return c == '_' || c == '.' || c == '@' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// replaceSymbols replaces every whole word found in replace, leaving quoted
+// strings alone.
+func replaceSymbols(line string, replace map[string]string) string {
+	var b strings.Builder
+	for i := 0; i < len(line); {
+		c := line[i]
+		if c == '"' || c == '\'' {
+			j := i + 1
+			for j < len(line) && line[j] != c {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, len(line))
+			b.WriteString(line[i:j])
+			i = j
+		} else if c == ';' {
+			b.WriteString(line[i:])
+			break
+		} else if isSymbolChar(c) {
+			j := i
+			for j < len(line) && isSymbolChar(line[j]) {
+				j++
+			}
+			if r, ok := replace[line[i:j]]; ok {
+				b.WriteString(r)
+			} else {
+				b.WriteString(line[i:j])
+			}
+			i = j
+		} else {
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// parseMacroLine handles the MACRO and ENDM lines, and stores the lines in
+// between in the macro being defined. It returns false for lines that have
+// nothing to do with macro definitions.
+func (p *Parser) parseMacroLine(line string) bool {
+	fields := splitArgs(line)
+	keyword := ""
+	if len(fields) > 0 {
+		keyword = fields[0].text
+	}
+
+	if m := p.defining; m != nil {
+		if keyword == "MACRO" {
+			m.depth++
+		} else if keyword == "ENDM" && m.depth > 0 {
+			m.depth--
+		} else if keyword == "ENDM" {
+			p.defining = nil
+			p.defineMacro(m)
+			return true
+		}
+		m.Lines = append(m.Lines, macroLine{text: p.source, line: p.line})
+		if m.depth == 0 && line[len(line)-1] == ':' {
+			m.Labels = append(m.Labels, line[:len(line)-1])
+		}
+		return true
+	}
+
+	switch keyword {
+	case "MACRO":
+		if len(fields) < 2 {
+			p.errorf(p.col(0), "MACRO expects a name")
+			// Still read up to ENDM, so the body is not parsed as code
+			fields = append(fields, field{})
+		}
+		m := &Macro{Name: fields[1].text, file: p.file, line: p.line}
+		for _, param := range fields[2:] {
+			m.Params = append(m.Params, param.text)
+		}
+		p.defining = m
+		p.definedAt = p.pos(p.col(0))
+		return true
+	case "ENDM":
+		p.errorf(p.col(0), "ENDM without MACRO")
+		return true
+	}
+	return false
+}
+
+func (p *Parser) defineMacro(m *Macro) {
+	pos := p.definedAt
+	if m.Name == "" {
+		return
+	}
+	if GetInstruction(m.Name) != nil || m.Name == "ORG" {
+		p.report(pos, SeverityError, "macro %s has the name of an instruction", m.Name)
+		return
+	}
+	if old, ok := p.Macros[m.Name]; ok {
+		// A header included by several files defines its macros once per file
+		if old.file == m.file && old.line == m.line {
+			return
+		}
+		p.report(pos, SeverityError, "macro %s is already defined at %s:%d", m.Name, old.file, old.line)
+		return
+	}
+	p.Macros[m.Name] = m
+}
+
+// expandMacro parses the lines of a macro in place of the line using it.
+// Diagnostics in the expanded lines point to the line in the macro, and
+// mention where the macro was used.
+func (p *Parser) expandMacro(m *Macro, args []field, col int) {
+	if len(args) != len(m.Params) {
+		p.errorf(col, "macro %s expects %d argument(s), got %d", m.Name, len(m.Params), len(args))
+		return
+	}
+	if len(p.expansions) >= MaxMacroDepth {
+		p.errorf(col, "macro %s is expanded too deeply, does it use itself?", m.Name)
+		return
+	}
+
+	p.expansionCount++
+	replace := make(map[string]string)
+	for _, label := range m.Labels {
+		replace[label] = fmt.Sprintf("%s@%d", label, p.expansionCount)
+	}
+	for i, param := range m.Params {
+		replace[param] = args[i].text
+	}
+
+	file, line := p.file, p.line
+	p.expansions = append(p.expansions, expansion{name: m.Name, file: file, line: line})
+	for _, l := range m.Lines {
+		p.file, p.line = m.file, l.line
+		p.ParseLine(replaceSymbols(l.text, replace))
+	}
+	p.expansions = p.expansions[:len(p.expansions)-1]
+	p.file, p.line = file, line
+}
+
+// checkMacros reports a macro that is still missing its ENDM at the end of
+// a file.
+func (p *Parser) checkMacros() {
+	if p.defining != nil {
+		p.report(p.definedAt, SeverityError, "MACRO %s without ENDM", p.defining.Name)
+		p.defining = nil
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// countMacro returns a macro that adds n to a register in a loop, so a jump to
+// the loop of another expansion changes the wrong register.
+func countMacro(label string) string {
+	return fmt.Sprintf(`MACRO COUNT reg n
+    LD R1 n
+%s:
+    INC reg
+    DEC R1
+    CMP R1 0
+    JNE %s
+ENDM
+`, label, label)
+}
+
+func TestMacroLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		labels []string
+	}{
+		{
+			name:   "two expansions",
+			source: countMacro("loop") + ".TEXT\n    COUNT R2 3\n    COUNT R3 5\n    HLT\n",
+			labels: []string{"loop@1", "loop@2"},
+		},
+		{
+			name:   "local labels",
+			source: countMacro(".loop") + ".TEXT\nmain:\n    COUNT R2 3\n    COUNT R3 5\n    HLT\n",
+			labels: []string{"main", "main.loop@1", "main.loop@2"},
+		},
+		{
+			name:   "expanded by another macro",
+			source: countMacro("loop") + "MACRO BOTH\n    COUNT R2 3\n    COUNT R3 5\nENDM\n.TEXT\n    BOTH\n    HLT\n",
+			labels: []string{"loop@2", "loop@3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := parseFiles(t, map[string]string{"test.asm": tt.source}, nil, "test.asm")
+			if p.HasErrors() {
+				t.Fatalf("unexpected diagnostics: %q", diagnostics(p))
+			}
+			labels := slices.Sorted(maps.Keys(p.Scopes[1].Labels))
+			if !slices.Equal(labels, tt.labels) {
+				t.Errorf("got labels %q, want %q", labels, tt.labels)
+			}
+
+			c := NewCPU()
+			if err := c.LoadProgram(ProgramToBytecode(p)); err != nil {
+				t.Fatal(err)
+			}
+			runUntilHalted(t, c)
+			if c.Registers[2] != 3 || c.Registers[3] != 5 {
+				t.Errorf("R2 = %d and R3 = %d, want 3 and 5", c.Registers[2], c.Registers[3])
+			}
+		})
+	}
+}
+
+func TestMacroDiagnostics(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name: "error in a macro",
+			files: map[string]string{
+				"test.asm": "MACRO LOAD\n    LD R1 [R2+]\nENDM\n.TEXT\n    LOAD\n",
+			},
+			want: `test.asm:2:11: error: expected an offset after +
+        LD R1 [R2+]
+              ^
+    note: in expansion of macro LOAD at test.asm:5`,
+		},
+		{
+			name: "nested expansions",
+			files: map[string]string{
+				"test.asm": "MACRO INNER\n    LD R1 [R2+]\nENDM\nMACRO OUTER\n    INNER\nENDM\n.TEXT\n    OUTER\n",
+			},
+			want: `test.asm:2:11: error: expected an offset after +
+        LD R1 [R2+]
+              ^
+    note: in expansion of macro INNER at test.asm:5
+    note: in expansion of macro OUTER at test.asm:8`,
+		},
+		{
+			name: "macro from an included file",
+			files: map[string]string{
+				"macros.inc": "MACRO LOAD\n    LD R1 [R2+]\nENDM\n",
+				"test.asm":   "INCLUDE \"macros.inc\"\n.TEXT\n    LOAD\n",
+			},
+			want: `macros.inc:2:11: error: expected an offset after +
+        LD R1 [R2+]
+              ^
+    note: in expansion of macro LOAD at test.asm:3`,
+		},
+		{
+			name: "macro that expands itself",
+			files: map[string]string{
+				"test.asm": "MACRO SELF\n    SELF\nENDM\n.TEXT\n    SELF\n",
+			},
+			want: `test.asm:2:5: error: macro SELF is expanded too deeply, does it use itself?
+        SELF
+        ^
+    note: in expansion of macro SELF at test.asm:2
+    note: in expansion of macro SELF at test.asm:2
+    note: in expansion of macro SELF at test.asm:2
+    note: ... 60 more expansions
+    note: in expansion of macro SELF at test.asm:5`,
+		},
+		{
+			name: "wrong number of arguments",
+			files: map[string]string{
+				"test.asm": "MACRO MOVE a b\n    MOV a b\nENDM\n.TEXT\n    MOVE R1\n",
+			},
+			want: `test.asm:5:5: error: macro MOVE expects 2 argument(s), got 1
+        MOVE R1
+        ^`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := parseFiles(t, tt.files, nil, "test.asm")
+			var got []string
+			for _, d := range p.Diagnostics {
+				got = append(got, d.Format())
+			}
+			if strings.Join(got, "\n") != tt.want {
+				t.Errorf("got diagnostics\n%s\nwant\n%s", strings.Join(got, "\n"), tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
 	"flag"
 	"fmt"
@@ -14,30 +15,94 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fat" {
+		if err := runFATCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	generateBytecode := flag.Bool("bytecode", false, "Generate bytecode")
 	outputFilename := flag.String("output", "output.bin", "Output filename")
-	fsType := flag.String("fs", "folder", "Filesystem type")
-	fsRoot := flag.String("root", "./vmdata", "Root folder")
+	fsType := flag.String("fs", "folder", "Filesystem type (folder, memory, tar:<file>, zip:<file>, fat:<image> or overlay)")
+	fsLower := flag.String("lower", "folder", "Read-only lower filesystem of the overlay filesystem")
+	fsUpper := flag.String("upper", "memory:", "Writable upper filesystem of the overlay filesystem")
+	readOnly := flag.Bool("readonly", false, "Make the folder or FAT filesystem read-only")
+	quota := flag.Int64("quota", 0, "Maximum number of bytes written to the folder filesystem (0 means no limit)")
+	var mounts listFlags
+	flag.Var(&mounts, "mount", "Mount a filesystem as <path>=<type>, can be repeated")
+	traceFile := flag.String("trace", "", "Write every filesystem call to this file")
+	var faults listFlags
+	flag.Var(&faults, "fault", "Make filesystem calls fail, as <op>[:<path>][@<n>][=<error>|short], can be repeated")
+	fsRoot := flag.String("root", "./vmdata", "Root folder, or the folder or archive to preload the memory filesystem from")
+	var includePaths listFlags
+	flag.Var(&includePaths, "I", "Folder searched for files used by INCLUDE and INCBIN, can be repeated")
 	callTable := flag.Bool("calltable", false, "Generate call table")
+	stackSize := flag.Uint("stack-size", 0, "Stack size in bytes for each task (0 uses the size from the bytecode, or the default)")
+	timeSlice := flag.Uint("timeslice", 100, "Instructions per task before preemption (0 disables preemption)")
+	maxFiles := flag.Uint("max-files", DefaultMaxFiles, "Maximum number of open file descriptors, including the 3 standard ones")
+	snapshotFile := flag.String("snapshot", "vm.snapshot", "Snapshot file used by the S and L keys")
+	restore := flag.Bool("restore", false, "Restore the snapshot file on startup")
 	flag.Parse()
 
 	var fs VFS
-	if *fsType == "folder" {
-		if _, err := os.Stat(*fsRoot); os.IsNotExist(err) {
-			err := os.Mkdir(*fsRoot, 0755)
+	var err error
+	if *fsType == "overlay" {
+		var lower, upper VFS
+		lower, err = NewVFSFromSpec(*fsLower, *fsRoot)
+		if err == nil {
+			upper, err = NewVFSFromSpec(*fsUpper, *fsRoot)
+		}
+		fs = &OverlayVFS{Lower: lower, Upper: upper}
+	} else {
+		fs, err = NewVFSFromSpec(*fsType, *fsRoot)
+	}
+	if err != nil {
+		log.Fatalf("failed to set up filesystem: %v", err)
+	}
+	if folder, ok := fs.(*FolderBasedVFS); ok {
+		folder.ReadOnly = *readOnly
+		folder.Quota = *quota
+	}
+	if fat, ok := fs.(*FATVFS); ok && *readOnly {
+		fat.ReadOnly = true
+	}
+	mountFS := NewMountVFS(fs)
+	for _, m := range mounts {
+		path, spec, ok := strings.Cut(m, "=")
+		if !ok {
+			log.Fatalf("invalid mount %q, expected <path>=<type>", m)
+		}
+		if err := mountFS.MountHost(path, spec); err != nil {
+			log.Fatalf("failed to mount %s: %v", path, err)
+		}
+	}
+	fs = mountFS
+	if *traceFile != "" || len(faults) > 0 {
+		tracing := &TracingVFS{FS: fs}
+		for _, spec := range faults {
+			fault, err := ParseFault(spec)
 			if err != nil {
-				log.Fatalf("failed to create root folder: %v", err)
+				log.Fatalf("invalid fault %q: %v", spec, err)
 			}
+			tracing.Faults = append(tracing.Faults, fault)
 		}
-		fs = &FolderBasedVFS{Root: *fsRoot}
-	} else {
-		log.Fatalf("unknown filesystem type")
+		if *traceFile != "" {
+			trace, err := os.Create(*traceFile)
+			if err != nil {
+				log.Fatalf("failed to create trace file: %v", err)
+			}
+			defer trace.Close()
+			tracing.Trace = trace
+		}
+		fs = tracing
 	}
 
 	var bc *Bytecode
 	isAsm := false
 	p := NewParser()
 	p.DefaultBaseAddress = 0x00000000
+	p.IncludePaths = includePaths
 	for _, filename := range flag.Args() {
 		if strings.HasSuffix(filename, ".asm") {
 			isAsm = true
@@ -62,6 +127,10 @@ func main() {
 
 	if isAsm {
 		p.Parse()
+		p.WriteDiagnostics(os.Stderr)
+		if p.HasErrors() {
+			os.Exit(1)
+		}
 		err := p.CheckForOverlappingSectors()
 		if err != nil {
 			log.Fatalf("overlapping sectors: %v", err)
@@ -69,8 +138,15 @@ func main() {
 		bc = ProgramToBytecode(p)
 
 		if *callTable {
-			for k, v := range p.Labels {
-				fmt.Printf("%s: %08x\n", k, v)
+			for _, scope := range p.Scopes {
+				for k, v := range scope.Labels {
+					// Labels are private to their file, so several files can
+					// use the same name
+					if len(flag.Args()) > 1 {
+						k = scope.File + ":" + k
+					}
+					fmt.Printf("%s: %08x\n", k, v)
+				}
 			}
 			return
 		}
@@ -81,6 +157,13 @@ func main() {
 		return
 	}
 
+	if *stackSize != 0 {
+		if *stackSize > MaxStackSize {
+			log.Fatalf("stack size %d is larger than the maximum of %d bytes", *stackSize, MaxStackSize)
+		}
+		bc.StackSize = uint32(*stackSize)
+	}
+
 	if *generateBytecode {
 		fileContent, err := EncodeBytecode(bc)
 		if err != nil {
@@ -95,14 +178,29 @@ func main() {
 
 	c := NewCPU()
 	c.FileSystem = fs
-	c.LoadProgram(bc)
+	c.Scheduler.TimeSlice = uint32(*timeSlice)
+	c.FileTable.Limit = uint32(*maxFiles)
+	if err := c.LoadProgram(bc); err != nil {
+		log.Fatalf("failed to load program: %v", err)
+	}
+
+	if *restore {
+		if err := restoreSnapshot(c, *snapshotFile); err != nil {
+			log.Fatalf("failed to restore snapshot: %v", err)
+		}
+	}
 
 	simulationDelay := time.Millisecond * 100
 
 	if err := ui.Init(); err != nil {
 		log.Fatalf("failed to initialize termui: %v", err)
 	}
-	defer ui.Close()
+	defer func() {
+		ui.Close()
+		if c.LeakReport != "" {
+			fmt.Print(c.LeakReport)
+		}
+	}()
 
 	video := widgets.NewParagraph()
 	video.Title = "Text-mode video buffer"
@@ -132,13 +230,22 @@ func main() {
 	heapWindow.Title = "Heap"
 	heapWindow.SetRect(101, 0, 111, 27)
 
-	ui.Render(video, regDump, simInfo, memoryWindow, accessWindow, stackWindow, heapWindow)
+	taskWindow := widgets.NewParagraph()
+	taskWindow.Title = "Tasks"
+	taskWindow.SetRect(0, 27, 42, 37)
+
+	statsWindow := widgets.NewParagraph()
+	statsWindow.Title = "Memory"
+	statsWindow.SetRect(42, 27, 74, 37)
+
+	ui.Render(video, regDump, simInfo, memoryWindow, accessWindow, stackWindow, heapWindow, taskWindow, statsWindow)
 
 	run := false
 
 	uiEvents := ui.PollEvents()
 	ticker := time.NewTicker(simulationDelay)
 	isEscaped := true
+	status := ""
 
 	for {
 		select {
@@ -171,7 +278,20 @@ func main() {
 					case "c":
 						run = false
 						c.Reset()
-						c.LoadProgram(bc)
+						if err := c.LoadProgram(bc); err != nil {
+							status = err.Error()
+						}
+					case "S":
+						status = "Saved " + *snapshotFile
+						if err := saveSnapshot(c, *snapshotFile); err != nil {
+							status = err.Error()
+						}
+					case "L":
+						run = false
+						status = "Loaded " + *snapshotFile
+						if err := restoreSnapshot(c, *snapshotFile); err != nil {
+							status = err.Error()
+						}
 					}
 				} else {
 					c.InputQueue <- e.ID
@@ -195,32 +315,58 @@ func main() {
 				regDump.Text += fmt.Sprintf("R%d: %08x | R%d: %08x\n", i, v, i+8, c.Registers[i+8])
 			}
 
-			simInfo.Text = fmt.Sprintf("Frequency: %s\nHalted: %t\nRunning: %t\nEscaped: %t\n\nPC: %08x\nSP: %08x\nHP: %08x", DurationToFrequency(simulationDelay), c.Halted, run, isEscaped, c.Registers[16], c.Registers[17], c.Registers[18])
+			simInfo.Text = fmt.Sprintf("Frequency: %s\nHalted: %t\nRunning: %t\nEscaped: %t\nPC: %08x\nSP: %08x\nHP: %08x\nER: %08x", DurationToFrequency(simulationDelay), c.Halted, run, isEscaped, c.Registers[16], c.Registers[17], c.Registers[18], c.Registers[ER])
 
 			memoryWindow.Text = drawMemoryWindow(c.MemoryManager, c.Registers[16])
 			accessWindow.Text = drawAccessWindow(c.MemoryManager, c.LastAccessedAddress)
-			stackWindow.Text = ""
-			stackMemory := c.MemoryManager.ReadMemoryN(c.Registers[17], int(c.MemoryManager.VirtualStackEnd-c.Registers[17]))
-			for i := 0; i < len(stackMemory); i += 4 {
-				if i+4 <= len(stackMemory) {
-					v := binary.LittleEndian.Uint32(stackMemory[i : i+4])
-					stackWindow.Text += fmt.Sprintf("%08x\n", v)
-				}
+			stackWindow.Text = drawWordWindow(c.MemoryManager, c.Registers[17], c.MemoryManager.VirtualStackEnd)
+			heapWindow.Text = drawWordWindow(c.MemoryManager, c.MemoryManager.VirtualHeapStart, c.Registers[18])
+			taskWindow.Text = c.Scheduler.Describe()
+			if c.Fault != nil {
+				taskWindow.Text += fmt.Sprintf("\nFault: %v", c.Fault)
 			}
-
-			heapWindow.Text = ""
-			heapMemory := c.MemoryManager.ReadMemoryN(c.MemoryManager.VirtualHeapStart, int(c.Registers[18]))
-			for i := 0; i < len(heapMemory); i += 4 {
-				if i+4 <= len(heapMemory) {
-					v := binary.LittleEndian.Uint32(heapMemory[i : i+4])
-					heapWindow.Text += fmt.Sprintf("%08x\n", v)
-				}
+			if status != "" {
+				taskWindow.Text += "\n" + status
 			}
-			ui.Render(video, regDump, simInfo, memoryWindow, accessWindow, stackWindow, heapWindow)
+			statsWindow.Text = c.MemoryManager.Stats().String()
+			ui.Render(video, regDump, simInfo, memoryWindow, accessWindow, stackWindow, heapWindow, taskWindow, statsWindow)
 		}
 	}
 }
 
+type listFlags []string
+
+func (m *listFlags) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *listFlags) Set(value string) error {
+	*m = append(*m, value)
+	return nil
+}
+
+func saveSnapshot(c *CPU, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	if err := c.Snapshot(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func restoreSnapshot(c *CPU, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return c.Restore(bufio.NewReader(file))
+}
+
 func DurationToFrequency(d time.Duration) string {
 	if d <= time.Nanosecond {
 		return fmt.Sprintf("%d GHz", time.Nanosecond/d)
@@ -261,6 +407,19 @@ func drawMemoryWindow(mem *MemoryManager, programCounter uint32) string {
 	return memoryWindow
 }
 
+func drawWordWindow(mem *MemoryManager, start uint32, end uint32) string {
+	var window string
+	for addr, lines := start, 0; addr+4 <= end && addr+4 > addr && lines < 25; addr, lines = addr+4, lines+1 {
+		if !mem.IsPageMapped(addr) || !mem.IsPageMapped(addr+3) {
+			window += "????????\n"
+			continue
+		}
+		v := binary.LittleEndian.Uint32(mem.ReadMemoryN(addr, 4))
+		window += fmt.Sprintf("%08x\n", v)
+	}
+	return window
+}
+
 func drawAccessWindow(mem *MemoryManager, lastAccess uint32) string {
 	linesBefore := 7
 	linesAfter := 7
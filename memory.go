@@ -1,6 +1,10 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
 
 type Memory struct {
 	RAM  *RAM
@@ -67,7 +71,35 @@ func (m *Memory) Read(addr uint32) uint8 {
 	}
 }
 
+// regionEnd returns the last address of the memory region addr is in.
+func regionEnd(addr uint32) uint32 {
+	switch {
+	case addr < 0x80000000:
+		return 0x7FFFFFFF
+	case addr < 0x88000000:
+		return 0x87FFFFFF
+	case addr < 0x88000400:
+		return 0x880003FF
+	case addr >= 0xFFFFF000:
+		return 0xFFFFFFFF
+	default:
+		return addr
+	}
+}
+
+// fitsInRegion reports whether an n byte access at addr stays within a single
+// memory region. Accesses that straddle regions are split into single bytes.
+func fitsInRegion(addr uint32, n uint32) bool {
+	return regionEnd(addr)-addr >= n-1
+}
+
+// Multi-byte accesses are little-endian. Device regions like VRAM, and
+// accesses crossing from one region into another, are performed one byte at a
+// time starting at the lowest address.
 func (m *Memory) ReadWord(addr uint32) uint16 {
+	if !fitsInRegion(addr, 2) {
+		return uint16(m.Read(addr)) | uint16(m.Read(addr+1))<<8
+	}
 	switch {
 	case addr < 0x80000000:
 		return m.RAM.ReadWord(addr)
@@ -76,13 +108,16 @@ func (m *Memory) ReadWord(addr uint32) uint16 {
 	case addr < 0x88000400:
 		return m.IVT.ReadWord(addr - 0x88000000)
 	case addr >= 0xFFFFF000:
-		panic("VRAM ReadWord")
+		return m.VRAM.ReadWord(addr - 0xFFFFF000)
 	default:
 		panic("Addressing unuseable memory")
 	}
 }
 
 func (m *Memory) ReadDWord(addr uint32) uint32 {
+	if !fitsInRegion(addr, 4) {
+		return uint32(m.ReadWord(addr)) | uint32(m.ReadWord(addr+2))<<16
+	}
 	switch {
 	case addr < 0x80000000:
 		return m.RAM.ReadDWord(addr)
@@ -91,7 +126,7 @@ func (m *Memory) ReadDWord(addr uint32) uint32 {
 	case addr < 0x88000400:
 		return m.IVT.ReadDWord(addr - 0x88000000)
 	case addr >= 0xFFFFF000:
-		panic("VRAM ReadDWord")
+		return m.VRAM.ReadDWord(addr - 0xFFFFF000)
 	default:
 		panic("Addressing unuseable memory")
 	}
@@ -134,6 +169,11 @@ func (m *Memory) Write(addr uint32, data uint8) {
 }
 
 func (m *Memory) WriteWord(addr uint32, data uint16) {
+	if !fitsInRegion(addr, 2) {
+		m.Write(addr, uint8(data))
+		m.Write(addr+1, uint8(data>>8))
+		return
+	}
 	switch {
 	case addr < 0x80000000:
 		m.RAM.WriteWord(addr, data)
@@ -142,13 +182,18 @@ func (m *Memory) WriteWord(addr uint32, data uint16) {
 	case addr < 0x88000400:
 		m.IVT.WriteWord(addr-0x88000000, data)
 	case addr >= 0xFFFFF000:
-		panic("VRAM WriteWord")
+		m.VRAM.WriteWord(addr-0xFFFFF000, data)
 	default:
 		panic("Addressing unuseable memory")
 	}
 }
 
 func (m *Memory) WriteDWord(addr uint32, data uint32) {
+	if !fitsInRegion(addr, 4) {
+		m.WriteWord(addr, uint16(data))
+		m.WriteWord(addr+2, uint16(data>>16))
+		return
+	}
 	switch {
 	case addr < 0x80000000:
 		m.RAM.WriteDWord(addr, data)
@@ -157,12 +202,25 @@ func (m *Memory) WriteDWord(addr uint32, data uint32) {
 	case addr < 0x88000400:
 		m.IVT.WriteDWord(addr-0x88000000, data)
 	case addr >= 0xFFFFF000:
-		panic("VRAM WriteDWord")
+		m.VRAM.WriteDWord(addr-0xFFFFF000, data)
 	default:
 		panic("Addressing unuseable memory")
 	}
 }
 
+// Fork returns a copy of the memory. RAM and ROM pages are shared with the
+// copy and only duplicated once either side writes to them.
+func (m *Memory) Fork() *Memory {
+	ivt := *m.IVT
+	vram := *m.VRAM
+	return &Memory{
+		RAM:  &RAM{m.RAM.fork()},
+		ROM:  &ROM{m.ROM.fork()},
+		IVT:  &ivt,
+		VRAM: &vram,
+	}
+}
+
 func (m *Memory) Clear() {
 	m.RAM.Clear()
 	m.ROM.Clear()
@@ -170,46 +228,113 @@ func (m *Memory) Clear() {
 	m.VRAM.Clear()
 }
 
-type RAM struct {
-	mem [0x80000000]uint8
+// memoryPage is a page of RAM or ROM. Pages can be shared between forked
+// machines, in which case refs counts the machines using it and the page is
+// copied before it is written to.
+type memoryPage struct {
+	data [PageSize]uint8
+	refs int32
 }
 
-func (r *RAM) Read(addr uint32) uint8 {
-	return r.mem[addr]
+// pagedMemory stores memory sparsely as pages, pages that were never written
+// read as zero.
+type pagedMemory struct {
+	pages map[uint32]*memoryPage
 }
 
-func (r *RAM) ReadWord(addr uint32) uint16 {
-	return uint16(r.mem[addr]) | uint16(r.mem[addr+1])<<8
+func newPagedMemory() pagedMemory {
+	return pagedMemory{pages: make(map[uint32]*memoryPage)}
 }
 
-func (r *RAM) ReadDWord(addr uint32) uint32 {
-	return uint32(r.mem[addr]) | uint32(r.mem[addr+1])<<8 | uint32(r.mem[addr+2])<<16 | uint32(r.mem[addr+3])<<24
+func (m *pagedMemory) Read(addr uint32) uint8 {
+	page := m.pages[addr/PageSize]
+	if page == nil {
+		return 0
+	}
+	return page.data[addr%PageSize]
 }
 
-func (r *RAM) Write(addr uint32, data uint8) {
-	r.mem[addr] = data
+func (m *pagedMemory) ReadWord(addr uint32) uint16 {
+	return uint16(m.Read(addr)) | uint16(m.Read(addr+1))<<8
 }
 
-func (r *RAM) WriteWord(addr uint32, data uint16) {
-	r.mem[addr] = uint8(data)
-	r.mem[addr+1] = uint8(data >> 8)
+func (m *pagedMemory) ReadDWord(addr uint32) uint32 {
+	return uint32(m.ReadWord(addr)) | uint32(m.ReadWord(addr+2))<<16
 }
 
-func (r *RAM) WriteDWord(addr uint32, data uint32) {
-	r.mem[addr] = uint8(data)
-	r.mem[addr+1] = uint8(data >> 8)
-	r.mem[addr+2] = uint8(data >> 16)
-	r.mem[addr+3] = uint8(data >> 24)
+func (m *pagedMemory) Write(addr uint32, data uint8) {
+	num := addr / PageSize
+	page := m.pages[num]
+	switch {
+	case page == nil:
+		if data == 0 {
+			return
+		}
+		page = &memoryPage{refs: 1}
+		m.pages[num] = page
+	case atomic.LoadInt32(&page.refs) > 1:
+		copied := &memoryPage{data: page.data, refs: 1}
+		atomic.AddInt32(&page.refs, -1)
+		page = copied
+		m.pages[num] = page
+	}
+	page.data[addr%PageSize] = data
 }
 
-func (r *RAM) Clear() {
-	for i := range r.mem {
-		r.mem[i] = 0
+func (m *pagedMemory) WriteWord(addr uint32, data uint16) {
+	m.Write(addr, uint8(data))
+	m.Write(addr+1, uint8(data>>8))
+}
+
+func (m *pagedMemory) WriteDWord(addr uint32, data uint32) {
+	m.WriteWord(addr, uint16(data))
+	m.WriteWord(addr+2, uint16(data>>16))
+}
+
+// Page returns a copy of the page with the given number and whether it has
+// ever been written to.
+func (m *pagedMemory) Page(num uint32) ([]uint8, bool) {
+	page := m.pages[num]
+	if page == nil {
+		return nil, false
+	}
+	return append([]uint8{}, page.data[:]...), true
+}
+
+// UsedPages returns the numbers of all pages that have been written to.
+func (m *pagedMemory) UsedPages() []uint32 {
+	var nums []uint32
+	for num := range m.pages {
+		nums = append(nums, num)
 	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums
+}
+
+// fork returns a copy of the memory that shares all pages with m until one of
+// them writes to a page.
+func (m *pagedMemory) fork() pagedMemory {
+	f := newPagedMemory()
+	for num, page := range m.pages {
+		atomic.AddInt32(&page.refs, 1)
+		f.pages[num] = page
+	}
+	return f
+}
+
+func (m *pagedMemory) Clear() {
+	for _, page := range m.pages {
+		atomic.AddInt32(&page.refs, -1)
+	}
+	m.pages = make(map[uint32]*memoryPage)
+}
+
+type RAM struct {
+	pagedMemory
 }
 
 func NewRAM() *RAM {
-	return &RAM{}
+	return &RAM{newPagedMemory()}
 }
 
 type IVT struct {
@@ -255,45 +380,41 @@ func NewIVT() *IVT {
 }
 
 type ROM struct {
-	mem [0x8000000]uint8
+	pagedMemory
 }
 
-func (r *ROM) Read(addr uint32) uint8 {
-	return r.mem[addr]
-}
-
-func (r *ROM) ReadWord(addr uint32) uint16 {
-	return uint16(r.mem[addr]) | uint16(r.mem[addr+1])<<8
+func NewROM() *ROM {
+	return &ROM{newPagedMemory()}
 }
 
-func (r *ROM) ReadDWord(addr uint32) uint32 {
-	return uint32(r.mem[addr]) | uint32(r.mem[addr+1])<<8 | uint32(r.mem[addr+2])<<16 | uint32(r.mem[addr+3])<<24
+type VRAM struct {
+	mem [0x1000]uint8
 }
 
-func (r *ROM) Write(addr uint32, data uint8) {
-	r.mem[addr] = data
+func (v *VRAM) Read(addr uint32) uint8 {
+	return v.mem[addr]
 }
 
-func (r *ROM) Clear() {
-	for i := range r.mem {
-		r.mem[i] = 0
-	}
+func (v *VRAM) ReadWord(addr uint32) uint16 {
+	return uint16(v.Read(addr)) | uint16(v.Read(addr+1))<<8
 }
 
-func NewROM() *ROM {
-	return &ROM{}
+func (v *VRAM) ReadDWord(addr uint32) uint32 {
+	return uint32(v.ReadWord(addr)) | uint32(v.ReadWord(addr+2))<<16
 }
 
-type VRAM struct {
-	mem [0x400]uint8
+func (v *VRAM) Write(addr uint32, data uint8) {
+	v.mem[addr] = data
 }
 
-func (v *VRAM) Read(addr uint32) uint8 {
-	return v.mem[addr]
+func (v *VRAM) WriteWord(addr uint32, data uint16) {
+	v.Write(addr, uint8(data))
+	v.Write(addr+1, uint8(data>>8))
 }
 
-func (v *VRAM) Write(addr uint32, data uint8) {
-	v.mem[addr] = data
+func (v *VRAM) WriteDWord(addr uint32, data uint32) {
+	v.WriteWord(addr, uint16(data))
+	v.WriteWord(addr+2, uint16(data>>16))
 }
 
 func (v *VRAM) Clear() {
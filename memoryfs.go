@@ -0,0 +1,486 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrReadOnly = errors.New("read-only filesystem")
+
+// DefaultMaxMemoryFileSize is the size files written to a MemoryVFS can grow
+// to by default.
+const DefaultMaxMemoryFileSize = 64 * 1024 * 1024
+
+// MemoryVFS is a VFS that keeps the whole file tree in memory. It can be
+// preloaded from a folder or an archive on the host. A read-only MemoryVFS
+// rejects every change made through the VFS interface. Writes that would make
+// a file larger than MaxFileSize fail, so a program cannot use up the memory
+// of the host, 0 means no limit.
+type MemoryVFS struct {
+	mu          sync.Mutex
+	root        *memoryNode
+	ReadOnly    bool
+	MaxFileSize int64
+}
+
+type memoryNode struct {
+	Name     string
+	Data     []byte
+	Mode     os.FileMode
+	Children map[string]*memoryNode
+}
+
+func (n *memoryNode) IsDir() bool {
+	return n.Mode.IsDir()
+}
+
+type MemoryFile struct {
+	Name   string
+	node   *memoryNode
+	offset int64
+}
+
+func (f *MemoryFile) FileName() string {
+	return f.Name
+}
+
+func NewMemoryVFS() *MemoryVFS {
+	return &MemoryVFS{
+		MaxFileSize: DefaultMaxMemoryFileSize,
+		root: &memoryNode{
+			Name:     "/",
+			Mode:     os.ModeDir | 0755,
+			Children: make(map[string]*memoryNode),
+		},
+	}
+}
+
+// splitPath cleans name and splits it into its parent folder and base name.
+func splitPath(name string) (string, string) {
+	name = path.Clean("/" + name)
+	return path.Dir(name), path.Base(name)
+}
+
+func (vfs *MemoryVFS) lookup(name string) (*memoryNode, error) {
+	node := vfs.root
+	for _, part := range strings.Split(path.Clean("/"+name), "/") {
+		if part == "" {
+			continue
+		}
+		if !node.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+		child, ok := node.Children[part]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		node = child
+	}
+	return node, nil
+}
+
+func (vfs *MemoryVFS) lookupDir(name string) (*memoryNode, error) {
+	node, err := vfs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !node.IsDir() {
+		return nil, ErrNotDir
+	}
+	return node, nil
+}
+
+func (vfs *MemoryVFS) Open(name string) (interface{}, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	node, err := vfs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if node.IsDir() {
+		return nil, ErrIsDir
+	}
+	return &MemoryFile{Name: name, node: node}, nil
+}
+
+func (vfs *MemoryVFS) Close(file interface{}) error {
+	return nil
+}
+
+// Create creates an empty file, truncating it if it already exists. The
+// parent folder has to exist.
+func (vfs *MemoryVFS) Create(name string) (interface{}, error) {
+	if vfs.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	dir, base := splitPath(name)
+	parent, err := vfs.lookupDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	node, ok := parent.Children[base]
+	if ok && node.IsDir() {
+		return nil, ErrIsDir
+	}
+	if !ok {
+		node = &memoryNode{Name: base, Mode: 0644}
+		parent.Children[base] = node
+	}
+	node.Data = nil
+	return &MemoryFile{Name: name, node: node}, nil
+}
+
+func (vfs *MemoryVFS) Remove(name string) error {
+	if vfs.ReadOnly {
+		return ErrReadOnly
+	}
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	dir, base := splitPath(name)
+	parent, err := vfs.lookupDir(dir)
+	if err != nil {
+		return err
+	}
+	node, ok := parent.Children[base]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	if node.IsDir() && len(node.Children) > 0 {
+		return ErrNotEmpty
+	}
+	delete(parent.Children, base)
+	return nil
+}
+
+// Rename moves a file or folder. The new parent folder has to exist, and an
+// existing file at the new name is replaced.
+func (vfs *MemoryVFS) Rename(oldName string, newName string) error {
+	if vfs.ReadOnly {
+		return ErrReadOnly
+	}
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	oldDir, oldBase := splitPath(oldName)
+	oldParent, err := vfs.lookupDir(oldDir)
+	if err != nil {
+		return err
+	}
+	node, ok := oldParent.Children[oldBase]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	newDir, newBase := splitPath(newName)
+	newParent, err := vfs.lookupDir(newDir)
+	if err != nil {
+		return err
+	}
+	if node.IsDir() && strings.HasPrefix(cleanPath(newName)+"/", cleanPath(oldName)+"/") {
+		return fmt.Errorf("cannot move a directory into itself: %w", ErrInvalid)
+	}
+	if existing, ok := newParent.Children[newBase]; ok && existing != node {
+		if existing.IsDir() != node.IsDir() {
+			return fmt.Errorf("cannot replace a file with a directory or the other way around: %w", ErrInvalid)
+		}
+		if existing.IsDir() && len(existing.Children) > 0 {
+			return ErrNotEmpty
+		}
+	}
+	delete(oldParent.Children, oldBase)
+	node.Name = newBase
+	newParent.Children[newBase] = node
+	return nil
+}
+
+func (vfs *MemoryVFS) Stat(name string) (*FileInfo, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	node, err := vfs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{
+		Name: name,
+		Size: int64(len(node.Data)),
+		Mode: node.Mode,
+	}, nil
+}
+
+func (vfs *MemoryVFS) ReadDir(name string) ([]*FileInfo, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	node, err := vfs.lookupDir(name)
+	if err != nil {
+		return nil, err
+	}
+	fileInfos := make([]*FileInfo, 0, len(node.Children))
+	for _, child := range node.Children {
+		fileInfos = append(fileInfos, &FileInfo{
+			Name: child.Name,
+			Size: int64(len(child.Data)),
+			Mode: child.Mode,
+		})
+	}
+	sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name < fileInfos[j].Name })
+	return fileInfos, nil
+}
+
+func (vfs *MemoryVFS) Read(file interface{}, b []byte) (int, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	f := file.(*MemoryFile)
+	n, err := vfs.readAt(f, b, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (vfs *MemoryVFS) Write(file interface{}, b []byte) (int, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	f := file.(*MemoryFile)
+	n, err := vfs.writeAt(f, b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (vfs *MemoryVFS) ReadAt(file interface{}, b []byte, off int64) (int, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	return vfs.readAt(file.(*MemoryFile), b, off)
+}
+
+func (vfs *MemoryVFS) readAt(f *MemoryFile, b []byte, off int64) (int, error) {
+	data := f.node.Data
+	if off < 0 {
+		return 0, ErrInvalid
+	}
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (vfs *MemoryVFS) WriteAt(file interface{}, b []byte, off int64) (int, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	return vfs.writeAt(file.(*MemoryFile), b, off)
+}
+
+func (vfs *MemoryVFS) writeAt(f *MemoryFile, b []byte, off int64) (int, error) {
+	if vfs.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	node := f.node
+	if off < 0 {
+		return 0, ErrInvalid
+	}
+	if end := off + int64(len(b)); end > int64(len(node.Data)) {
+		if vfs.MaxFileSize > 0 && end > vfs.MaxFileSize {
+			return 0, ErrQuotaExceeded
+		}
+		data := make([]byte, end)
+		copy(data, node.Data)
+		node.Data = data
+	}
+	return copy(node.Data[off:], b), nil
+}
+
+func (vfs *MemoryVFS) Seek(file interface{}, off int64, whence int) (int64, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	f := file.(*MemoryFile)
+	switch whence {
+	case io.SeekCurrent:
+		off += f.offset
+	case io.SeekEnd:
+		off += int64(len(f.node.Data))
+	}
+	if off < 0 {
+		return 0, ErrInvalid
+	}
+	f.offset = off
+	return off, nil
+}
+
+func (vfs *MemoryVFS) LoadBinary(file interface{}, mm *MemoryManager) (*ProgramInfo, error) {
+	vfs.mu.Lock()
+	data := file.(*MemoryFile).node.Data
+	vfs.mu.Unlock()
+	return loadBytecode(data, mm)
+}
+
+// NewArchiveVFS returns a read-only VFS with the contents of a .tar or .zip
+// archive.
+func NewArchiveVFS(filename string) (*MemoryVFS, error) {
+	vfs := NewMemoryVFS()
+	if err := vfs.LoadArchive(filename); err != nil {
+		return nil, err
+	}
+	vfs.ReadOnly = true
+	return vfs, nil
+}
+
+// Mkdir creates a folder and all of its missing parents.
+func (vfs *MemoryVFS) Mkdir(name string) error {
+	if vfs.ReadOnly {
+		return ErrReadOnly
+	}
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	_, err := vfs.mkdirAll(name)
+	return err
+}
+
+func (vfs *MemoryVFS) mkdirAll(name string) (*memoryNode, error) {
+	node := vfs.root
+	for _, part := range strings.Split(path.Clean("/"+name), "/") {
+		if part == "" {
+			continue
+		}
+		child, ok := node.Children[part]
+		if !ok {
+			child = &memoryNode{
+				Name:     part,
+				Mode:     os.ModeDir | 0755,
+				Children: make(map[string]*memoryNode),
+			}
+			node.Children[part] = child
+		}
+		if !child.IsDir() {
+			return nil, ErrNotDir
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// AddFile stores a file with the given contents, creating its parent folders
+// if needed.
+func (vfs *MemoryVFS) AddFile(name string, data []byte) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	dir, base := splitPath(name)
+	parent, err := vfs.mkdirAll(dir)
+	if err != nil {
+		return err
+	}
+	if node, ok := parent.Children[base]; ok && node.IsDir() {
+		return ErrIsDir
+	}
+	parent.Children[base] = &memoryNode{Name: base, Data: data, Mode: 0644}
+	return nil
+}
+
+// LoadDir copies all files below a folder on the host into the VFS.
+func (vfs *MemoryVFS) LoadDir(root string) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			return vfs.Mkdir(rel)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return vfs.AddFile(rel, data)
+	})
+}
+
+// LoadArchive copies all files from a .tar or .zip archive into the VFS.
+func (vfs *MemoryVFS) LoadArchive(filename string) error {
+	switch {
+	case strings.HasSuffix(filename, ".tar"):
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return vfs.LoadTar(file)
+	case strings.HasSuffix(filename, ".zip"):
+		r, err := zip.OpenReader(filename)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return vfs.LoadZip(&r.Reader)
+	}
+	return errors.New("unknown archive type")
+}
+
+func (vfs *MemoryVFS) LoadTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = vfs.Mkdir(header.Name)
+		case tar.TypeReg:
+			var data []byte
+			data, err = io.ReadAll(tr)
+			if err == nil {
+				err = vfs.AddFile(header.Name, data)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (vfs *MemoryVFS) LoadZip(r *zip.Reader) error {
+	for _, file := range r.File {
+		if file.FileInfo().IsDir() {
+			if err := vfs.Mkdir(file.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err := vfs.AddFile(file.Name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
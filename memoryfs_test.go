@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+func TestMemoryVFSReadWrite(t *testing.T) {
+	vfs := NewMemoryVFS()
+	file, err := vfs.Create("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vfs.Write(file, []byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vfs.WriteAt(file, []byte("there"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vfs.WriteAt(file, []byte("!"), 12); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		off  int64
+		size int
+		want string
+		err  error
+	}{
+		{0, 5, "hello", nil},
+		{6, 5, "there", nil},
+		{11, 2, "\x00!", nil},
+		{10, 8, "e\x00!", io.EOF},
+		{13, 1, "", io.EOF},
+	}
+	for _, tt := range tests {
+		b := make([]byte, tt.size)
+		n, err := vfs.ReadAt(file, b, tt.off)
+		if err != tt.err || string(b[:n]) != tt.want {
+			t.Errorf("ReadAt(%d, %d) = %q, %v, want %q, %v", tt.off, tt.size, b[:n], err, tt.want, tt.err)
+		}
+	}
+
+	info, err := vfs.Stat("/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 13 {
+		t.Errorf("size = %d, want 13", info.Size)
+	}
+}
+
+func TestMemoryVFSErrors(t *testing.T) {
+	vfs := NewMemoryVFS()
+	if err := vfs.AddFile("dir/file.txt", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.Mkdir("empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		op   func() error
+		want error
+	}{
+		{"open missing", func() error { _, err := vfs.Open("missing.txt"); return err }, fs.ErrNotExist},
+		{"open folder", func() error { _, err := vfs.Open("dir"); return err }, ErrIsDir},
+		{"create over folder", func() error { _, err := vfs.Create("dir"); return err }, ErrIsDir},
+		{"create in missing folder", func() error { _, err := vfs.Create("missing/file.txt"); return err }, fs.ErrNotExist},
+		{"remove full folder", func() error { return vfs.Remove("dir") }, ErrNotEmpty},
+		{"rename into itself", func() error { return vfs.Rename("dir", "dir/sub") }, ErrInvalid},
+		{"rename folder over file", func() error { return vfs.Rename("empty", "dir/file.txt") }, ErrInvalid},
+		{"rename over full folder", func() error { return vfs.Rename("empty", "dir") }, ErrNotEmpty},
+		{"remove empty folder", func() error { return vfs.Remove("empty") }, nil},
+	}
+	for _, tt := range tests {
+		if err := tt.op(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestMemoryVFSReadOnly(t *testing.T) {
+	vfs := NewMemoryVFS()
+	if err := vfs.AddFile("file.txt", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	file, err := vfs.Open("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vfs.ReadOnly = true
+
+	tests := []struct {
+		name string
+		op   func() error
+	}{
+		{"create", func() error { _, err := vfs.Create("new.txt"); return err }},
+		{"write", func() error { _, err := vfs.Write(file, []byte("x")); return err }},
+		{"remove", func() error { return vfs.Remove("file.txt") }},
+		{"rename", func() error { return vfs.Rename("file.txt", "other.txt") }},
+		{"mkdir", func() error { return vfs.Mkdir("dir") }},
+	}
+	for _, tt := range tests {
+		if err := tt.op(); err != ErrReadOnly {
+			t.Errorf("%s: got %v, want %v", tt.name, err, ErrReadOnly)
+		}
+	}
+
+	b := make([]byte, 4)
+	if n, err := vfs.Read(file, b); err != nil || string(b[:n]) != "data" {
+		t.Errorf("Read = %q, %v, want %q", b[:n], err, "data")
+	}
+}
+
+func TestMemoryVFSMaxFileSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		max   int64
+		off   int64
+		write int
+		want  error
+	}{
+		{"up to the limit", 16, 0, 16, nil},
+		{"past the limit", 16, 0, 17, ErrQuotaExceeded},
+		{"offset past the limit", 16, 16, 1, ErrQuotaExceeded},
+		{"huge offset", DefaultMaxMemoryFileSize, 4 << 30, 1, ErrQuotaExceeded},
+		{"overwriting at the limit", 16, 8, 8, nil},
+		{"no limit", 0, 1 << 20, 1, nil},
+	}
+	for _, tt := range tests {
+		vfs := NewMemoryVFS()
+		vfs.MaxFileSize = tt.max
+		if err := vfs.AddFile("file.txt", make([]byte, 16)); err != nil {
+			t.Fatal(err)
+		}
+		file, err := vfs.Open("file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vfs.WriteAt(file, make([]byte, tt.write), tt.off); err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
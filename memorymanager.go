@@ -17,9 +17,24 @@ const (
 	ROMEnd    = 0x87FFFFFF
 	VRAMStart = 0xFFFFF000
 	VRAMEnd   = 0xFFFFFFFF
+
+	DefaultStackSize = 0x100000
+	// MaxStackSize leaves room below the stack for its guard page, the stacks
+	// of other tasks and the heap.
+	MaxStackSize = 0x10000000
+)
+
+var (
+	ErrStackOverflow  = errors.New("stack overflow")
+	ErrStackUnderflow = errors.New("stack underflow")
+	ErrUnmappedMemory = errors.New("unmapped memory access")
+	ErrProgramBusy    = errors.New("program is in use")
+	ErrOutOfMemory    = errors.New("out of memory")
 )
 
 type ProgramInfo struct {
+	Handle       uint32
+	BaseAddress  uint32
 	StartAddress uint32
 	Size         uint32
 	Sectors      []ProgramInfoSector
@@ -37,8 +52,14 @@ type MemoryManager struct {
 	Programs         []*ProgramInfo
 	PageTable        map[uint32]uint32
 	FreeFrames       []uint32
+	FrameRefs        map[uint32]uint32
 	VirtualStackEnd  uint32
 	VirtualHeapStart uint32
+	StackSize        uint32
+	Mappings         []*MemoryMapping
+	SharedMemory     []*SharedMemory
+	Allocations      map[uint32]*Allocation
+	PeakPages        int
 }
 
 func NewMemoryManager(cpu *CPU, memory *Memory) *MemoryManager {
@@ -48,8 +69,11 @@ func NewMemoryManager(cpu *CPU, memory *Memory) *MemoryManager {
 		Programs:         []*ProgramInfo{},
 		PageTable:        make(map[uint32]uint32),
 		FreeFrames:       []uint32{},
+		FrameRefs:        make(map[uint32]uint32),
+		Allocations:      make(map[uint32]*Allocation),
 		VirtualStackEnd:  0x7FFFFFFF,
 		VirtualHeapStart: 0x00000000,
+		StackSize:        DefaultStackSize,
 	}
 
 	mm.cpu.Registers[17] = mm.VirtualStackEnd
@@ -64,19 +88,38 @@ func NewMemoryManager(cpu *CPU, memory *Memory) *MemoryManager {
 
 func (mm *MemoryManager) AllocateFrame() (uint32, error) {
 	if len(mm.FreeFrames) == 0 {
-		return 0, fmt.Errorf("out of memory")
+		return 0, ErrOutOfMemory
 	}
 
 	frame := mm.FreeFrames[0]
 	mm.FreeFrames = mm.FreeFrames[1:]
+	mm.FrameRefs[frame] = 1
 
 	return frame, nil
 }
 
+// RetainFrame adds a reference to a frame that is mapped more than once, so
+// it is only returned to FreeFrames once every user has freed it.
+func (mm *MemoryManager) RetainFrame(frame uint32) {
+	mm.FrameRefs[frame]++
+}
+
 func (mm *MemoryManager) FreeFrame(frame uint32) {
+	if mm.FrameRefs[frame] > 1 {
+		mm.FrameRefs[frame]--
+		return
+	}
+	delete(mm.FrameRefs, frame)
 	mm.FreeFrames = append(mm.FreeFrames, frame)
 }
 
+func (mm *MemoryManager) mapPage(pageNum uint32, frame uint32) {
+	mm.PageTable[pageNum] = frame
+	if len(mm.PageTable) > mm.PeakPages {
+		mm.PeakPages = len(mm.PageTable)
+	}
+}
+
 func (mm *MemoryManager) MapVirtualToPhysical(virtualAddr uint32) error {
 	virtualPageNum := virtualAddr / PageSize
 	if _, exists := mm.PageTable[virtualPageNum]; !exists {
@@ -84,30 +127,53 @@ func (mm *MemoryManager) MapVirtualToPhysical(virtualAddr uint32) error {
 		if err != nil {
 			return err
 		}
-		mm.PageTable[virtualPageNum] = physicalPageIndex
+		mm.mapPage(virtualPageNum, physicalPageIndex)
 	}
 	return nil
 }
 
 func (mm *MemoryManager) TranslateAddress(virtualAddr uint32) (uint32, error) {
-	if virtualAddr >= ROMStart || virtualAddr <= ROMEnd {
-		return virtualAddr, nil
-	} else if virtualAddr >= VRAMStart || virtualAddr <= VRAMEnd {
-		return virtualAddr, nil
-	} else if virtualAddr >= IVTStart || virtualAddr <= IVTEnd {
+	return mm.translate(virtualAddr, false)
+}
+
+// translate maps a virtual address to a physical one. Pages of memory-mapped
+// files are read in on first access, and marked dirty when written to.
+func (mm *MemoryManager) translate(virtualAddr uint32, write bool) (uint32, error) {
+	if mm.IsGuardPage(virtualAddr) {
+		return 0, ErrStackOverflow
+	}
+	if virtualAddr > RAMEnd {
 		return virtualAddr, nil
 	}
 	virtualPageNum := virtualAddr / PageSize
 	offset := virtualAddr % PageSize
 
-	if physicalPageIndex, exists := mm.PageTable[virtualPageNum]; exists {
-		return uint32(physicalPageIndex)*PageSize + offset, nil
+	physicalPageIndex, exists := mm.PageTable[virtualPageNum]
+	if !exists {
+		mapping := mm.MappingAt(virtualAddr)
+		if mapping == nil {
+			return 0, ErrUnmappedMemory
+		}
+		var err error
+		physicalPageIndex, err = mm.pageIn(mapping, virtualPageNum)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if write {
+		if mapping := mm.MappingAt(virtualAddr); mapping != nil {
+			mapping.Dirty[virtualPageNum] = true
+		}
 	}
 
-	return 0, errors.New("unmapped memory access")
+	return uint32(physicalPageIndex)*PageSize + offset, nil
 }
 
 func (mm *MemoryManager) CanRead(addr uint32) bool {
+	if addr <= RAMEnd && !mm.IsPageMapped(addr) {
+		return false
+	}
 	addr, err := mm.TranslateAddress(addr)
 	if err != nil {
 		return false
@@ -115,26 +181,45 @@ func (mm *MemoryManager) CanRead(addr uint32) bool {
 	return mm.Memory.CanRead(addr)
 }
 
+// fault stops the CPU with a fault for errors the guest can cause on its own,
+// and panics for everything else.
+func (mm *MemoryManager) fault(err error) {
+	if errors.Is(err, ErrStackOverflow) || errors.Is(err, ErrStackUnderflow) || errors.Is(err, ErrUnmappedMemory) {
+		mm.cpu.RaiseFault(err)
+		return
+	}
+	panic(err)
+}
+
 func (mm *MemoryManager) ReadMemory(addr uint32) byte {
 	physAddr, err := mm.TranslateAddress(addr)
 	if err != nil {
-		panic(err)
+		mm.fault(err)
+		return 0
 	}
 	return mm.Memory.Read(physAddr)
 }
 
 func (mm *MemoryManager) ReadMemoryWord(addr uint32) uint16 {
+	if addr > RAMEnd && fitsInRegion(addr, 2) {
+		return mm.Memory.ReadWord(addr)
+	}
 	data, err := mm.ReadNMemory(addr, 2)
 	if err != nil {
-		panic(err)
+		mm.fault(err)
+		return 0
 	}
 	return binary.LittleEndian.Uint16(data)
 }
 
 func (mm *MemoryManager) ReadMemoryDWord(addr uint32) uint32 {
+	if addr > RAMEnd && fitsInRegion(addr, 4) {
+		return mm.Memory.ReadDWord(addr)
+	}
 	data, err := mm.ReadNMemory(addr, 4)
 	if err != nil {
-		panic(err)
+		mm.fault(err)
+		return 0
 	}
 	return binary.LittleEndian.Uint32(data)
 }
@@ -155,7 +240,8 @@ func (mm *MemoryManager) ReadMemoryString(addr uint32) string {
 func (mm *MemoryManager) ReadMemoryN(addr uint32, n int) []byte {
 	data, err := mm.ReadNMemory(addr, n)
 	if err != nil {
-		panic(err)
+		mm.fault(err)
+		return make([]byte, n)
 	}
 	return data
 }
@@ -173,34 +259,43 @@ func (mm *MemoryManager) ReadNMemory(addr uint32, n int) ([]byte, error) {
 }
 
 func (mm *MemoryManager) WriteMemory(addr uint32, value byte) {
-	physAddr, err := mm.TranslateAddress(addr)
+	physAddr, err := mm.translate(addr, true)
 	if err != nil {
-		panic(err)
+		mm.fault(err)
+		return
 	}
 	mm.Memory.Write(physAddr, value)
 }
 
 func (mm *MemoryManager) WriteMemoryWord(addr uint32, value uint16) {
+	if addr > RAMEnd && fitsInRegion(addr, 2) {
+		mm.Memory.WriteWord(addr, value)
+		return
+	}
 	valueBytes := make([]byte, 2)
 	binary.LittleEndian.PutUint16(valueBytes, value)
 	err := mm.WriteNMemory(addr, valueBytes)
 	if err != nil {
-		panic(err)
+		mm.fault(err)
 	}
 }
 
 func (mm *MemoryManager) WriteMemoryDWord(addr uint32, value uint32) {
+	if addr > RAMEnd && fitsInRegion(addr, 4) {
+		mm.Memory.WriteDWord(addr, value)
+		return
+	}
 	valueBytes := make([]byte, 4)
 	binary.LittleEndian.PutUint32(valueBytes, value)
 	err := mm.WriteNMemory(addr, valueBytes)
 	if err != nil {
-		panic(err)
+		mm.fault(err)
 	}
 }
 
 func (mm *MemoryManager) WriteNMemory(addr uint32, data []byte) error {
 	for i, value := range data {
-		physAddr, err := mm.TranslateAddress(addr + uint32(i))
+		physAddr, err := mm.translate(addr+uint32(i), true)
 		if err != nil {
 			return err
 		}
@@ -209,19 +304,51 @@ func (mm *MemoryManager) WriteNMemory(addr uint32, data []byte) error {
 	return nil
 }
 
-func (mm *MemoryManager) Push(value uint32) {
-	if mm.cpu.Registers[17]-4 < mm.cpu.Registers[18] {
-		if err := mm.GrowStack(); err != nil {
-			panic(err)
-		}
+// StackLimit returns the lowest address the stack of the running task may
+// grow to. The page directly below it is the guard page.
+func (mm *MemoryManager) StackLimit() uint32 {
+	return mm.VirtualStackEnd - mm.StackSize
+}
+
+func (mm *MemoryManager) IsGuardPage(addr uint32) bool {
+	guardStart := mm.StackLimit() - PageSize
+	return addr >= guardStart && addr < mm.StackLimit()
+}
+
+// SetStackSize changes the size of the stack, rounded up to whole pages. It
+// should only be called before any task is started.
+func (mm *MemoryManager) SetStackSize(size uint32) error {
+	if err := checkStackSize(size); err != nil {
+		return err
 	}
+	mm.StackSize = (size + PageSize - 1) &^ (PageSize - 1)
+	return nil
+}
 
-	mm.cpu.Registers[17] -= 4
+// checkStackSize returns an error if size is 0 or larger than MaxStackSize.
+func checkStackSize(size uint32) error {
+	if size == 0 || size > MaxStackSize {
+		return fmt.Errorf("stack size %d is not between 1 and %d bytes: %w", size, MaxStackSize, ErrInvalid)
+	}
+	return nil
+}
+
+func (mm *MemoryManager) Push(value uint32) {
+	newStackPtr := mm.cpu.Registers[17] - 4
+	if newStackPtr < mm.StackLimit() || newStackPtr > mm.cpu.Registers[17] {
+		mm.cpu.RaiseFault(ErrStackOverflow)
+		return
+	}
 
-	if err := mm.MapVirtualToPhysical(mm.cpu.Registers[17]); err != nil {
+	if err := mm.MapVirtualToPhysical(newStackPtr); err != nil {
+		panic(err)
+	}
+	if err := mm.MapVirtualToPhysical(newStackPtr + 3); err != nil {
 		panic(err)
 	}
 
+	mm.cpu.Registers[17] = newStackPtr
+
 	valueBytes := make([]byte, 4)
 	binary.LittleEndian.PutUint32(valueBytes, value)
 	err := mm.WriteNMemory(mm.cpu.Registers[17], valueBytes)
@@ -232,7 +359,8 @@ func (mm *MemoryManager) Push(value uint32) {
 
 func (mm *MemoryManager) Pop() uint32 {
 	if mm.cpu.Registers[17] >= mm.VirtualStackEnd {
-		panic("stack underflow")
+		mm.cpu.RaiseFault(ErrStackUnderflow)
+		return 0
 	}
 
 	valueBytes, err := mm.ReadNMemory(mm.cpu.Registers[17], 4)
@@ -249,7 +377,22 @@ func (mm *MemoryManager) Pop() uint32 {
 	return value
 }
 
+// Malloc allocates memory on the heap for the guest, and remembers the
+// allocation along with the instruction that made it.
 func (mm *MemoryManager) Malloc(size uint32) (uint32, error) {
+	addr, err := mm.allocate(size)
+	if err != nil {
+		return 0, err
+	}
+	mm.Allocations[addr] = &Allocation{
+		Address: addr,
+		Size:    size,
+		PC:      mm.cpu.LastInstructionAddress,
+	}
+	return addr, nil
+}
+
+func (mm *MemoryManager) allocate(size uint32) (uint32, error) {
 	alignedSize := (size + 3) & ^uint32(3)
 	startAddr := mm.cpu.Registers[18]
 	endAddr := startAddr + alignedSize
@@ -264,61 +407,56 @@ func (mm *MemoryManager) Malloc(size uint32) (uint32, error) {
 }
 
 func (mm *MemoryManager) Free(addr uint32, size uint32) {
-	alignedSize := (size + 3) & ^uint32(3)
-	startAddr := addr
-	endAddr := startAddr + alignedSize
+	delete(mm.Allocations, addr)
 
-	for freeAddr := startAddr; freeAddr < endAddr; freeAddr += PageSize {
-		pageNum := freeAddr / PageSize
+	alignedSize := (size + 3) & ^uint32(3)
+	startPage := addr / PageSize
+	endPage := (addr + alignedSize + PageSize - 1) / PageSize
+
+	for pageNum := startPage; pageNum < endPage; pageNum++ {
+		// Pages of mapped files and shared memory are only released by MUNMAP,
+		// since other mappings may still be using their frames.
+		if mm.MappingAt(pageNum*PageSize) != nil {
+			continue
+		}
 		if physicalPageIndex, exists := mm.PageTable[pageNum]; exists {
-			mm.WriteNMemory(freeAddr, make([]byte, PageSize))
+			mm.WriteNMemory(pageNum*PageSize, make([]byte, PageSize))
 			delete(mm.PageTable, pageNum)
 			mm.FreeFrame(physicalPageIndex)
 		}
 	}
 
-	mm.TryShrinkHeap()
+	mm.reclaimHeap()
 }
 
-func (mm *MemoryManager) GrowStack() error {
-	newStackPtr := mm.cpu.Registers[17] - PageSize
-	if newStackPtr <= mm.cpu.Registers[18] {
-		return errors.New("cannot grow stack: collision with heap")
-	}
-
-	if err := mm.MapVirtualToPhysical(newStackPtr); err != nil {
-		return err
+// reclaimHeap lowers the heap pointer past any pages at the top of the heap
+// that are no longer in use.
+func (mm *MemoryManager) reclaimHeap() {
+	for mm.cpu.Registers[18] > mm.VirtualHeapStart {
+		topPage := mm.cpu.Registers[18] - PageSize
+		if _, mapped := mm.PageTable[topPage/PageSize]; mapped || mm.MappingAt(topPage) != nil {
+			break
+		}
+		mm.cpu.Registers[18] -= PageSize
 	}
 
-	mm.cpu.Registers[17] = newStackPtr
-	return nil
+	mm.TryShrinkHeap()
 }
 
+// TryShrinkStack unmaps the page below the one the stack pointer is in, since
+// everything below the stack pointer is free.
 func (mm *MemoryManager) TryShrinkStack() {
-	if (mm.cpu.Registers[17]%PageSize == 0) && (mm.cpu.Registers[17] < mm.VirtualStackEnd) {
-		topPageStart := mm.cpu.Registers[17]
-		topPageEnd := topPageStart + PageSize
-
-		isEmpty := true
-		for addr := topPageStart; addr < topPageEnd; addr += 4 {
-			value, err := mm.ReadNMemory(addr, 4)
-			if err != nil || binary.LittleEndian.Uint32(value) != 0 {
-				isEmpty = false
-				break
-			}
-		}
-
-		if isEmpty {
-			mm.UnmapPage(topPageStart)
-			mm.cpu.Registers[17] += PageSize
-		}
+	spPage := mm.cpu.Registers[17] / PageSize
+	if spPage == 0 || spPage*PageSize <= mm.StackLimit() {
+		return
 	}
+	mm.UnmapPage((spPage - 1) * PageSize)
 }
 
 func (mm *MemoryManager) GrowHeap() error {
 	newHeapPtr := mm.cpu.Registers[18] + PageSize
-	if newHeapPtr >= mm.cpu.Registers[17] {
-		return errors.New("cannot grow heap: collision with stack")
+	if newHeapPtr > mm.cpu.Scheduler.StackFloor() {
+		return fmt.Errorf("cannot grow heap: collision with stack: %w", ErrOutOfMemory)
 	}
 
 	if err := mm.MapVirtualToPhysical(mm.cpu.Registers[18]); err != nil {
@@ -330,16 +468,18 @@ func (mm *MemoryManager) GrowHeap() error {
 }
 
 func (mm *MemoryManager) TryShrinkHeap() {
-	if (mm.cpu.Registers[18]%PageSize == 0) && (mm.cpu.Registers[18] > mm.VirtualHeapStart) {
+	if (mm.cpu.Registers[18]%PageSize == 0) && (mm.cpu.Registers[18] > mm.VirtualHeapStart) && mm.MappingAt(mm.cpu.Registers[18]-PageSize) == nil {
 		topPageStart := mm.cpu.Registers[18] - PageSize
 		topPageEnd := mm.cpu.Registers[18]
 
-		isEmpty := true
-		for addr := topPageStart; addr < topPageEnd; addr += 4 {
-			value, err := mm.ReadNMemory(addr, 4)
-			if err != nil || binary.LittleEndian.Uint32(value) != 0 {
-				isEmpty = false
-				break
+		isEmpty := mm.allocationAt(topPageStart) == nil && mm.programAt(topPageStart) == nil
+		if _, mapped := mm.PageTable[topPageStart/PageSize]; mapped && isEmpty {
+			for addr := topPageStart; addr < topPageEnd; addr += 4 {
+				value, err := mm.ReadNMemory(addr, 4)
+				if err != nil || binary.LittleEndian.Uint32(value) != 0 {
+					isEmpty = false
+					break
+				}
 			}
 		}
 
@@ -350,6 +490,11 @@ func (mm *MemoryManager) TryShrinkHeap() {
 	}
 }
 
+func (mm *MemoryManager) IsPageMapped(addr uint32) bool {
+	_, exists := mm.PageTable[addr/PageSize]
+	return exists
+}
+
 func (mm *MemoryManager) UnmapPage(addr uint32) {
 	pageNum := addr / PageSize
 	if physicalPageIndex, exists := mm.PageTable[pageNum]; exists {
@@ -360,18 +505,17 @@ func (mm *MemoryManager) UnmapPage(addr uint32) {
 
 func (mm *MemoryManager) ExecuteJump(currentPC uint32, jumpAddr uint32) uint32 {
 	for _, info := range mm.Programs {
+		if info == nil {
+			continue
+		}
 		if currentPC >= info.StartAddress && currentPC < info.StartAddress+info.Size {
 			if jumpAddr >= RAMEnd {
 				return jumpAddr
 			}
-			translatedAddr, err := mm.TranslateAddress(info.StartAddress + jumpAddr)
-			if err != nil {
-				panic(err)
+			if _, err := mm.TranslateAddress(info.StartAddress + jumpAddr); err != nil {
+				mm.fault(err)
 			}
-			if translatedAddr == 0xFFFFFFFF {
-				panic("invalid jump address")
-			}
-			return translatedAddr
+			return info.StartAddress + jumpAddr
 		}
 	}
 	return jumpAddr
@@ -379,6 +523,7 @@ func (mm *MemoryManager) ExecuteJump(currentPC uint32, jumpAddr uint32) uint32 {
 
 func (mm *MemoryManager) NewProgram() *ProgramInfo {
 	program := &ProgramInfo{
+		Handle:  uint32(len(mm.Programs)),
 		Sectors: []ProgramInfoSector{},
 	}
 	mm.Programs = append(mm.Programs, program)
@@ -394,17 +539,25 @@ func (mm *MemoryManager) AddSector(programInfo *ProgramInfo, baseAddress uint32,
 	programInfo.Sectors = append(programInfo.Sectors, sector)
 }
 
-func (mm *MemoryManager) LoadProgram(programInfo *ProgramInfo) uint32 {
+// LoadProgram copies the sectors of a program onto the heap and returns its
+// start address. If there is not enough memory, the program is removed again
+// and its handle is left unused.
+func (mm *MemoryManager) LoadProgram(programInfo *ProgramInfo) (uint32, error) {
 	var totalSize uint32
 	for _, sector := range programInfo.Sectors {
 		totalSize += uint32(len(sector.Bytecode))
 	}
 
-	startAddr, err := mm.Malloc(totalSize)
+	startAddr, err := mm.allocate(totalSize)
 	if err != nil {
-		panic(err)
+		mm.Programs[programInfo.Handle] = nil
+		if programInfo.Handle == uint32(len(mm.Programs))-1 {
+			mm.Programs = mm.Programs[:programInfo.Handle]
+		}
+		return 0, fmt.Errorf("cannot load program: %w", err)
 	}
 
+	programInfo.BaseAddress = startAddr
 	programInfo.StartAddress = startAddr
 
 	for _, sector := range programInfo.Sectors {
@@ -416,18 +569,39 @@ func (mm *MemoryManager) LoadProgram(programInfo *ProgramInfo) uint32 {
 		startAddr += uint32(len(sector.Bytecode))
 	}
 
-	return programInfo.StartAddress
+	return programInfo.StartAddress, nil
+}
+
+func (mm *MemoryManager) Program(handle uint32) (*ProgramInfo, error) {
+	if handle >= uint32(len(mm.Programs)) || mm.Programs[handle] == nil {
+		return nil, fmt.Errorf("program not found: %w", ErrInvalid)
+	}
+	return mm.Programs[handle], nil
 }
 
-func (mm *MemoryManager) UnloadProgram(startAddr uint32) error {
-	programInfo := mm.Programs[startAddr]
-	if programInfo == nil {
-		return errors.New("program not found")
+// UnloadProgram frees the memory of a loaded program. The main program (handle
+// 0) and programs that a task is still executing cannot be unloaded.
+func (mm *MemoryManager) UnloadProgram(handle uint32) error {
+	if handle == 0 {
+		return ErrProgramBusy
+	}
+	programInfo, err := mm.Program(handle)
+	if err != nil {
+		return err
+	}
+	for _, t := range mm.cpu.Scheduler.Tasks {
+		pc := t.Registers[16]
+		if t == mm.cpu.Scheduler.Current {
+			pc = mm.cpu.Registers[16]
+		}
+		if t.State != TaskExited && pc >= programInfo.BaseAddress && pc < programInfo.BaseAddress+programInfo.Size {
+			return ErrProgramBusy
+		}
 	}
 
-	mm.Free(programInfo.StartAddress, programInfo.Size)
+	mm.Programs[handle] = nil
 
-	mm.Programs[startAddr] = nil
+	mm.Free(programInfo.BaseAddress, programInfo.Size)
 
 	return nil
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLoadBinaryOutOfMemory(t *testing.T) {
+	lib, err := EncodeBytecode(assemble(t, ".TEXT\n    HLT\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewMemoryVFS()
+	fs.AddFile("lib.bin", lib)
+	c := NewCPU()
+	c.FileSystem = fs
+	if err := c.LoadProgram(assemble(t, `
+.DATA
+    name DB "lib.bin", 0
+.TEXT
+    OPEN R1 [name]
+    LOADBIN R1 R2
+    HLT
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Take away the remaining frames, so the heap cannot grow for the library
+	frames := c.MemoryManager.FreeFrames
+	c.MemoryManager.FreeFrames = nil
+	runUntilHalted(t, c)
+	if c.Registers[2] != 0xFFFFFFFF || c.Registers[15] != 0xFFFFFFFF {
+		t.Errorf("LOADBIN returned start %#x and handle %#x, want 0xFFFFFFFF", c.Registers[2], c.Registers[15])
+	}
+	if c.Registers[ER] != ENOSPC {
+		t.Errorf("ER = %s, want ENOSPC", ErrorNames[c.Registers[ER]])
+	}
+
+	// The failed program does not use up a handle
+	c.MemoryManager.FreeFrames = frames
+	p := c.MemoryManager.NewProgram()
+	c.MemoryManager.AddSector(p, 0, []byte{0}, true)
+	if _, err := c.MemoryManager.LoadProgram(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Handle != 1 {
+		t.Errorf("next program got handle %d, want 1", p.Handle)
+	}
+
+	c.MemoryManager.FreeFrames = nil
+	p = c.MemoryManager.NewProgram()
+	c.MemoryManager.AddSector(p, 0, []byte{0}, true)
+	if _, err := c.MemoryManager.LoadProgram(p); !errors.Is(err, ErrOutOfMemory) {
+		t.Errorf("loading without free frames: got %v, want %v", err, ErrOutOfMemory)
+	}
+	if len(c.MemoryManager.Programs) != 2 {
+		t.Errorf("%d programs after a failed load, want 2", len(c.MemoryManager.Programs))
+	}
+}
+
+func TestSetStackSize(t *testing.T) {
+	tests := []struct {
+		size uint32
+		want uint32
+		err  bool
+	}{
+		{size: 1, want: PageSize},
+		{size: PageSize, want: PageSize},
+		{size: PageSize + 1, want: 2 * PageSize},
+		{size: DefaultStackSize, want: DefaultStackSize},
+		{size: MaxStackSize, want: MaxStackSize},
+		{size: 0, err: true},
+		{size: MaxStackSize + 1, err: true},
+		{size: 0xFFFFF001, err: true},
+		{size: 0xFFFFFFFF, err: true},
+	}
+	for _, tt := range tests {
+		mm := NewCPU().MemoryManager
+		err := mm.SetStackSize(tt.size)
+		if tt.err {
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("SetStackSize(%#x): got %v, want %v", tt.size, err, ErrInvalid)
+			}
+			if mm.StackSize != DefaultStackSize {
+				t.Errorf("SetStackSize(%#x) changed the size to %#x", tt.size, mm.StackSize)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SetStackSize(%#x): %v", tt.size, err)
+		} else if mm.StackSize != tt.want {
+			t.Errorf("SetStackSize(%#x) set %#x, want %#x", tt.size, mm.StackSize, tt.want)
+		} else if limit := mm.StackLimit(); limit >= mm.VirtualStackEnd || limit < mm.VirtualHeapStart+PageSize {
+			t.Errorf("SetStackSize(%#x): stack limit %#x is outside of RAM", tt.size, limit)
+		}
+	}
+
+	// The size in the bytecode header is checked when loading the program
+	bc := assemble(t, ".TEXT\n    HLT\n")
+	bc.StackSize = 0xFFFFFFFF
+	if err := NewCPU().LoadProgram(bc); !errors.Is(err, ErrInvalid) {
+		t.Errorf("loading a program with stack size %#x: got %v, want %v", bc.StackSize, err, ErrInvalid)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Allocation is a block of heap memory handed out by MALLOC that has not been
+// freed yet.
+type Allocation struct {
+	Address uint32
+	Size    uint32
+	PC      uint32
+}
+
+type MemoryStats struct {
+	CodePages       int
+	HeapPages       int
+	StackPages      int
+	MappedPages     int
+	TotalPages      int
+	PeakPages       int
+	FreeFrames      int
+	LiveAllocations int
+	LiveBytes       uint32
+}
+
+func (mm *MemoryManager) Stats() MemoryStats {
+	stats := MemoryStats{
+		TotalPages:      len(mm.PageTable),
+		PeakPages:       mm.PeakPages,
+		FreeFrames:      len(mm.FreeFrames),
+		LiveAllocations: len(mm.Allocations),
+	}
+
+	for _, allocation := range mm.Allocations {
+		stats.LiveBytes += allocation.Size
+	}
+
+	stackFloor := mm.cpu.Scheduler.StackFloor()
+	for pageNum := range mm.PageTable {
+		addr := pageNum * PageSize
+		switch {
+		case addr+PageSize > stackFloor:
+			stats.StackPages++
+		case mm.MappingAt(addr) != nil:
+			stats.MappedPages++
+		case mm.programAt(addr) != nil:
+			stats.CodePages++
+		default:
+			stats.HeapPages++
+		}
+	}
+
+	return stats
+}
+
+func (mm *MemoryManager) programAt(addr uint32) *ProgramInfo {
+	for _, program := range mm.Programs {
+		if program == nil || program.Size == 0 {
+			continue
+		}
+		if addr+PageSize > program.BaseAddress && addr < program.BaseAddress+program.Size {
+			return program
+		}
+	}
+	return nil
+}
+
+// allocationAt returns a live allocation overlapping the page at addr.
+func (mm *MemoryManager) allocationAt(addr uint32) *Allocation {
+	for _, allocation := range mm.Allocations {
+		if addr+PageSize > allocation.Address && addr < allocation.Address+allocation.Size {
+			return allocation
+		}
+	}
+	return nil
+}
+
+func (s MemoryStats) String() string {
+	return fmt.Sprintf("Code:   %d pages\nHeap:   %d pages\nStack:  %d pages\nMapped: %d pages\nTotal:  %d pages\nPeak:   %d pages\nAllocs: %d (%d B)",
+		s.CodePages, s.HeapPages, s.StackPages, s.MappedPages, s.TotalPages, s.PeakPages, s.LiveAllocations, s.LiveBytes)
+}
+
+// LeakReport lists every heap block that was allocated but never freed, or
+// returns an empty string if there are none.
+func (mm *MemoryManager) LeakReport() string {
+	if len(mm.Allocations) == 0 {
+		return ""
+	}
+
+	allocations := make([]*Allocation, 0, len(mm.Allocations))
+	for _, allocation := range mm.Allocations {
+		allocations = append(allocations, allocation)
+	}
+	sort.Slice(allocations, func(i, j int) bool {
+		return allocations[i].Address < allocations[j].Address
+	})
+
+	report := fmt.Sprintf("%d heap block(s) never freed:\n", len(allocations))
+	for _, allocation := range allocations {
+		report += fmt.Sprintf("  %08x: %d bytes, allocated at PC %08x\n", allocation.Address, allocation.Size, allocation.PC)
+	}
+	return report
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// MemoryMapping is a region of the address space backed by a file or by a
+// shared memory object. Pages of files are only read once they are first
+// accessed, and pages that were written to are written back when the mapping
+// is removed.
+type MemoryMapping struct {
+	Start  uint32
+	Length uint32
+	FS     VFS
+	File   interface{}
+	Shared *SharedMemory
+	Dirty  map[uint32]bool
+}
+
+func (m *MemoryMapping) Contains(addr uint32) bool {
+	return addr >= m.Start && addr-m.Start < m.Length
+}
+
+func (mm *MemoryManager) MappingAt(addr uint32) *MemoryMapping {
+	for _, mapping := range mm.Mappings {
+		if mapping.Contains(addr) {
+			return mapping
+		}
+	}
+	return nil
+}
+
+// reserve sets aside a page aligned region at the top of the heap without
+// mapping any pages into it.
+func (mm *MemoryManager) reserve(length uint32) (uint32, error) {
+	pages := (length + PageSize - 1) / PageSize
+	startAddr := (mm.cpu.Registers[18] + PageSize - 1) &^ (PageSize - 1)
+	endAddr := startAddr + pages*PageSize
+
+	if endAddr < startAddr || endAddr > mm.cpu.Scheduler.StackFloor() {
+		return 0, fmt.Errorf("cannot reserve memory: collision with stack: %w", ErrOutOfMemory)
+	}
+
+	mm.cpu.Registers[18] = endAddr
+	return startAddr, nil
+}
+
+// MapFile maps the first length bytes of file into the address space and
+// returns the address of the mapping.
+func (mm *MemoryManager) MapFile(fs VFS, file interface{}, length uint32) (uint32, error) {
+	if length == 0 {
+		return 0, fmt.Errorf("cannot map zero bytes: %w", ErrInvalid)
+	}
+
+	startAddr, err := mm.reserve(length)
+	if err != nil {
+		return 0, err
+	}
+
+	mm.Mappings = append(mm.Mappings, &MemoryMapping{
+		Start:  startAddr,
+		Length: length,
+		FS:     fs,
+		File:   file,
+		Dirty:  make(map[uint32]bool),
+	})
+
+	return startAddr, nil
+}
+
+func (mm *MemoryManager) pageIn(mapping *MemoryMapping, pageNum uint32) (uint32, error) {
+	frame, err := mm.AllocateFrame()
+	if err != nil {
+		return 0, err
+	}
+
+	data := make([]byte, PageSize)
+	offset := pageNum*PageSize - mapping.Start
+	if remaining := mapping.Length - offset; remaining < PageSize {
+		data = data[:remaining]
+	}
+	n, err := mapping.FS.ReadAt(mapping.File, data, int64(offset))
+	if err != nil && err != io.EOF {
+		mm.FreeFrame(frame)
+		return 0, err
+	}
+
+	page := make([]byte, PageSize)
+	copy(page, data[:n])
+	for i, b := range page {
+		mm.Memory.Write(frame*PageSize+uint32(i), b)
+	}
+
+	mm.mapPage(pageNum, frame)
+	return frame, nil
+}
+
+func (mm *MemoryManager) writeBack(mapping *MemoryMapping) error {
+	if mapping.FS == nil {
+		return nil
+	}
+	for pageNum := range mapping.Dirty {
+		frame, exists := mm.PageTable[pageNum]
+		if !exists {
+			continue
+		}
+
+		offset := pageNum*PageSize - mapping.Start
+		length := uint32(PageSize)
+		if remaining := mapping.Length - offset; remaining < length {
+			length = remaining
+		}
+
+		data := mm.Memory.ReadN(frame*PageSize, length)
+		if _, err := mapping.FS.WriteAt(mapping.File, data, int64(offset)); err != nil {
+			return err
+		}
+		delete(mapping.Dirty, pageNum)
+	}
+	return nil
+}
+
+// Unmap writes back and removes the mapping starting at addr.
+func (mm *MemoryManager) Unmap(addr uint32) error {
+	for i, mapping := range mm.Mappings {
+		if mapping.Start != addr {
+			continue
+		}
+
+		err := mm.writeBack(mapping)
+
+		mm.Mappings = append(mm.Mappings[:i], mm.Mappings[i+1:]...)
+		for pageAddr := mapping.Start; mapping.Contains(pageAddr); pageAddr += PageSize {
+			mm.UnmapPage(pageAddr)
+		}
+		mm.reclaimHeap()
+
+		return err
+	}
+	return fmt.Errorf("no mapping at address: %w", ErrInvalid)
+}
+
+// UnmapFile removes every mapping of file, like when it is closed.
+func (mm *MemoryManager) UnmapFile(file interface{}) error {
+	var firstErr error
+	for _, mapping := range append([]*MemoryMapping{}, mm.Mappings...) {
+		if mapping.FS == nil || mapping.File != file {
+			continue
+		}
+		if err := mm.Unmap(mapping.Start); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MountVFS routes every path to the VFS mounted at the longest matching
+// prefix. The path is passed on relative to the mount point, so a file opened
+// as /tmp/a.txt is /a.txt to the VFS mounted at /tmp. Allowed lists the specs
+// the guest may mount besides "memory".
+type MountVFS struct {
+	mu      sync.Mutex
+	Mounts  []*Mount
+	Allowed []string
+}
+
+type Mount struct {
+	Path      string
+	FS        VFS
+	Spec      string
+	Guest     bool
+	openFiles int
+}
+
+type mountFile struct {
+	Name  string
+	File  interface{}
+	mount *Mount
+}
+
+func (f *mountFile) FileName() string {
+	return f.Name
+}
+
+func NewMountVFS(root VFS) *MountVFS {
+	return &MountVFS{Mounts: []*Mount{{Path: "/", FS: root}}}
+}
+
+// FindMountVFS returns the MountVFS of vfs, looking through wrappers like
+// TracingVFS.
+func FindMountVFS(vfs VFS) (*MountVFS, bool) {
+	for {
+		switch v := vfs.(type) {
+		case *MountVFS:
+			return v, true
+		case interface{ Unwrap() VFS }:
+			vfs = v.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Clone returns a MountVFS with its own copy of the mount table. The mounted
+// filesystems themselves are shared, and files opened through vfs are not
+// counted as open in the clone.
+func (vfs *MountVFS) Clone() *MountVFS {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	c := &MountVFS{Allowed: append([]string{}, vfs.Allowed...)}
+	for _, m := range vfs.Mounts {
+		c.Mounts = append(c.Mounts, &Mount{Path: m.Path, FS: m.FS, Spec: m.Spec, Guest: m.Guest})
+	}
+	return c
+}
+
+// Mount attaches a VFS at the given path, which must not be in use yet.
+func (vfs *MountVFS) Mount(name string, fs VFS) error {
+	return vfs.add(&Mount{Path: name, FS: fs})
+}
+
+func (vfs *MountVFS) add(mount *Mount) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	mount.Path = cleanPath(mount.Path)
+	for _, m := range vfs.Mounts {
+		if m.Path == mount.Path {
+			return fmt.Errorf("path is already a mount point: %w", ErrBusy)
+		}
+	}
+	vfs.Mounts = append(vfs.Mounts, mount)
+	return nil
+}
+
+// MountHost mounts the VFS described by spec as configured by the host, and
+// allows the guest to mount it again after unmounting it.
+func (vfs *MountVFS) MountHost(name string, spec string) error {
+	mfs, err := NewVFSFromSpec(spec, "")
+	if err != nil {
+		return err
+	}
+	if err := vfs.add(&Mount{Path: name, FS: mfs, Spec: spec}); err != nil {
+		return err
+	}
+	vfs.Allowed = append(vfs.Allowed, spec)
+	return nil
+}
+
+// MountSpec mounts the VFS described by spec on behalf of the guest. Since the
+// spec comes from guest memory, only an empty in-memory VFS or a spec from
+// Allowed that is not mounted already can be used, so the guest cannot reach
+// any host files the host did not give it.
+func (vfs *MountVFS) MountSpec(name string, spec string) error {
+	var mfs VFS
+	if spec == "memory" {
+		mfs = NewMemoryVFS()
+	} else {
+		if !vfs.mayMount(spec) {
+			return fmt.Errorf("cannot mount %q: %w", spec, fs.ErrPermission)
+		}
+		var err error
+		if mfs, err = NewVFSFromSpec(spec, ""); err != nil {
+			return err
+		}
+	}
+	return vfs.add(&Mount{Path: name, FS: mfs, Spec: spec, Guest: true})
+}
+
+// mayMount reports whether spec is allowed and not mounted anywhere, since two
+// drivers working on the same image would corrupt it.
+func (vfs *MountVFS) mayMount(spec string) bool {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	for _, m := range vfs.Mounts {
+		if m.Spec == spec {
+			return false
+		}
+	}
+	for _, allowed := range vfs.Allowed {
+		if allowed == spec {
+			return true
+		}
+	}
+	return false
+}
+
+// Unmount detaches the VFS mounted at the given path. The root cannot be
+// unmounted, and neither can a VFS that still has open files.
+func (vfs *MountVFS) Unmount(name string) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	name = cleanPath(name)
+	if name == "/" {
+		return fmt.Errorf("cannot unmount the root filesystem: %w", ErrBusy)
+	}
+	for i, m := range vfs.Mounts {
+		if m.Path == name {
+			if m.openFiles > 0 {
+				return ErrBusy
+			}
+			vfs.Mounts = append(vfs.Mounts[:i], vfs.Mounts[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("not a mount point: %w", ErrInvalid)
+}
+
+// resolve returns the mount responsible for name, along with the path of name
+// inside that mount.
+func (vfs *MountVFS) resolve(name string) (*Mount, string) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	name = cleanPath(name)
+	var best *Mount
+	for _, m := range vfs.Mounts {
+		if m.Path != "/" && name != m.Path && !strings.HasPrefix(name, m.Path+"/") {
+			continue
+		}
+		if best == nil || len(m.Path) > len(best.Path) {
+			best = m
+		}
+	}
+	if best == nil {
+		return nil, name
+	}
+	if best.Path == "/" {
+		return best, name
+	}
+	return best, cleanPath(strings.TrimPrefix(name, best.Path))
+}
+
+func (vfs *MountVFS) Open(name string) (interface{}, error) {
+	m, p := vfs.resolve(name)
+	if m == nil {
+		return nil, fs.ErrNotExist
+	}
+	file, err := m.FS.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	vfs.mu.Lock()
+	m.openFiles++
+	vfs.mu.Unlock()
+	return &mountFile{Name: cleanPath(name), File: file, mount: m}, nil
+}
+
+func (vfs *MountVFS) Close(file interface{}) error {
+	f := file.(*mountFile)
+	vfs.mu.Lock()
+	f.mount.openFiles--
+	vfs.mu.Unlock()
+	return f.mount.FS.Close(f.File)
+}
+
+func (vfs *MountVFS) Create(name string) (interface{}, error) {
+	m, p := vfs.resolve(name)
+	if m == nil {
+		return nil, fs.ErrNotExist
+	}
+	file, err := m.FS.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	vfs.mu.Lock()
+	m.openFiles++
+	vfs.mu.Unlock()
+	return &mountFile{Name: cleanPath(name), File: file, mount: m}, nil
+}
+
+func (vfs *MountVFS) Remove(name string) error {
+	m, p := vfs.resolve(name)
+	if m == nil {
+		return fs.ErrNotExist
+	}
+	if p == "/" {
+		return fmt.Errorf("cannot remove a mount point: %w", ErrBusy)
+	}
+	return m.FS.Remove(p)
+}
+
+func (vfs *MountVFS) Stat(name string) (*FileInfo, error) {
+	m, p := vfs.resolve(name)
+	if m == nil {
+		return nil, fs.ErrNotExist
+	}
+	if p == "/" && m.Path != "/" {
+		return &FileInfo{Name: cleanPath(name), Mode: os.ModeDir | 0755}, nil
+	}
+	return m.FS.Stat(p)
+}
+
+// ReadDir lists a folder of the responsible VFS. Mount points directly inside
+// the folder are listed as folders, even if the folder does not contain them.
+func (vfs *MountVFS) ReadDir(name string) ([]*FileInfo, error) {
+	name = cleanPath(name)
+	m, p := vfs.resolve(name)
+	if m == nil {
+		return nil, fs.ErrNotExist
+	}
+	fileInfos, err := m.FS.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	for _, other := range vfs.Mounts {
+		if other.Path == "/" || path.Dir(other.Path) != name {
+			continue
+		}
+		base := path.Base(other.Path)
+		found := false
+		for _, info := range fileInfos {
+			if info.Name == base {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fileInfos = append(fileInfos, &FileInfo{Name: base, Mode: os.ModeDir | 0755})
+		}
+	}
+	sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name < fileInfos[j].Name })
+	return fileInfos, nil
+}
+
+func (vfs *MountVFS) Mkdir(name string) error {
+	m, p := vfs.resolve(name)
+	if m == nil {
+		return fs.ErrNotExist
+	}
+	return m.FS.Mkdir(p)
+}
+
+// Rename moves a file within a single mounted VFS, moving files between two
+// mounts is not supported.
+func (vfs *MountVFS) Rename(oldName string, newName string) error {
+	oldMount, oldPath := vfs.resolve(oldName)
+	newMount, newPath := vfs.resolve(newName)
+	if oldMount == nil || newMount == nil {
+		return fs.ErrNotExist
+	}
+	if oldMount != newMount {
+		return ErrCrossDevice
+	}
+	if oldPath == "/" {
+		return fmt.Errorf("cannot rename a mount point: %w", ErrBusy)
+	}
+	return oldMount.FS.Rename(oldPath, newPath)
+}
+
+func (vfs *MountVFS) Read(file interface{}, b []byte) (int, error) {
+	f := file.(*mountFile)
+	return f.mount.FS.Read(f.File, b)
+}
+
+func (vfs *MountVFS) Write(file interface{}, b []byte) (int, error) {
+	f := file.(*mountFile)
+	return f.mount.FS.Write(f.File, b)
+}
+
+func (vfs *MountVFS) ReadAt(file interface{}, b []byte, off int64) (int, error) {
+	f := file.(*mountFile)
+	return f.mount.FS.ReadAt(f.File, b, off)
+}
+
+func (vfs *MountVFS) WriteAt(file interface{}, b []byte, off int64) (int, error) {
+	f := file.(*mountFile)
+	return f.mount.FS.WriteAt(f.File, b, off)
+}
+
+func (vfs *MountVFS) Seek(file interface{}, off int64, whence int) (int64, error) {
+	f := file.(*mountFile)
+	return f.mount.FS.Seek(f.File, off, whence)
+}
+
+func (vfs *MountVFS) LoadBinary(file interface{}, mm *MemoryManager) (*ProgramInfo, error) {
+	f := file.(*mountFile)
+	return f.mount.FS.LoadBinary(f.File, mm)
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// WhiteoutPrefix marks files in the upper layer of an OverlayVFS that hide a
+// removed file of the lower layer. A folder containing OpaqueMarker hides the
+// contents of the lower folder with the same name, which is how a folder that
+// was removed and created again starts out empty.
+const (
+	WhiteoutPrefix = ".wh."
+	OpaqueMarker   = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// OverlayVFS combines a read-only lower VFS with a writable upper VFS. Files
+// are copied to the upper layer the first time they are written to, and files
+// removed from the lower layer are hidden by whiteout files in the upper layer,
+// so the lower layer is never modified.
+type OverlayVFS struct {
+	Lower VFS
+	Upper VFS
+}
+
+// overlayFile is a file opened from either layer. Its lock is held while it
+// is used, since the first write moves it to the upper layer.
+type overlayFile struct {
+	Name  string
+	File  interface{}
+	Upper bool
+
+	mu sync.Mutex
+}
+
+func (f *overlayFile) FileName() string {
+	return f.Name
+}
+
+func (f *overlayFile) layer(vfs *OverlayVFS) VFS {
+	if f.Upper {
+		return vfs.Upper
+	}
+	return vfs.Lower
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func whiteoutPath(name string) string {
+	dir, base := splitPath(name)
+	return path.Join(dir, WhiteoutPrefix+base)
+}
+
+// checkName cleans name and rejects names that would be mistaken for
+// whiteouts.
+func checkName(name string) (string, error) {
+	name = cleanPath(name)
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, WhiteoutPrefix) {
+			return "", fmt.Errorf("%s: reserved file name: %w", name, ErrInvalid)
+		}
+	}
+	return name, nil
+}
+
+// whitedOut reports whether name or any of its parent folders was removed
+// from the lower layer, or whether one of its parent folders is opaque.
+func (vfs *OverlayVFS) whitedOut(name string) bool {
+	name = cleanPath(name)
+	for p := name; p != "/"; p = path.Dir(p) {
+		if _, err := vfs.Upper.Stat(whiteoutPath(p)); err == nil {
+			return true
+		}
+		if p != name && vfs.opaque(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (vfs *OverlayVFS) opaque(name string) bool {
+	_, err := vfs.Upper.Stat(path.Join(name, OpaqueMarker))
+	return err == nil
+}
+
+func (vfs *OverlayVFS) inLower(name string) bool {
+	if vfs.whitedOut(name) {
+		return false
+	}
+	_, err := vfs.Lower.Stat(name)
+	return err == nil
+}
+
+// makeParents creates the parent folders of name in the upper layer.
+func (vfs *OverlayVFS) makeParents(name string) error {
+	return vfs.Upper.Mkdir(path.Dir(cleanPath(name)))
+}
+
+func (vfs *OverlayVFS) Open(name string) (interface{}, error) {
+	name, err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	if file, err := vfs.Upper.Open(name); err == nil {
+		return &overlayFile{Name: name, File: file, Upper: true}, nil
+	}
+	if vfs.whitedOut(name) {
+		return nil, fs.ErrNotExist
+	}
+	file, err := vfs.Lower.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &overlayFile{Name: name, File: file}, nil
+}
+
+func (vfs *OverlayVFS) Close(file interface{}) error {
+	f := file.(*overlayFile)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.layer(vfs).Close(f.File)
+}
+
+func (vfs *OverlayVFS) Create(name string) (interface{}, error) {
+	name, err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := vfs.makeParents(name); err != nil {
+		return nil, err
+	}
+	vfs.Upper.Remove(whiteoutPath(name))
+	file, err := vfs.Upper.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &overlayFile{Name: name, File: file, Upper: true}, nil
+}
+
+func (vfs *OverlayVFS) Remove(name string) error {
+	name, err := checkName(name)
+	if err != nil {
+		return err
+	}
+	_, upperErr := vfs.Upper.Stat(name)
+	lower := vfs.inLower(name)
+	if upperErr != nil && !lower {
+		return fs.ErrNotExist
+	}
+	if info, err := vfs.Stat(name); err == nil && info.Mode.IsDir() {
+		if err := vfs.clearWhiteouts(name); err != nil {
+			return err
+		}
+	}
+	if upperErr == nil {
+		if err := vfs.Upper.Remove(name); err != nil {
+			return err
+		}
+	}
+	if lower {
+		if err := vfs.makeParents(name); err != nil {
+			return err
+		}
+		file, err := vfs.Upper.Create(whiteoutPath(name))
+		if err != nil {
+			return err
+		}
+		vfs.Upper.Close(file)
+	}
+	return nil
+}
+
+// clearWhiteouts removes the whiteout files from a folder that is about to be
+// removed. The folder has to look empty.
+func (vfs *OverlayVFS) clearWhiteouts(name string) error {
+	entries, err := vfs.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrNotEmpty
+	}
+	upper, _ := vfs.Upper.ReadDir(name)
+	for _, info := range upper {
+		if err := vfs.Upper.Remove(path.Join(name, info.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename moves a file to the upper layer under its new name and hides the old
+// name. Folders can only be renamed while they exist in the upper layer only.
+func (vfs *OverlayVFS) Rename(oldName string, newName string) error {
+	newName, err := checkName(newName)
+	if err != nil {
+		return err
+	}
+	oldName = cleanPath(oldName)
+	info, err := vfs.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	if err := vfs.makeParents(newName); err != nil {
+		return err
+	}
+	vfs.Upper.Remove(whiteoutPath(newName))
+
+	if _, err := vfs.Upper.Stat(oldName); err == nil && !vfs.inLower(oldName) {
+		return vfs.Upper.Rename(oldName, newName)
+	}
+	if info.Mode.IsDir() {
+		return fmt.Errorf("cannot rename a directory of the lower filesystem: %w", ErrNotSupported)
+	}
+
+	file, err := vfs.Open(oldName)
+	if err != nil {
+		return err
+	}
+	f := file.(*overlayFile)
+	if err := vfs.copyUp(f); err != nil {
+		vfs.Close(f)
+		return err
+	}
+	vfs.Close(f)
+	if err := vfs.Upper.Rename(oldName, newName); err != nil {
+		return err
+	}
+	// The old name only needs to be hidden if the lower layer still has it
+	if vfs.inLower(oldName) {
+		marker, err := vfs.Upper.Create(whiteoutPath(oldName))
+		if err != nil {
+			return err
+		}
+		vfs.Upper.Close(marker)
+	}
+	return nil
+}
+
+// Mkdir creates a folder in the upper layer. A folder created in place of a
+// removed lower folder is made opaque, so the removed contents stay hidden.
+func (vfs *OverlayVFS) Mkdir(name string) error {
+	name, err := checkName(name)
+	if err != nil {
+		return err
+	}
+	if err := vfs.makeParents(name); err != nil {
+		return err
+	}
+	_, err = vfs.Upper.Stat(whiteoutPath(name))
+	replacesRemoved := err == nil
+	if err := vfs.Upper.Mkdir(name); err != nil {
+		return err
+	}
+	if replacesRemoved {
+		marker, err := vfs.Upper.Create(path.Join(name, OpaqueMarker))
+		if err != nil {
+			return err
+		}
+		vfs.Upper.Close(marker)
+		return vfs.Upper.Remove(whiteoutPath(name))
+	}
+	return nil
+}
+
+func (vfs *OverlayVFS) Stat(name string) (*FileInfo, error) {
+	name, err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := vfs.Upper.Stat(name); err == nil {
+		return info, nil
+	}
+	if vfs.whitedOut(name) {
+		return nil, fs.ErrNotExist
+	}
+	return vfs.Lower.Stat(name)
+}
+
+// ReadDir merges the folder from both layers. Files in the upper layer take
+// precedence, and whiteout files hide their lower counterparts.
+func (vfs *OverlayVFS) ReadDir(name string) ([]*FileInfo, error) {
+	name, err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	upper, upperErr := vfs.Upper.ReadDir(name)
+	var lower []*FileInfo
+	lowerErr := fs.ErrNotExist
+	if !vfs.whitedOut(name) && !vfs.opaque(name) {
+		lower, lowerErr = vfs.Lower.ReadDir(name)
+	}
+	if upperErr != nil && lowerErr != nil {
+		return nil, upperErr
+	}
+
+	entries := make(map[string]*FileInfo)
+	hidden := make(map[string]bool)
+	for _, info := range upper {
+		if strings.HasPrefix(info.Name, WhiteoutPrefix) {
+			hidden[strings.TrimPrefix(info.Name, WhiteoutPrefix)] = true
+			continue
+		}
+		entries[info.Name] = info
+	}
+	for _, info := range lower {
+		if _, ok := entries[info.Name]; !ok && !hidden[info.Name] {
+			entries[info.Name] = info
+		}
+	}
+
+	fileInfos := make([]*FileInfo, 0, len(entries))
+	for _, info := range entries {
+		fileInfos = append(fileInfos, info)
+	}
+	sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name < fileInfos[j].Name })
+	return fileInfos, nil
+}
+
+// switchToUpper moves a file that was opened from the lower layer over to the
+// upper layer once a copy of it exists there, like after another descriptor
+// of the same file was written to. The offset is kept.
+func (vfs *OverlayVFS) switchToUpper(f *overlayFile) error {
+	if f.Upper {
+		return nil
+	}
+	if _, err := vfs.Upper.Stat(f.Name); err != nil {
+		return nil
+	}
+	offset, err := vfs.Lower.Seek(f.File, 0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	file, err := vfs.Upper.Open(f.Name)
+	if err != nil {
+		return err
+	}
+	if _, err := vfs.Upper.Seek(file, offset, io.SeekStart); err != nil {
+		vfs.Upper.Close(file)
+		return err
+	}
+	vfs.Lower.Close(f.File)
+	f.File = file
+	f.Upper = true
+	return nil
+}
+
+// copyUp copies a file that is still in the lower layer to the upper layer,
+// keeping its offset, so it can be written to. If the file was already copied
+// through another descriptor, that copy is used instead.
+func (vfs *OverlayVFS) copyUp(f *overlayFile) error {
+	if err := vfs.switchToUpper(f); err != nil || f.Upper {
+		return err
+	}
+	offset, err := vfs.Lower.Seek(f.File, 0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	info, err := vfs.Lower.Stat(f.Name)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, info.Size)
+	if _, err := vfs.Lower.ReadAt(f.File, data, 0); err != nil && err != io.EOF {
+		return err
+	}
+
+	if err := vfs.makeParents(f.Name); err != nil {
+		return err
+	}
+	file, err := vfs.Upper.Create(f.Name)
+	if err != nil {
+		return err
+	}
+	if _, err := vfs.Upper.WriteAt(file, data, 0); err != nil {
+		vfs.Upper.Close(file)
+		return err
+	}
+	if _, err := vfs.Upper.Seek(file, offset, io.SeekStart); err != nil {
+		vfs.Upper.Close(file)
+		return err
+	}
+
+	vfs.Lower.Close(f.File)
+	f.File = file
+	f.Upper = true
+	return nil
+}
+
+func (vfs *OverlayVFS) Read(file interface{}, b []byte) (int, error) {
+	f := file.(*overlayFile)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := vfs.switchToUpper(f); err != nil {
+		return 0, err
+	}
+	return f.layer(vfs).Read(f.File, b)
+}
+
+func (vfs *OverlayVFS) Write(file interface{}, b []byte) (int, error) {
+	f := file.(*overlayFile)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := vfs.copyUp(f); err != nil {
+		return 0, err
+	}
+	return vfs.Upper.Write(f.File, b)
+}
+
+func (vfs *OverlayVFS) ReadAt(file interface{}, b []byte, off int64) (int, error) {
+	f := file.(*overlayFile)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := vfs.switchToUpper(f); err != nil {
+		return 0, err
+	}
+	return f.layer(vfs).ReadAt(f.File, b, off)
+}
+
+func (vfs *OverlayVFS) WriteAt(file interface{}, b []byte, off int64) (int, error) {
+	f := file.(*overlayFile)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := vfs.copyUp(f); err != nil {
+		return 0, err
+	}
+	return vfs.Upper.WriteAt(f.File, b, off)
+}
+
+func (vfs *OverlayVFS) Seek(file interface{}, off int64, whence int) (int64, error) {
+	f := file.(*overlayFile)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.layer(vfs).Seek(f.File, off, whence)
+}
+
+func (vfs *OverlayVFS) LoadBinary(file interface{}, mm *MemoryManager) (*ProgramInfo, error) {
+	f := file.(*overlayFile)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.layer(vfs).LoadBinary(f.File, mm)
+}
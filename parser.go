@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"slices"
@@ -13,11 +14,39 @@ type Parser struct {
 	DefaultBaseAddress uint32
 	ExplicitStart      bool
 	StartAddress       uint32
-	Labels             map[string]uint32
-	Sectors            []*Sector
+	// Labels and Constants hold the symbols declared GLOBAL, the symbols of
+	// each file are in its scope
+	Labels  map[string]uint32
+	Sectors []*Sector
+	Scopes  []*Scope
 
 	CurrentSection string
 	CurrentSector  *Sector
+
+	Macros      map[string]*Macro
+	Constants   map[string]*Constant
+	Diagnostics []Diagnostic
+	// Folders searched by INCLUDE and INCBIN, after the folder of the file
+	// using them
+	IncludePaths []string
+
+	// Position of the line being parsed, for diagnostics
+	file   string
+	line   int
+	source string
+	indent int
+
+	defining       *Macro
+	definedAt      position
+	expansions     []expansion
+	expansionCount int
+	evaluating     map[*Constant]bool
+	scope          *Scope
+	globalData     map[string]*Data
+	exportedBy     map[string]string
+	// Whether data addresses are known, which they are not until the end
+	// of the file
+	dataPlaced bool
 }
 
 type Sector struct {
@@ -35,21 +64,18 @@ type Data struct {
 	Name    string
 }
 
-func (p *Parser) DataByName(name string) (*Data, bool) {
-	for _, sector := range p.Sectors {
-		for _, data := range sector.Data {
-			if name == data.Name {
-				return data, true
-			}
-		}
-	}
-	return nil, false
-}
-
 func NewParser() *Parser {
+	scope := newScope("")
 	return &Parser{
+		Scopes:             []*Scope{scope},
+		scope:              scope,
 		DefaultBaseAddress: 0,
 		Labels:             make(map[string]uint32),
+		Macros:             make(map[string]*Macro),
+		Constants:          make(map[string]*Constant),
+		evaluating:         make(map[*Constant]bool),
+		globalData:         make(map[string]*Data),
+		exportedBy:         make(map[string]string),
 		Sectors:            []*Sector{},
 	}
 }
@@ -62,19 +88,25 @@ func (p *Parser) AddFile(filename string) {
 
 	contents, err := os.ReadFile(filename)
 	if err != nil {
-		panic(err)
+		p.report(position{file: filename}, SeverityError, "%v", err)
+		return
 	}
 
-	sectorsToEncode := []*Sector{p.CurrentSector}
-	lastSector := p.CurrentSector
-	for _, line := range strings.Split(string(contents), "\n") {
-		p.ParseLine(line)
-		if p.CurrentSector != lastSector {
-			lastSector = p.CurrentSector
-			sectorsToEncode = append(sectorsToEncode, lastSector)
-		}
+	firstSector := p.CurrentSector
+	sectorCount := len(p.Sectors)
+	p.scope = newScope(filename)
+	p.Scopes = append(p.Scopes, p.scope)
+	p.dataPlaced = false
+	defer func() { p.dataPlaced = true }()
+	if !p.markIncluded(filename) {
+		p.parseLines(filename, contents)
+		p.checkMacros()
+		p.exportGlobals()
 	}
 
+	// Macros can add more than one sector on a single line
+	sectorsToEncode := append([]*Sector{firstSector}, p.Sectors[sectorCount:]...)
+
 	for _, sector := range sectorsToEncode {
 		for _, data := range sector.Data {
 			data.Address = sector.BaseAddress + uint32(len(sector.Program))
@@ -123,6 +155,7 @@ func (p *Parser) CheckForOverlappingSectors() error {
 }
 
 func (p *Parser) Parse() {
+	p.checkExterns()
 	for _, sector := range p.Sectors {
 		for _, postParse := range sector.PostParse {
 			postParse()
@@ -139,7 +172,11 @@ func (p *Parser) Parse() {
 	}
 }
 
+// ParseLine parses a single line. Problems are added to Diagnostics, at the
+// position set by AddFile.
 func (p *Parser) ParseLine(line string) {
+	p.source = line
+	p.indent = len(line) - len(strings.TrimLeft(line, " \t"))
 	line = strings.TrimSpace(line)
 	if len(line) == 0 {
 		return
@@ -147,27 +184,72 @@ func (p *Parser) ParseLine(line string) {
 	if line[0] == ';' {
 		return
 	}
-	if line[0] == '.' {
-		p.ParseSection(line)
+	if p.parseMacroLine(line) {
+		return
+	}
+	if p.parseConstant(line) {
 		return
 	}
 	if line[len(line)-1] == ':' {
 		p.ParseLabel(line)
 		return
 	}
+	if line[0] == '.' {
+		p.ParseSection(line)
+		return
+	}
+	if fields := splitArgs(line); len(fields) > 0 {
+		if fields[0].text == "INCLUDE" {
+			p.parseInclude(fields)
+			return
+		}
+		if fields[0].text == "GLOBAL" || fields[0].text == "EXTERN" {
+			p.parseDeclaration(fields)
+			return
+		}
+		if m, ok := p.Macros[fields[0].text]; ok {
+			p.expandMacro(m, fields[1:], p.col(0))
+			return
+		}
+	}
 	p.ParseInstruction(line)
 }
 
+// col returns the column of an offset in the trimmed line being parsed.
+func (p *Parser) col(offset int) int {
+	return p.indent + offset + 1
+}
+
 func (p *Parser) ParseSection(line string) {
 	p.CurrentSection = line[1:]
+	switch p.CurrentSection {
+	case "data", "DATA", "text", "TEXT":
+	default:
+		p.errorf(p.col(0), "unknown section %s", line)
+	}
 }
 
+// ParseLabel defines a label in the scope of the current file. Labels
+// starting with a dot are local to the label before them, except for labels
+// inside macros, which do not start a new scope.
 func (p *Parser) ParseLabel(line string) {
 	label := line[:len(line)-1]
-	p.Labels[label] = p.CurrentSector.BaseAddress + uint32(len(p.CurrentSector.Program))
+	if !isSymbol(strings.TrimPrefix(label, ".")) {
+		p.errorf(p.col(0), "invalid label name %q", label)
+		return
+	}
+	if !strings.HasPrefix(label, ".") && !p.inMacro() {
+		p.scope.lastGlobal = label
+	}
+	label = p.qualify(label)
+	if !p.define(label, p.col(0)) {
+		return
+	}
+	p.scope.Labels[label] = p.CurrentSector.BaseAddress + uint32(len(p.CurrentSector.Program))
 	if label == "_start" {
 		if p.ExplicitStart {
-			panic("Multiple _start labels found")
+			p.errorf(p.col(0), "multiple _start labels found")
+			return
 		}
 		p.ExplicitStart = true
 		p.StartAddress = p.CurrentSector.BaseAddress + uint32(len(p.CurrentSector.Program))
@@ -175,142 +257,128 @@ func (p *Parser) ParseLabel(line string) {
 }
 
 func (p *Parser) ParseData(line string) {
+	first := len(p.CurrentSector.Data)
+	if fields := splitArgs(line); len(fields) == 2 && fields[0].text == "INCBIN" {
+		p.parseIncbin("", fields[1])
+		return
+	} else if len(fields) == 3 && fields[1].text == "INCBIN" {
+		p.parseIncbin(fields[0].text, fields[2])
+		p.defineData(fields[0].text, first)
+		return
+	}
 	parts := strings.Fields(line)
 	if len(parts) < 3 {
-		panic("Invalid data declaration")
+		p.errorf(p.col(0), "invalid data declaration, expected <name> <DB|DW|DD> <values>")
+		return
 	}
 
 	name := parts[0]
 	directive := parts[1] // DB, DW, DD
-	valueStr := strings.Join(parts[2:], " ")
+	directiveOffset := len(name) + strings.Index(line[len(name):], directive)
+	valueOffset := directiveOffset + len(directive)
+	valueStr := line[valueOffset:]
 
 	switch directive {
 	case "DB":
-		p.parseByteData(name, valueStr)
+		p.parseByteData(name, valueStr, valueOffset)
 	case "DW":
-		p.parseWordData(name, valueStr)
+		p.parseWordData(name, valueStr, valueOffset)
 	case "DD":
-		p.parseDwordData(name, valueStr)
+		p.parseDwordData(name, valueStr, valueOffset)
 	default:
-		panic("Unknown data directive: " + directive)
+		p.errorf(p.col(directiveOffset), "unknown data directive %s", directive)
 	}
+	p.defineData(name, first)
 }
 
-func (p *Parser) parseByteData(name, valueStr string) {
-	values := parseMixedValues(valueStr)
-	for _, val := range values {
-		p.CurrentSector.Data = append(p.CurrentSector.Data, &Data{
-			Name:  name,
-			Size:  1,
-			Value: uint32(val),
-		})
+// defineData makes the data added since first available under name.
+func (p *Parser) defineData(name string, first int) {
+	if first == len(p.CurrentSector.Data) {
+		return
 	}
-}
-
-func parseMixedValues(valueStr string) []uint32 {
-	var valueArray []uint32
-	var currentBuffer strings.Builder
-	inString := false
-	escape := false
-
-	for i := 0; i < len(valueStr); i++ {
-		char := valueStr[i]
-
-		if escape {
-			// Handle special escape sequences like \n, \r, \t, etc.
-			switch char {
-			case 'n':
-				currentBuffer.WriteByte('\n')
-			case 'r':
-				currentBuffer.WriteByte('\r')
-			case 't':
-				currentBuffer.WriteByte('\t')
-			case '\\':
-				currentBuffer.WriteByte('\\')
-			default:
-				currentBuffer.WriteByte(char)
-			}
-			escape = false
-		} else if char == '\\' {
-			escape = true
-		} else if char == '"' && !escape {
-			inString = !inString
-			currentBuffer.WriteByte(char)
-		} else if char == ',' && !inString {
-			valueArray = append(valueArray, parseSingleValue(currentBuffer.String())...)
-			currentBuffer.Reset()
-		} else {
-			currentBuffer.WriteByte(char)
-		}
+	name = p.qualify(name)
+	for _, data := range p.CurrentSector.Data[first:] {
+		data.Name = name
 	}
-
-	if currentBuffer.Len() > 0 {
-		valueArray = append(valueArray, parseSingleValue(currentBuffer.String())...)
+	if p.define(name, p.col(0)) {
+		p.scope.data[name] = p.CurrentSector.Data[first]
 	}
+}
 
-	return valueArray
+func (p *Parser) parseByteData(name, valueStr string, offset int) {
+	p.parseDataValues(name, valueStr, offset, 1)
 }
 
-func parseSingleValue(valueStr string) []uint32 {
-	valueStr = strings.TrimSpace(valueStr)
+func (p *Parser) parseWordData(name, valueStr string, offset int) {
+	p.parseDataValues(name, valueStr, offset, 2)
+}
 
-	if isStringLiteral(valueStr) {
-		str := parseStringLiteral(valueStr)
-		var result []uint32
-		for _, char := range str {
-			result = append(result, uint32(char))
-		}
-		return result
-	} else if valueStr != "" {
-		value, err := strconv.ParseUint(valueStr, 0, 32)
-		if err != nil {
-			panic("Invalid value in mixed data: " + valueStr)
-		}
-		return []uint32{uint32(value)}
-	}
-	return nil
+func (p *Parser) parseDwordData(name, valueStr string, offset int) {
+	p.parseDataValues(name, valueStr, offset, 4)
 }
 
-func (p *Parser) parseWordData(name, valueStr string) {
-	values := parseValues(valueStr)
-	for _, val := range values {
-		p.CurrentSector.Data = append(p.CurrentSector.Data, &Data{
-			Name:  name,
-			Size:  2,
-			Value: uint32(val),
+// parseDataValues adds comma separated values of the given size. Bytes can
+// also be given as strings, which add a byte for every character.
+func (p *Parser) parseDataValues(name, valueStr string, offset int, size uint32) {
+	for _, v := range splitOn(valueStr, ",") {
+		col := p.col(offset + v.offset)
+		if size == 1 && isStringLiteral(v.text) {
+			for _, char := range unescapeString(parseStringLiteral(v.text)) {
+				p.CurrentSector.Data = append(p.CurrentSector.Data, &Data{
+					Name:  name,
+					Size:  1,
+					Value: uint32(char),
+				})
+			}
+			continue
+		}
+		data := &Data{Name: name, Size: size}
+		pos := p.pos(col)
+		ok := p.evalLater(v.text, col, func(value uint32) {
+			p.checkDataSize(value, pos, size)
+			data.Value = value
 		})
+		if ok {
+			p.CurrentSector.Data = append(p.CurrentSector.Data, data)
+		}
 	}
 }
 
-func (p *Parser) parseDwordData(name, valueStr string) {
-	values := parseValues(valueStr)
-	for _, val := range values {
-		p.CurrentSector.Data = append(p.CurrentSector.Data, &Data{
-			Name:  name,
-			Size:  4,
-			Value: uint32(val),
-		})
+// checkDataSize warns about values that are cut off to fit into size bytes.
+func (p *Parser) checkDataSize(value uint32, pos position, size uint32) {
+	if size < 4 && value >= 1<<(size*8) {
+		p.report(pos, SeverityWarning, "value 0x%X does not fit in %d byte(s), truncated to 0x%X", value, size, value&(1<<(size*8)-1))
 	}
 }
 
-func parseValues(valueStr string) []uint32 {
-	valueParts := strings.Split(valueStr, ",")
-	var valueArray []uint32
-	for _, v := range valueParts {
-		if strings.TrimSpace(v) == "" {
+// unescapeString replaces the escape sequences in a string literal.
+func unescapeString(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
 			continue
 		}
-		value, err := strconv.ParseUint(strings.TrimSpace(v), 0, 32)
-		if err != nil {
-			panic("Invalid value: " + v)
+		i++
+		// Handle special escape sequences like \n, \r, \t, etc.
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '0':
+			b.WriteByte(0)
+		default:
+			b.WriteByte(s[i])
 		}
-		valueArray = append(valueArray, uint32(value))
 	}
-	return valueArray
+	return b.String()
 }
 
 func isStringLiteral(valueStr string) bool {
-	return strings.HasPrefix(valueStr, "\"") && strings.HasSuffix(valueStr, "\"")
+	return len(valueStr) >= 2 && strings.HasPrefix(valueStr, "\"") && strings.HasSuffix(valueStr, "\"")
 }
 
 func parseStringLiteral(valueStr string) string {
@@ -325,58 +393,125 @@ func EncodeData(value, size uint32) []byte {
 	return data
 }
 
+// field is a word of a line, along with its offset in the line.
+type field struct {
+	text   string
+	offset int
+}
+
+// splitFields splits an instruction into its words, stopping at a comment.
+// Spaces inside brackets, parentheses and quotes do not split, so [R0 + 4]
+// and (end - start) are single operands.
+func splitFields(line string) []field {
+	return splitOn(line, " \t")
+}
+
+// splitOn splits a line at any of the separators, stopping at a comment.
+// Brackets, parentheses and quotes are kept together, and spaces around the
+// fields are removed.
+func splitOn(line string, separators string) []field {
+	var fields []field
+	add := func(start, end int) {
+		text := strings.TrimRight(line[start:end], " \t")
+		trimmed := strings.TrimLeft(text, " \t")
+		if trimmed != "" {
+			fields = append(fields, field{text: trimmed, offset: start + len(text) - len(trimmed)})
+		}
+	}
+	start := 0
+	depth := 0
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case (c == ']' || c == ')') && depth > 0:
+			depth--
+		case depth == 0 && c == ';':
+			add(start, i)
+			return fields
+		case depth == 0 && strings.IndexByte(separators, c) >= 0:
+			add(start, i)
+			start = i + 1
+		}
+	}
+	add(start, len(line))
+	return fields
+}
+
 func (p *Parser) ParseInstruction(line string) {
 	if p.CurrentSection == "data" || p.CurrentSection == "DATA" {
 		p.ParseData(line)
 		return
 	} else if p.CurrentSection != "text" && p.CurrentSection != "TEXT" {
-		panic("Unknown section: " + p.CurrentSection)
-	}
-	parts := strings.Split(line, " ")
-	opcode := parts[0]
-	args := parts[1:]
-	if opcode == "ORG" {
-		value, err := strconv.ParseUint(args[0], 0, 32)
-		if err != nil {
-			panic("Invalid value for ORG: " + args[0])
+		// Unknown sections are reported by ParseSection
+		if p.CurrentSection == "" {
+			p.errorf(p.col(0), "instruction outside of a section")
 		}
-		p.CurrentSector = &Sector{BaseAddress: uint32(value)}
-		p.Sectors = append(p.Sectors, p.CurrentSector)
 		return
 	}
-	instruction := GetInstruction(opcode)
-	if instruction == nil {
-		panic("Unknown instruction: " + opcode)
+	fields := splitFields(line)
+	if len(fields) == 0 {
+		return
 	}
-	for i, arg := range args {
-		arg = strings.TrimSpace(arg)
-		if arg[0] == ';' {
-			args = args[:i]
-		} else if arg == "" {
-			args = args[:i]
-		} else if arg[0] == '[' {
-			for j := i + 1; j < len(args); j++ {
-				if strings.Contains(args[j], "]") {
-					oldArgs := args
-					args = append(args[:i], strings.Join(args[i:j+1], " "))
-					if j+1 < len(oldArgs) {
-						args = append(args, oldArgs[j+1:]...)
-					}
-					break
-				}
-			}
+	opcode := fields[0]
+	args := fields[1:]
+	if opcode.text == "ORG" {
+		if len(args) == 0 {
+			p.errorf(p.col(opcode.offset), "ORG expects an address")
+			return
+		}
+		value, ok := p.evalNow(stripComment(line)[args[0].offset:], p.col(args[0].offset))
+		if !ok {
+			return
 		}
+		p.CurrentSector = &Sector{BaseAddress: uint32(value)}
+		p.Sectors = append(p.Sectors, p.CurrentSector)
+		return
+	}
+	instruction := GetInstruction(opcode.text)
+	if instruction == nil && opcode.text == "INCBIN" {
+		p.errorf(p.col(opcode.offset), "INCBIN can only be used in the DATA section")
+		return
+	} else if instruction == nil {
+		p.errorf(p.col(opcode.offset), "unknown instruction %s", opcode.text)
+		return
 	}
 	if len(args) != len(instruction.Operands) {
-		panic("Invalid number of arguments for " + opcode)
+		col := p.col(opcode.offset)
+		if len(args) > len(instruction.Operands) {
+			col = p.col(args[len(instruction.Operands)].offset)
+		}
+		p.errorf(col, "%s expects %d operand(s), got %d", opcode.text, len(instruction.Operands), len(args))
+		return
 	}
+	ok := true
+	postParse := len(p.CurrentSector.PostParse)
 	for i, arg := range args {
-		p.ParseOperand(arg, &instruction.Operands[i], instruction.Name)
+		if !p.ParseOperand(arg.text, p.col(arg.offset), &instruction.Operands[i], instruction.Name) {
+			ok = false
+		}
+	}
+	if !ok {
+		// Labels of an instruction that is left out are not resolved
+		p.CurrentSector.PostParse = p.CurrentSector.PostParse[:postParse]
+		return
 	}
 	p.CurrentSector.Instructions = append(p.CurrentSector.Instructions, instruction)
 	p.CurrentSector.Program = append(p.CurrentSector.Program, EncodeInstruction(instruction)...)
 }
 
+var errNoSuchRegister = errors.New("there is no register")
+
 func getRegisterID(name string) (byte, error) {
 	if name == "PC" {
 		return 16, nil
@@ -384,204 +519,124 @@ func getRegisterID(name string) (byte, error) {
 		return 17, nil
 	} else if name == "HP" {
 		return 18, nil
+	} else if name == "ER" {
+		return ER, nil
+	}
+	if len(name) < 2 || (name[0] != 'r' && name[0] != 'R') {
+		return 0, fmt.Errorf("%s is not a register", name)
 	}
 	id := strings.TrimSuffix(strings.TrimSuffix(name[1:], "B"), "L")
 	parsedValue, err := strconv.ParseUint(id, 10, 32)
 	if err != nil {
 		return 0, err
 	}
+	if parsedValue >= uint64(len(CPU{}.Registers)) {
+		return 0, fmt.Errorf("%w %s", errNoSuchRegister, name)
+	}
 	return byte(parsedValue), nil
 }
 
-func (p *Parser) ParseOperand(arg string, operand *Operand, opName string) {
+// parseMemory parses what is inside the brackets of a memory operand: a
+// register, a register plus or minus an offset, or an address.
+func (p *Parser) parseMemory(toParse string, col int) (MemType, byte, string, bool) {
+	toParse = strings.TrimSpace(toParse)
+	if toParse == "" {
+		p.errorf(col, "missing address")
+		return 0, 0, "", false
+	}
+	end := 0
+	for end < len(toParse) && isSymbolChar(toParse[end]) {
+		end++
+	}
+	rid, err := getRegisterID(toParse[:end])
+	if errors.Is(err, errNoSuchRegister) {
+		p.errorf(col, "%v", err)
+		return 0, 0, "", false
+	} else if err != nil {
+		return Address, 0, toParse, true
+	}
+	rest := strings.TrimSpace(toParse[end:])
+	switch {
+	case rest == "":
+		return Register, rid, "", true
+	case rest == "+" || rest == "-":
+		p.errorf(col, "expected an offset after %s", rest)
+		return 0, 0, "", false
+	case rest[0] == '+':
+		return Offset, rid, rest[1:], true
+	case rest[0] == '-':
+		// The offset wraps around, which subtracts it from the register
+		return Offset, rid, rest, true
+	}
+	p.errorf(col, "only + or - can follow the register in %s", toParse)
+	return 0, 0, "", false
+}
+
+// ParseOperand parses arg, found at column col, into operand. Expressions
+// are evaluated by Parse, once all files have been added. It returns false
+// if the operand is invalid.
+func (p *Parser) ParseOperand(arg string, col int, operand *Operand, opName string) bool {
 	var detectedType OperandType
 	if arg[0] == '[' {
-		if arg[1] == '[' {
+		indirect := strings.HasPrefix(arg, "[[")
+		closing := "]"
+		if indirect {
+			closing = "]]"
+		}
+		if !strings.HasSuffix(arg, closing) || len(arg) < 2*len(closing) {
+			p.errorf(col, "missing %s in %s", closing, arg)
+			return false
+		}
+		memType, register, expr, ok := p.parseMemory(arg[len(closing):len(arg)-len(closing)], col)
+		if !ok {
+			return false
+		}
+		var addr *uint32
+		if indirect {
 			detectedType = IMem
-			toParse := strings.TrimSuffix(arg[2:], "]]")
-
-			// Check if it's a register offset or just a raw address
-			if strings.Contains(toParse, "+") {
-				parts := strings.Split(toParse, "+")
-				registerName := strings.TrimSpace(parts[0])
-				offsetStr := strings.TrimSpace(parts[1])
-				offset, err := strconv.ParseUint(offsetStr, 0, 32)
-				if err != nil {
-					p.CurrentSector.PostParse = append(p.CurrentSector.PostParse, func() {
-						label := toParse
-						if val, ok := p.Labels[offsetStr]; ok {
-							operand.Value.(*IMemOperand).Addr = val
-						} else if val, ok := p.DataByName(offsetStr); ok {
-							operand.Value.(*IMemOperand).Addr = val.Address
-						} else {
-							panic("Unknown label: " + label)
-						}
-					})
-				}
-
-				rid, err := getRegisterID(registerName)
-				if err != nil {
-					panic("Invalid register for " + opName + ": " + registerName)
-				}
-				operand.Value = &IMemOperand{
-					Type:     Offset,
-					Addr:     uint32(offset),
-					Register: rid, // Implement this function to map register names to IDs
-				}
-			} else {
-				parsedValue, err := strconv.ParseUint(toParse, 0, 32)
-				if err != nil {
-					if toParse[0] == 'r' || toParse[0] == 'R' || toParse == "PC" || toParse == "SP" || toParse == "HP" {
-						rid, err := getRegisterID(toParse)
-						if err != nil {
-							operand.Value = &IMemOperand{Type: Address}
-							p.CurrentSector.PostParse = append(p.CurrentSector.PostParse, func() {
-								label := toParse
-								if val, ok := p.Labels[toParse]; ok {
-									operand.Value.(*IMemOperand).Addr = val
-								} else if val, ok := p.DataByName(toParse); ok {
-									operand.Value.(*IMemOperand).Addr = val.Address
-								} else {
-									panic("Unknown label: " + label)
-								}
-							})
-						} else {
-							operand.Value = &IMemOperand{Type: Register, Register: rid}
-						}
-					} else {
-						operand.Value = &IMemOperand{Type: Address}
-						p.CurrentSector.PostParse = append(p.CurrentSector.PostParse, func() {
-							label := toParse
-							if val, ok := p.Labels[toParse]; ok {
-								operand.Value.(*IMemOperand).Addr = val
-							} else if val, ok := p.DataByName(toParse); ok {
-								operand.Value.(*IMemOperand).Addr = val.Address
-							} else {
-								panic("Unknown label: " + label)
-							}
-						})
-					}
-				} else {
-					operand.Value = &IMemOperand{Type: Address, Addr: uint32(parsedValue)}
-				}
-			}
+			value := &IMemOperand{Type: memType, Register: register}
+			operand.Value, addr = value, &value.Addr
 		} else {
 			detectedType = DMem
-			toParse := strings.TrimSuffix(arg[1:], "]")
-
-			// Check if it's a register offset or just a raw address
-			if strings.Contains(toParse, "+") {
-				parts := strings.Split(toParse, "+")
-				registerName := strings.TrimSpace(parts[0])
-				offsetStr := strings.TrimSpace(parts[1])
-				offset, err := strconv.ParseUint(offsetStr, 0, 32)
-				if err != nil {
-					p.CurrentSector.PostParse = append(p.CurrentSector.PostParse, func() {
-						label := toParse
-						if val, ok := p.Labels[offsetStr]; ok {
-							operand.Value.(*DMemOperand).Addr = val
-						} else if val, ok := p.DataByName(offsetStr); ok {
-							operand.Value.(*DMemOperand).Addr = val.Address
-						} else {
-							panic("Unknown label: " + label)
-						}
-					})
-				}
-
-				rid, err := getRegisterID(registerName)
-				if err != nil {
-					panic("Invalid register for " + opName + ": " + registerName)
-				}
-				operand.Value = &DMemOperand{
-					Type:     Offset,
-					Addr:     uint32(offset),
-					Register: rid, // Implement this function to map register names to IDs
-				}
-			} else {
-				parsedValue, err := strconv.ParseUint(toParse, 0, 32)
-				if err != nil {
-					if toParse[0] == 'r' || toParse[0] == 'R' || toParse == "PC" || toParse == "SP" || toParse == "HP" {
-						rid, err := getRegisterID(toParse)
-						if err != nil {
-							operand.Value = &DMemOperand{Type: Address}
-							p.CurrentSector.PostParse = append(p.CurrentSector.PostParse, func() {
-								label := toParse
-								if val, ok := p.Labels[toParse]; ok {
-									operand.Value.(*DMemOperand).Addr = val
-								} else if val, ok := p.DataByName(toParse); ok {
-									operand.Value.(*DMemOperand).Addr = val.Address
-								} else {
-									panic("Unknown label: " + label)
-								}
-							})
-						} else {
-							operand.Value = &DMemOperand{Type: Register, Register: rid}
-						}
-					} else {
-						operand.Value = &DMemOperand{Type: Address}
-						p.CurrentSector.PostParse = append(p.CurrentSector.PostParse, func() {
-							label := toParse
-							if val, ok := p.Labels[toParse]; ok {
-								operand.Value.(*DMemOperand).Addr = val
-							} else if val, ok := p.DataByName(toParse); ok {
-								operand.Value.(*DMemOperand).Addr = val.Address
-							} else {
-								panic("Unknown label: " + label)
-							}
-						})
-					}
-				} else {
-					operand.Value = &DMemOperand{Type: Address, Addr: uint32(parsedValue)}
-				}
-			}
+			value := &DMemOperand{Type: memType, Register: register}
+			operand.Value, addr = value, &value.Addr
 		}
-	} else if arg[0] == 'r' || arg[0] == 'R' || arg == "PC" || arg == "SP" || arg == "HP" {
+		if expr != "" && !p.evalLater(expr, col, func(v uint32) { *addr = v }) {
+			return false
+		}
+	} else if rid, err := getRegisterID(arg); err == nil {
 		detectedType = Reg
-		if arg == "PC" {
-			operand.Value = &RegOperand{RegNum: 16, Size: 0}
-		} else if arg == "SP" {
-			operand.Value = &RegOperand{RegNum: 17, Size: 0}
-		} else if arg == "HP" {
-			operand.Value = &RegOperand{RegNum: 18, Size: 0}
-		} else {
-			id := strings.TrimSuffix(strings.TrimSuffix(arg[1:], "B"), "L")
-			parsedValue, err := strconv.ParseUint(id, 10, 32)
-			if err != nil {
-				panic(arg + " is not a valid register for " + opName + ": " + err.Error())
-			}
-			size := 0x0
+		size := 0x0
+		if arg[0] == 'r' || arg[0] == 'R' {
 			if strings.HasSuffix(arg, "B") {
 				size = 0x2
 			} else if strings.HasSuffix(arg, "L") {
 				size = 0x1
 			}
-			operand.Value = &RegOperand{RegNum: byte(parsedValue), Size: byte(size)}
 		}
+		operand.Value = &RegOperand{RegNum: rid, Size: byte(size)}
+	} else if errors.Is(err, errNoSuchRegister) {
+		p.errorf(col, "%v", err)
+		return false
 	} else {
 		detectedType = Imm
-		parsedValue, err := strconv.ParseUint(arg, 0, 32)
-		if err != nil {
-			operand.Value = &ImmOperand{}
-			p.CurrentSector.PostParse = append(p.CurrentSector.PostParse, func() {
-				if val, ok := p.Labels[arg]; ok {
-					operand.Value.(*ImmOperand).Value = val
-				} else if val, ok := p.DataByName(arg); ok {
-					operand.Value.(*ImmOperand).Value = val.Address
-				} else {
-					panic("Unknown label: " + arg)
-				}
-			})
+		value := &ImmOperand{}
+		operand.Value = value
+		if !p.evalLater(arg, col, func(v uint32) { value.Value = v }) {
+			return false
 		}
-		operand.Value = &ImmOperand{Value: uint32(parsedValue)}
 	}
 	if len(operand.AllowedTypes) > 0 {
 		if !slices.Contains(operand.AllowedTypes, detectedType) {
-			panic(arg + " is not an allowed type for " + opName)
+			p.errorf(col, "%s does not accept %s here", opName, detectedType)
+			return false
 		}
 		operand.Type = detectedType
 	} else {
 		if operand.Type != detectedType {
-			panic(arg + " is not a valid type for " + opName)
+			p.errorf(col, "%s expects %s here, not %s", opName, operand.Type, detectedType)
+			return false
 		}
 	}
+	return true
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parseFiles writes files into a temporary folder and adds the ones named in
+// add to a new parser, in order. includes are folders in the temporary folder
+// searched by INCLUDE and INCBIN.
+func parseFiles(t *testing.T, files map[string]string, includes []string, add ...string) *Parser {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := NewParser()
+	for _, include := range includes {
+		p.IncludePaths = append(p.IncludePaths, filepath.Join(dir, include))
+	}
+	for _, name := range add {
+		p.AddFile(filepath.Join(dir, name))
+	}
+	p.Parse()
+	// Make the paths in diagnostics relative to the temporary folder
+	prefix := dir + string(filepath.Separator)
+	for i := range p.Diagnostics {
+		d := &p.Diagnostics[i]
+		d.File = strings.TrimPrefix(d.File, prefix)
+		d.Message = strings.ReplaceAll(d.Message, prefix, "")
+		d.notes = append([]string(nil), d.notes...)
+		for j, note := range d.notes {
+			d.notes[j] = strings.ReplaceAll(note, prefix, "")
+		}
+	}
+	return p
+}
+
+// diagnostics returns the diagnostics of a parser as strings.
+func diagnostics(p *Parser) []string {
+	var diags []string
+	for _, d := range p.Diagnostics {
+		diags = append(diags, d.String())
+	}
+	return diags
+}
+
+func TestParseMemoryOperand(t *testing.T) {
+	tests := []struct {
+		operand string
+		want    string
+	}{
+		{operand: "[R2]"},
+		{operand: "[R2+4]"},
+		{operand: "[R2 + 4]"},
+		{operand: "[R2-4]"},
+		{operand: "[R2 - 4]"},
+		{operand: "[0x100]"},
+		{operand: "[[R2+4]]"},
+		{operand: "[R2+]", want: "test.asm:2:11: error: expected an offset after +"},
+		{operand: "[R2 + ]", want: "test.asm:2:11: error: expected an offset after +"},
+		{operand: "[R2-]", want: "test.asm:2:11: error: expected an offset after -"},
+		{operand: "[[R2+]]", want: "test.asm:2:11: error: expected an offset after +"},
+		{operand: "[R2*4]", want: "test.asm:2:11: error: only + or - can follow the register in R2*4"},
+		{operand: "[ ]", want: "test.asm:2:11: error: missing address"},
+	}
+	for _, tt := range tests {
+		p := parseFiles(t, map[string]string{
+			"test.asm": ".TEXT\n    LD R1 " + tt.operand + "\n",
+		}, nil, "test.asm")
+		got := strings.Join(diagnostics(p), "\n")
+		if got != tt.want {
+			t.Errorf("LD R1 %s: got diagnostics %q, want %q", tt.operand, got, tt.want)
+		}
+	}
+}
+
+func TestParseLabel(t *testing.T) {
+	tests := []struct {
+		label string
+		want  string
+	}{
+		{label: "loop:"},
+		{label: ".next:"},
+		{label: "print.loop:"},
+		{label: "_done@1:"},
+		{label: ":", want: `test.asm:3:5: error: invalid label name ""`},
+		{label: ".:", want: `test.asm:3:5: error: invalid label name "."`},
+		{label: "1loop:", want: `test.asm:3:5: error: invalid label name "1loop"`},
+		{label: ".1:", want: `test.asm:3:5: error: invalid label name ".1"`},
+		{label: "my label:", want: `test.asm:3:5: error: invalid label name "my label"`},
+		{label: "a-b:", want: `test.asm:3:5: error: invalid label name "a-b"`},
+	}
+	for _, tt := range tests {
+		p := parseFiles(t, map[string]string{
+			"test.asm": ".TEXT\nmain:\n    " + tt.label + "\n    HLT\n",
+		}, nil, "test.asm")
+		got := strings.Join(diagnostics(p), "\n")
+		if got != tt.want {
+			t.Errorf("%s: got diagnostics %q, want %q", tt.label, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import "fmt"
+
+type TaskState int
+
+const (
+	TaskRunnable TaskState = iota
+	TaskWaiting
+	TaskExited
+)
+
+func (s TaskState) String() string {
+	switch s {
+	case TaskRunnable:
+		return "run"
+	case TaskWaiting:
+		return "wait"
+	case TaskExited:
+		return "exit"
+	}
+	return "?"
+}
+
+// Task holds the saved context of a task that is not currently running. The
+// running task's context lives directly in the CPU. Only the registers and the
+// stack belong to a task; the page table, the heap and loaded programs are
+// shared by all tasks.
+type Task struct {
+	ID                  uint32
+	State               TaskState
+	Registers           [20]uint32
+	InterruptProcessing bool
+	OriginalPC          uint32
+	StackEnd            uint32
+	Slot                uint32
+	WaitingOn           uint32
+	ExitCode            uint32
+}
+
+type Scheduler struct {
+	cpu       *CPU
+	Tasks     []*Task
+	Current   *Task
+	NextID    uint32
+	TimeSlice uint32
+	StackTop  uint32
+	ticks     uint32
+}
+
+func NewScheduler(cpu *CPU) *Scheduler {
+	s := &Scheduler{
+		cpu:       cpu,
+		Tasks:     []*Task{},
+		TimeSlice: 100,
+		StackTop:  cpu.MemoryManager.VirtualStackEnd,
+	}
+
+	main := &Task{
+		ID:       0,
+		State:    TaskRunnable,
+		StackEnd: s.StackTop,
+	}
+	s.Tasks = append(s.Tasks, main)
+	s.Current = main
+	s.NextID = 1
+
+	return s
+}
+
+func (s *Scheduler) Task(id uint32) *Task {
+	for _, t := range s.Tasks {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) freeSlot() uint32 {
+	for slot := uint32(1); ; slot++ {
+		used := false
+		for _, t := range s.Tasks {
+			if t.State != TaskExited && t.Slot == slot {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return slot
+		}
+	}
+}
+
+// Spawn creates a new runnable task starting at entry and returns its ID. Each
+// task gets its own stack region below the stacks of the other tasks, while
+// code and heap are shared.
+func (s *Scheduler) Spawn(entry uint32) uint32 {
+	slot := s.freeSlot()
+	task := &Task{
+		ID:       s.NextID,
+		State:    TaskRunnable,
+		StackEnd: s.StackTop - slot*s.regionSize(),
+		Slot:     slot,
+	}
+	s.NextID++
+
+	task.Registers[16] = entry
+	task.Registers[17] = task.StackEnd
+	s.Tasks = append(s.Tasks, task)
+
+	return task.ID
+}
+
+// regionSize is the amount of address space reserved for each task's stack,
+// including its guard page.
+func (s *Scheduler) regionSize() uint32 {
+	return s.cpu.MemoryManager.StackSize + PageSize
+}
+
+// StackFloor returns the lowest address used by any task's stack region. The
+// heap may not grow past it.
+func (s *Scheduler) StackFloor() uint32 {
+	var maxSlot uint32
+	for _, t := range s.Tasks {
+		if t.State != TaskExited && t.Slot > maxSlot {
+			maxSlot = t.Slot
+		}
+	}
+	return s.StackTop - (maxSlot+1)*s.regionSize()
+}
+
+// Tick is called after every executed instruction and preempts the running
+// task once its time slice is used up.
+func (s *Scheduler) Tick() {
+	s.ticks++
+	if s.TimeSlice == 0 || s.ticks < s.TimeSlice {
+		return
+	}
+	if s.cpu.InterruptPending || s.cpu.InterruptProcessing {
+		return
+	}
+	s.Yield()
+}
+
+func (s *Scheduler) Yield() {
+	s.ticks = 0
+	if next := s.next(); next != nil {
+		s.switchTo(next)
+	}
+}
+
+// Exit ends the running task with the value of R0 as its exit code. The task
+// is kept as a zombie holding the exit code until another task waits on it.
+func (s *Scheduler) Exit() {
+	current := s.Current
+	current.State = TaskExited
+	current.ExitCode = s.cpu.Registers[0]
+	waited := false
+	for _, t := range s.Tasks {
+		if t.State == TaskWaiting && t.WaitingOn == current.ID {
+			t.State = TaskRunnable
+			t.Registers[0] = current.ExitCode
+			waited = true
+		}
+	}
+
+	next := s.next()
+	if next == nil {
+		s.cpu.Halted = true
+		return
+	}
+	s.switchTo(next)
+	s.releaseStack(current)
+	if waited {
+		s.remove(current)
+	}
+}
+
+// Wait blocks the running task until the task with the given ID exits, and
+// reaps it. R15 is set to 0 on success and R0 to the exit code of the task, or
+// R15 is set to 0xFFFFFFFF if there is no such task.
+func (s *Scheduler) Wait(id uint32) {
+	target := s.Task(id)
+	if target == nil || target == s.Current {
+		s.cpu.Registers[0xF] = 0xFFFFFFFF
+		return
+	}
+	s.cpu.Registers[0xF] = 0x0
+	if target.State == TaskExited {
+		s.cpu.Registers[0] = target.ExitCode
+		s.remove(target)
+		return
+	}
+
+	s.Current.State = TaskWaiting
+	s.Current.WaitingOn = id
+
+	next := s.next()
+	if next == nil {
+		s.cpu.Halted = true
+		return
+	}
+	s.switchTo(next)
+}
+
+func (s *Scheduler) next() *Task {
+	start := 0
+	for i, t := range s.Tasks {
+		if t == s.Current {
+			start = i
+			break
+		}
+	}
+	for i := 1; i < len(s.Tasks); i++ {
+		t := s.Tasks[(start+i)%len(s.Tasks)]
+		if t.State == TaskRunnable {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) switchTo(next *Task) {
+	s.ticks = 0
+	if next == s.Current {
+		return
+	}
+	c := s.cpu
+	prev := s.Current
+
+	prev.Registers = c.Registers
+	prev.InterruptProcessing = c.InterruptProcessing
+	prev.OriginalPC = c.OriginalPC
+
+	// The heap is shared between all tasks, so the heap pointer is carried over
+	heapPtr := c.Registers[18]
+	c.Registers = next.Registers
+	c.Registers[18] = heapPtr
+	c.InterruptProcessing = next.InterruptProcessing
+	c.OriginalPC = next.OriginalPC
+	c.MemoryManager.VirtualStackEnd = next.StackEnd
+
+	s.Current = next
+}
+
+func (s *Scheduler) remove(task *Task) {
+	for i, t := range s.Tasks {
+		if t == task {
+			s.Tasks = append(s.Tasks[:i], s.Tasks[i+1:]...)
+			break
+		}
+	}
+}
+
+// releaseStack unmaps the stack of an exited task.
+func (s *Scheduler) releaseStack(task *Task) {
+	for addr := task.Registers[17] &^ (PageSize - 1); addr < task.StackEnd; addr += PageSize {
+		s.cpu.MemoryManager.UnmapPage(addr)
+	}
+}
+
+func (s *Scheduler) Describe() string {
+	var text string
+	for _, t := range s.Tasks {
+		marker := " "
+		pc, sp := t.Registers[16], t.Registers[17]
+		if t == s.Current {
+			marker = ">"
+			pc, sp = s.cpu.Registers[16], s.cpu.Registers[17]
+		}
+		text += fmt.Sprintf("%s%3d %-4s PC: %08x SP: %08x\n", marker, t.ID, t.State, pc, sp)
+	}
+	return text
+}
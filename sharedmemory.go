@@ -0,0 +1,105 @@
+package main
+
+import "fmt"
+
+// SharedMemory is a named set of physical frames that can be mapped into the
+// address space any number of times. The object itself holds a reference to
+// each of its frames, so they stay allocated while nothing has them mapped.
+type SharedMemory struct {
+	Handle   uint32
+	Name     string
+	Size     uint32
+	Frames   []uint32
+	Unlinked bool
+}
+
+// OpenSharedMemory returns the shared memory object with the given name,
+// creating it with the given size if it does not exist yet.
+func (mm *MemoryManager) OpenSharedMemory(name string, size uint32) (*SharedMemory, error) {
+	for _, shm := range mm.SharedMemory {
+		if !shm.Unlinked && shm.Name == name {
+			if size > shm.Size {
+				return nil, fmt.Errorf("shared memory object is smaller than requested: %w", ErrInvalid)
+			}
+			return shm, nil
+		}
+	}
+
+	if size == 0 {
+		return nil, fmt.Errorf("cannot create an empty shared memory object: %w", ErrInvalid)
+	}
+
+	shm := &SharedMemory{
+		Handle: uint32(len(mm.SharedMemory)),
+		Name:   name,
+		Size:   size,
+	}
+
+	for i := uint32(0); i < (size+PageSize-1)/PageSize; i++ {
+		frame, err := mm.AllocateFrame()
+		if err != nil {
+			for _, f := range shm.Frames {
+				mm.FreeFrame(f)
+			}
+			return nil, err
+		}
+		for offset := uint32(0); offset < PageSize; offset++ {
+			mm.Memory.Write(frame*PageSize+offset, 0)
+		}
+		shm.Frames = append(shm.Frames, frame)
+	}
+
+	mm.SharedMemory = append(mm.SharedMemory, shm)
+	return shm, nil
+}
+
+// MapSharedMemory maps the frames of a shared memory object into the address
+// space and returns the address of the mapping.
+func (mm *MemoryManager) MapSharedMemory(handle uint32) (uint32, error) {
+	shm, err := mm.sharedMemory(handle)
+	if err != nil {
+		return 0, err
+	}
+
+	startAddr, err := mm.reserve(shm.Size)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, frame := range shm.Frames {
+		mm.RetainFrame(frame)
+		mm.mapPage(startAddr/PageSize+uint32(i), frame)
+	}
+
+	mm.Mappings = append(mm.Mappings, &MemoryMapping{
+		Start:  startAddr,
+		Length: shm.Size,
+		Shared: shm,
+		Dirty:  make(map[uint32]bool),
+	})
+
+	return startAddr, nil
+}
+
+func (mm *MemoryManager) sharedMemory(handle uint32) (*SharedMemory, error) {
+	if handle >= uint32(len(mm.SharedMemory)) || mm.SharedMemory[handle].Unlinked {
+		return nil, fmt.Errorf("shared memory object not found: %w", ErrInvalid)
+	}
+	return mm.SharedMemory[handle], nil
+}
+
+// UnlinkSharedMemory removes the name of a shared memory object and drops the
+// object's own reference to its frames. Existing mappings keep working, and
+// the frames are freed once the last of them is removed.
+func (mm *MemoryManager) UnlinkSharedMemory(handle uint32) error {
+	shm, err := mm.sharedMemory(handle)
+	if err != nil {
+		return err
+	}
+	for _, frame := range shm.Frames {
+		mm.FreeFrame(frame)
+	}
+	shm.Frames = nil
+	shm.Unlinked = true
+	return nil
+}
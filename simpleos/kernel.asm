@@ -22,3 +22,5 @@ _start:
   CALL [R2]
 
   HLT
+
+INCLUDE "std.asm"
@@ -4,10 +4,10 @@ print:
 print_loop:
   LD R0B [R1]
   CMP R0B 0
-  JEQ [return]
+  JEQ [.return]
   ST [R2 + 0xFFFFF000] R0B
   ADD R1 1
   ADD R2 1
   JMP [print_loop]
-return:
+.return:
   RET
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	SnapshotMagic   uint32 = 0x736E6170
+	SnapshotVersion uint32 = 6
+)
+
+var ErrGuestMounts = errors.New("filesystems mounted by the guest cannot be saved")
+
+// NamedFile is implemented by VFS files that know the path they were opened
+// with, so they can be reopened when a snapshot is restored.
+type NamedFile interface {
+	FileName() string
+}
+
+type snapshot struct {
+	Registers              [20]uint32
+	Halted                 bool
+	Fault                  string
+	LastAccessedAddress    uint32
+	LastInstructionAddress uint32
+	InterruptPending       bool
+	InterruptProcessing    bool
+	OriginalPC             uint32
+	InterruptVector        uint32
+	InterruptData          uint32
+	Interrupts             []Interrupt
+
+	Tasks         []Task
+	CurrentTask   uint32
+	NextTaskID    uint32
+	TimeSlice     uint32
+	StackTop      uint32
+	SchedulerTick uint32
+
+	PageTable        map[uint32]uint32
+	FreeFrames       []uint32
+	FrameRefs        map[uint32]uint32
+	Frames           map[uint32][]byte
+	Programs         map[uint32]*ProgramInfo
+	ProgramCount     uint32
+	Mappings         []snapshotMapping
+	SharedMemory     []*SharedMemory
+	Allocations      map[uint32]*Allocation
+	PeakPages        int
+	VirtualStackEnd  uint32
+	VirtualHeapStart uint32
+	StackSize        uint32
+
+	ROM  map[uint32][]byte
+	IVT  []byte
+	VRAM []byte
+
+	Files         map[uint32]snapshotFile
+	FileLimit     uint32
+	ConsoleCursor uint32
+
+	AsyncResults map[uint32]AsyncResult
+	NextAsyncID  uint32
+
+	Mounts []string
+}
+
+// snapshotFile is either a file to reopen, the console, or another
+// descriptor of a file stored under a lower descriptor.
+type snapshotFile struct {
+	Path    string
+	Offset  int64
+	Console bool
+	Alias   bool
+	Of      uint32
+}
+
+type snapshotMapping struct {
+	Start  uint32
+	Length uint32
+	FD     uint32
+	Shared int
+	Dirty  map[uint32]bool
+}
+
+// Snapshot writes the complete state of the machine to w. Open files are
+// stored by path and offset and are reopened from the VFS on restore.
+func (c *CPU) Snapshot(w io.Writer) error {
+	if c.AsyncIO.Outstanding() > 0 {
+		return ErrAsyncInProgress
+	}
+	mm := c.MemoryManager
+	s := snapshot{
+		Registers:              c.Registers,
+		Halted:                 c.Halted,
+		LastAccessedAddress:    c.LastAccessedAddress,
+		LastInstructionAddress: c.LastInstructionAddress,
+		InterruptPending:       c.InterruptPending,
+		InterruptProcessing:    c.InterruptProcessing,
+		OriginalPC:             c.OriginalPC,
+		InterruptVector:        c.InterruptVector,
+		InterruptData:          c.InterruptData,
+		Interrupts:             c.queuedInterrupts(),
+
+		CurrentTask:   c.Scheduler.Current.ID,
+		NextTaskID:    c.Scheduler.NextID,
+		TimeSlice:     c.Scheduler.TimeSlice,
+		StackTop:      c.Scheduler.StackTop,
+		SchedulerTick: c.Scheduler.ticks,
+
+		PageTable:        mm.PageTable,
+		FreeFrames:       mm.FreeFrames,
+		FrameRefs:        mm.FrameRefs,
+		Frames:           make(map[uint32][]byte),
+		Programs:         make(map[uint32]*ProgramInfo),
+		ProgramCount:     uint32(len(mm.Programs)),
+		SharedMemory:     mm.SharedMemory,
+		Allocations:      mm.Allocations,
+		PeakPages:        mm.PeakPages,
+		VirtualStackEnd:  mm.VirtualStackEnd,
+		VirtualHeapStart: mm.VirtualHeapStart,
+		StackSize:        mm.StackSize,
+
+		ROM:  make(map[uint32][]byte),
+		IVT:  mm.Memory.ReadN(IVTStart, IVTEnd-IVTStart+1),
+		VRAM: mm.Memory.ReadN(VRAMStart, VRAMEnd-VRAMStart+1),
+
+		FileLimit:     c.FileTable.Limit,
+		ConsoleCursor: c.Console.Cursor,
+
+		AsyncResults: c.AsyncIO.Results,
+		NextAsyncID:  c.AsyncIO.NextID,
+	}
+	if c.Fault != nil {
+		s.Fault = c.Fault.Error()
+	}
+
+	for _, t := range c.Scheduler.Tasks {
+		s.Tasks = append(s.Tasks, *t)
+	}
+
+	// Unloaded programs leave holes in the handles, which gob cannot encode,
+	// so only the loaded ones are stored along with the number of handles
+	for handle, p := range mm.Programs {
+		if p != nil {
+			s.Programs[uint32(handle)] = p
+		}
+	}
+
+	for frame := range mm.FrameRefs {
+		s.Frames[frame] = mm.Memory.ReadN(frame*PageSize, PageSize)
+	}
+
+	for _, num := range mm.Memory.ROM.UsedPages() {
+		s.ROM[num], _ = mm.Memory.ROM.Page(num)
+	}
+
+	mounts, err := c.mountPaths(true)
+	if err != nil {
+		return err
+	}
+	s.Mounts = mounts
+
+	files, fds, err := c.openFiles()
+	if err != nil {
+		return err
+	}
+	s.Files = files
+
+	for _, mapping := range mm.Mappings {
+		sm := snapshotMapping{
+			Start:  mapping.Start,
+			Length: mapping.Length,
+			Shared: -1,
+			Dirty:  mapping.Dirty,
+		}
+		if mapping.Shared != nil {
+			sm.Shared = int(mapping.Shared.Handle)
+		} else {
+			sm.FD = fds[mapping.File]
+		}
+		s.Mappings = append(s.Mappings, sm)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, SnapshotMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, SnapshotVersion); err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(&s)
+}
+
+// Restore replaces the state of the machine with a snapshot read from r. The
+// VFS has to be set up the same way as when the snapshot was taken, including
+// its mount table.
+func (c *CPU) Restore(r io.Reader) error {
+	var magic, version uint32
+	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil {
+		return err
+	}
+	if magic != SnapshotMagic {
+		return errors.New("invalid snapshot magic number")
+	}
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return err
+	}
+	if version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	var s snapshot
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+
+	mounts, err := c.mountPaths(false)
+	if err != nil {
+		return err
+	}
+	if strings.Join(mounts, "\x00") != strings.Join(s.Mounts, "\x00") {
+		return fmt.Errorf("mounts %v do not match the snapshot %v", mounts, s.Mounts)
+	}
+
+	if err := checkStackSize(s.StackSize); err != nil {
+		return err
+	}
+	for handle := range s.Programs {
+		if handle >= s.ProgramCount {
+			return fmt.Errorf("program handle %d is out of range", handle)
+		}
+	}
+
+	console := &Console{cpu: c, Cursor: s.ConsoleCursor}
+	files, err := c.reopenFiles(s.Files, s.FileLimit, console)
+	if err != nil {
+		return err
+	}
+	for _, sm := range s.Mappings {
+		if sm.Shared >= len(s.SharedMemory) {
+			err = fmt.Errorf("mapping at %08x refers to a missing shared memory object", sm.Start)
+		} else if f := files.Files[sm.FD]; sm.Shared < 0 && (f == nil || f.File == nil) {
+			err = fmt.Errorf("mapping at %08x refers to a missing file descriptor %d", sm.Start, sm.FD)
+		}
+		if err != nil {
+			files.CloseAll()
+			return err
+		}
+	}
+
+	c.Reset()
+
+	c.Registers = s.Registers
+	c.Halted = s.Halted
+	if s.Fault != "" {
+		c.Fault = errors.New(s.Fault)
+	}
+	c.LastAccessedAddress = s.LastAccessedAddress
+	c.LastInstructionAddress = s.LastInstructionAddress
+	c.InterruptPending = s.InterruptPending
+	c.InterruptProcessing = s.InterruptProcessing
+	c.OriginalPC = s.OriginalPC
+	c.InterruptVector = s.InterruptVector
+	c.InterruptData = s.InterruptData
+	c.interruptMu.Lock()
+	c.Interrupts = s.Interrupts
+	c.interruptMu.Unlock()
+	c.FileTable.CloseAll()
+	c.FileTable = files
+	c.Console = console
+	if s.AsyncResults != nil {
+		c.AsyncIO.Results = s.AsyncResults
+	}
+	c.AsyncIO.NextID = s.NextAsyncID
+
+	mm := c.MemoryManager
+	mm.PageTable = s.PageTable
+	mm.FreeFrames = s.FreeFrames
+	mm.FrameRefs = s.FrameRefs
+	mm.Programs = make([]*ProgramInfo, s.ProgramCount)
+	for handle, p := range s.Programs {
+		mm.Programs[handle] = p
+	}
+	mm.SharedMemory = s.SharedMemory
+	mm.Allocations = s.Allocations
+	mm.PeakPages = s.PeakPages
+	mm.VirtualStackEnd = s.VirtualStackEnd
+	mm.VirtualHeapStart = s.VirtualHeapStart
+	mm.StackSize = s.StackSize
+	if mm.PageTable == nil {
+		mm.PageTable = make(map[uint32]uint32)
+	}
+	if mm.FrameRefs == nil {
+		mm.FrameRefs = make(map[uint32]uint32)
+	}
+	if mm.Allocations == nil {
+		mm.Allocations = make(map[uint32]*Allocation)
+	}
+
+	for frame, data := range s.Frames {
+		for i, b := range data {
+			mm.Memory.Write(frame*PageSize+uint32(i), b)
+		}
+	}
+	for page, data := range s.ROM {
+		mm.Memory.LoadProgram(ROMStart+page*PageSize, data)
+	}
+	mm.Memory.LoadProgram(VRAMStart, s.VRAM)
+	for i, b := range s.IVT {
+		mm.Memory.Write(IVTStart+uint32(i), b)
+	}
+
+	for _, sm := range s.Mappings {
+		mapping := &MemoryMapping{
+			Start:  sm.Start,
+			Length: sm.Length,
+			Dirty:  sm.Dirty,
+		}
+		if mapping.Dirty == nil {
+			mapping.Dirty = make(map[uint32]bool)
+		}
+		if sm.Shared >= 0 {
+			mapping.Shared = mm.SharedMemory[sm.Shared]
+		} else {
+			mapping.FS = files.Files[sm.FD].FS
+			mapping.File = files.Files[sm.FD].File
+		}
+		mm.Mappings = append(mm.Mappings, mapping)
+	}
+
+	sched := c.Scheduler
+	sched.Tasks = []*Task{}
+	for i := range s.Tasks {
+		task := s.Tasks[i]
+		sched.Tasks = append(sched.Tasks, &task)
+		if task.ID == s.CurrentTask {
+			sched.Current = &task
+		}
+	}
+	sched.NextID = s.NextTaskID
+	sched.TimeSlice = s.TimeSlice
+	sched.StackTop = s.StackTop
+	sched.ticks = s.SchedulerTick
+
+	return nil
+}
+
+// openFiles returns the path and offset of every open file, along with a map
+// from each file back to its lowest descriptor.
+func (c *CPU) openFiles() (map[uint32]snapshotFile, map[interface{}]uint32, error) {
+	files := make(map[uint32]snapshotFile)
+	fds := make(map[interface{}]uint32)
+	seen := make(map[*OpenFile]uint32)
+	for _, fd := range c.FileTable.FDs() {
+		f := c.FileTable.Files[fd]
+		if first, ok := seen[f]; ok {
+			files[fd] = snapshotFile{Alias: true, Of: first}
+			continue
+		}
+		seen[f] = fd
+		if f.FS == c.Console {
+			files[fd] = snapshotFile{Console: true}
+			continue
+		}
+		named, ok := f.File.(NamedFile)
+		if !ok {
+			return nil, nil, fmt.Errorf("cannot reopen file descriptor %d", fd)
+		}
+		offset, err := f.FS.Seek(f.File, 0, io.SeekCurrent)
+		if err != nil {
+			return nil, nil, err
+		}
+		files[fd] = snapshotFile{Path: named.FileName(), Offset: offset}
+		fds[f.File] = fd
+	}
+	return files, fds, nil
+}
+
+// reopenFiles opens every file again at its saved offset and builds a new
+// file table from them. If any of them fails, the ones that were already
+// opened are closed again.
+func (c *CPU) reopenFiles(files map[uint32]snapshotFile, limit uint32, console *Console) (*FileTable, error) {
+	table := NewFileTable(limit)
+	var aliases []uint32
+	for fd, sf := range files {
+		switch {
+		case sf.Alias:
+			aliases = append(aliases, fd)
+			continue
+		case sf.Console:
+			table.Files[fd] = &OpenFile{FS: console, refs: 1}
+			continue
+		}
+		file, err := c.FileSystem.Open(sf.Path)
+		if err == nil {
+			_, err = c.FileSystem.Seek(file, sf.Offset, io.SeekStart)
+		}
+		if err != nil {
+			table.CloseAll()
+			return nil, fmt.Errorf("cannot reopen %s: %w", sf.Path, err)
+		}
+		table.Files[fd] = &OpenFile{FS: c.FileSystem, File: file, refs: 1}
+	}
+	for _, fd := range aliases {
+		f, ok := table.Files[files[fd].Of]
+		if !ok {
+			table.CloseAll()
+			return nil, fmt.Errorf("file descriptor %d refers to a missing descriptor", fd)
+		}
+		f.refs++
+		table.Files[fd] = f
+	}
+	return table, nil
+}
+
+// mountPaths returns the mount points of the VFS in the order they were
+// mounted. If saving is set, mounts made by the guest are refused, since the
+// contents of the filesystems themselves are not part of a snapshot.
+func (c *CPU) mountPaths(saving bool) ([]string, error) {
+	mounts, ok := FindMountVFS(c.FileSystem)
+	if !ok {
+		return nil, nil
+	}
+	mounts.mu.Lock()
+	defer mounts.mu.Unlock()
+	var paths []string
+	for _, m := range mounts.Mounts {
+		if saving && m.Guest {
+			return nil, fmt.Errorf("%s: %w", m.Path, ErrGuestMounts)
+		}
+		paths = append(paths, m.Path)
+	}
+	return paths, nil
+}
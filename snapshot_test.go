@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSnapshotAfterUnload(t *testing.T) {
+	c := newUnloadCPU(t)
+	var buf bytes.Buffer
+	if err := c.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewCPU()
+	r.FileSystem = c.FileSystem
+	if err := r.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if r.Registers != c.Registers {
+		t.Errorf("registers are %v after restoring, want %v", r.Registers, c.Registers)
+	}
+
+	tests := []struct {
+		handle uint32
+		loaded bool
+	}{
+		{0, true},
+		{1, false},
+		{2, true},
+		{3, false},
+	}
+	for _, tt := range tests {
+		want, _ := c.MemoryManager.Program(tt.handle)
+		got, err := r.MemoryManager.Program(tt.handle)
+		if (err == nil) != tt.loaded {
+			t.Errorf("program %d: got error %v, want loaded = %v", tt.handle, err, tt.loaded)
+			continue
+		}
+		if tt.loaded && (got.Handle != tt.handle || got.BaseAddress != want.BaseAddress || got.Size != want.Size) {
+			t.Errorf("program %d is %+v after restoring, want %+v", tt.handle, got, want)
+		}
+	}
+
+	// New programs get the next handle, as they would have before
+	if p := r.MemoryManager.NewProgram(); p.Handle != 3 {
+		t.Errorf("next program got handle %d, want 3", p.Handle)
+	}
+}
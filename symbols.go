@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scope holds the symbols of a file given to AddFile, including the files it
+// includes. Symbols are private to their scope, unless they are declared
+// GLOBAL. Other files can then use them after declaring them EXTERN.
+type Scope struct {
+	File   string
+	Labels map[string]uint32
+
+	constants map[string]*Constant
+	data      map[string]*Data
+	defined   map[string]position
+	globals   map[string]position
+	externs   map[string]position
+	// Files parsed into this scope, so each file is only included once per
+	// top-level file
+	included map[string]bool
+	// The last label that does not start with a dot, which local labels
+	// belong to
+	lastGlobal string
+}
+
+func newScope(file string) *Scope {
+	return &Scope{
+		File:      file,
+		Labels:    make(map[string]uint32),
+		constants: make(map[string]*Constant),
+		data:      make(map[string]*Data),
+		defined:   make(map[string]position),
+		globals:   make(map[string]position),
+		externs:   make(map[string]position),
+		included:  make(map[string]bool),
+	}
+}
+
+// qualify turns a local label like .loop into the name it is stored under,
+// like print.loop for a .loop following print.
+func (p *Parser) qualify(name string) string {
+	if strings.HasPrefix(name, ".") {
+		return p.scope.lastGlobal + name
+	}
+	return name
+}
+
+// define records a new symbol in the current scope, and reports an error if
+// it is already defined.
+func (p *Parser) define(name string, col int) bool {
+	if old, ok := p.scope.defined[name]; ok {
+		p.errorf(col, "%s is already defined at %s:%d", name, old.file, old.line)
+		return false
+	}
+	if _, ok := p.scope.externs[name]; ok {
+		p.errorf(col, "%s is declared EXTERN, but defined here", name)
+		return false
+	}
+	p.scope.defined[name] = p.pos(col)
+	return true
+}
+
+// inMacro tells whether the line being parsed comes from a macro.
+func (p *Parser) inMacro() bool {
+	for _, e := range p.expansions {
+		if e.name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDeclaration handles GLOBAL and EXTERN, which take a list of names.
+func (p *Parser) parseDeclaration(fields []field) {
+	keyword := fields[0].text
+	if len(fields) == 1 {
+		p.errorf(p.col(0), "%s expects at least 1 name", keyword)
+	}
+	for _, f := range fields[1:] {
+		col := p.col(f.offset)
+		if !isSymbol(f.text) || strings.HasPrefix(f.text, ".") {
+			p.errorf(col, "%s cannot be %s", f.text, keyword)
+			continue
+		}
+		if keyword == "GLOBAL" {
+			p.scope.globals[f.text] = p.pos(col)
+		} else if _, ok := p.scope.defined[f.text]; ok {
+			p.errorf(col, "%s is declared EXTERN, but defined in this file", f.text)
+		} else {
+			p.scope.externs[f.text] = p.pos(col)
+		}
+	}
+}
+
+// exportGlobals makes the symbols declared GLOBAL in the current scope
+// available to other files. It is called at the end of a file, once the
+// addresses of its data are known.
+func (p *Parser) exportGlobals() {
+	s := p.scope
+	for name, pos := range s.globals {
+		if other, ok := p.exportedBy[name]; ok {
+			p.report(pos, SeverityError, "%s is GLOBAL in both %s and %s", name, other, s.File)
+			continue
+		}
+		if v, ok := s.Labels[name]; ok {
+			p.Labels[name] = v
+		} else if c, ok := s.constants[name]; ok {
+			p.Constants[name] = c
+		} else if d, ok := s.data[name]; ok {
+			p.globalData[name] = d
+		} else {
+			p.report(pos, SeverityError, "%s is declared GLOBAL, but never defined", name)
+			continue
+		}
+		p.exportedBy[name] = s.File
+	}
+}
+
+// checkExterns reports EXTERN declarations that no file defines as GLOBAL.
+func (p *Parser) checkExterns() {
+	for _, s := range p.Scopes {
+		for name, pos := range s.externs {
+			if _, ok := p.exportedBy[name]; !ok {
+				p.report(pos, SeverityError, "%s is declared EXTERN, but no file declares it GLOBAL", name)
+			}
+		}
+	}
+}
+
+// lookup returns a function that finds symbols as seen from the line being
+// parsed, for expressions that are evaluated later.
+func (p *Parser) lookup() func(string) (uint32, error) {
+	s, lastGlobal := p.scope, p.scope.lastGlobal
+	return func(name string) (uint32, error) {
+		if strings.HasPrefix(name, ".") {
+			name = lastGlobal + name
+		}
+		return p.resolve(s, name)
+	}
+}
+
+// resolve returns the value of a symbol in a scope, looking at symbols of
+// other files only if the scope declares them EXTERN.
+func (p *Parser) resolve(s *Scope, name string) (uint32, error) {
+	if c, ok := s.constants[name]; ok {
+		return p.constantValue(c)
+	}
+	if v, ok := s.Labels[name]; ok {
+		return v, nil
+	}
+	if d, ok := s.data[name]; ok && (p.dataPlaced || s != p.scope) {
+		return d.Address, nil
+	}
+	if _, ok := s.externs[name]; ok {
+		if c, ok := p.Constants[name]; ok {
+			return p.constantValue(c)
+		}
+		if v, ok := p.Labels[name]; ok {
+			return v, nil
+		}
+		if d, ok := p.globalData[name]; ok {
+			return d.Address, nil
+		}
+	} else if file, ok := p.exportedBy[name]; ok {
+		return 0, fmt.Errorf("%w, it is GLOBAL in %s but not declared EXTERN here", &errUnknownSymbol{name: name}, file)
+	}
+	return 0, &errUnknownSymbol{name: name}
+}
+
+func (p *Parser) constantValue(c *Constant) (uint32, error) {
+	if p.evaluating[c] {
+		return 0, fmt.Errorf("constant %s is defined in terms of itself", c.Name)
+	}
+	p.evaluating[c] = true
+	defer delete(p.evaluating, c)
+	v, err := evalExpr(c.Expr, c.here, c.lookup)
+	if err != nil {
+		return 0, fmt.Errorf("in constant %s: %w", c.Name, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGlobalExtern(t *testing.T) {
+	// other.asm is added after main.asm and defines helper
+	const other = "GLOBAL helper\n.TEXT\nhelper:\n    RET\n"
+	tests := []struct {
+		name  string
+		files map[string]string
+		// diags are the expected diagnostics. If there are none, the symbols
+		// in shared have the same value in both files, and those in private
+		// a different one.
+		diags   []string
+		shared  []string
+		private []string
+	}{
+		{
+			name: "label",
+			files: map[string]string{
+				"main.asm":  "EXTERN helper\n.TEXT\n    CALL helper\n    HLT\n",
+				"other.asm": other,
+			},
+			shared: []string{"helper"},
+		},
+		{
+			name: "constant and data",
+			files: map[string]string{
+				"main.asm":  "EXTERN WIDTH, value\n.TEXT\n    LD R1 WIDTH\n    LD R2 [value]\n    HLT\n",
+				"other.asm": "GLOBAL WIDTH, value\nWIDTH EQU 40\n.DATA\n    value DD 7\n",
+			},
+			shared: []string{"WIDTH", "value"},
+		},
+		{
+			name: "header included by two files",
+			files: map[string]string{
+				"defs.inc":  "WIDTH EQU 40\nMACRO SET reg value\n    LD reg value\nENDM\n",
+				"main.asm":  "INCLUDE \"defs.inc\"\n.TEXT\n    SET R1 WIDTH\n    HLT\n",
+				"other.asm": "INCLUDE \"defs.inc\"\n.TEXT\n    SET R2 WIDTH*2\n    RET\n",
+			},
+			shared: []string{"WIDTH"},
+		},
+		{
+			name: "same private label in two files",
+			files: map[string]string{
+				"main.asm":  ".TEXT\nloop:\n    JMP loop\n",
+				"other.asm": ".TEXT\nloop:\n    JMP loop\n",
+			},
+			private: []string{"loop"},
+		},
+		{
+			name: "EXTERN without GLOBAL",
+			files: map[string]string{
+				"main.asm":  "EXTERN helper\n.TEXT\n    CALL helper\n    HLT\n",
+				"other.asm": ".TEXT\nhelper:\n    RET\n",
+			},
+			diags: []string{
+				"main.asm:1:8: error: helper is declared EXTERN, but no file declares it GLOBAL",
+				"main.asm:3:10: error: unknown symbol helper",
+			},
+		},
+		{
+			name: "GLOBAL without EXTERN",
+			files: map[string]string{
+				"main.asm":  ".TEXT\n    CALL helper\n    HLT\n",
+				"other.asm": other,
+			},
+			diags: []string{"main.asm:2:10: error: unknown symbol helper, it is GLOBAL in other.asm but not declared EXTERN here"},
+		},
+		{
+			name: "GLOBAL never defined",
+			files: map[string]string{
+				"main.asm":  ".TEXT\n    HLT\n",
+				"other.asm": "GLOBAL helper\n.TEXT\n    RET\n",
+			},
+			diags: []string{"other.asm:1:8: error: helper is declared GLOBAL, but never defined"},
+		},
+		{
+			name: "GLOBAL in two files",
+			files: map[string]string{
+				"main.asm":  "GLOBAL helper\n.TEXT\nhelper:\n    HLT\n",
+				"other.asm": other,
+			},
+			diags: []string{"other.asm:1:8: error: helper is GLOBAL in both main.asm and other.asm"},
+		},
+		{
+			name: "EXTERN and then defined",
+			files: map[string]string{
+				"main.asm":  "EXTERN helper\n.TEXT\nhelper:\n    HLT\n",
+				"other.asm": other,
+			},
+			diags: []string{"main.asm:3:1: error: helper is declared EXTERN, but defined here"},
+		},
+		{
+			name: "defined and then EXTERN",
+			files: map[string]string{
+				"main.asm":  ".TEXT\nhelper:\n    HLT\nEXTERN helper\n",
+				"other.asm": other,
+			},
+			diags: []string{"main.asm:4:8: error: helper is declared EXTERN, but defined in this file"},
+		},
+		{
+			name: "invalid names",
+			files: map[string]string{
+				"main.asm":  "GLOBAL .loop, 1a\nEXTERN\n.TEXT\n    HLT\n",
+				"other.asm": other,
+			},
+			diags: []string{
+				"main.asm:1:8: error: .loop cannot be GLOBAL",
+				"main.asm:1:15: error: 1a cannot be GLOBAL",
+				"main.asm:2:1: error: EXTERN expects at least 1 name",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := parseFiles(t, tt.files, nil, "main.asm", "other.asm")
+			if got := diagnostics(p); !slices.Equal(got, tt.diags) {
+				t.Fatalf("got diagnostics %q, want %q", got, tt.diags)
+			}
+			if tt.diags != nil {
+				return
+			}
+			first, second := p.Scopes[1], p.Scopes[2]
+			for _, name := range append(tt.shared, tt.private...) {
+				v1, err1 := p.resolve(first, name)
+				v2, err2 := p.resolve(second, name)
+				if err1 != nil || err2 != nil {
+					t.Errorf("resolving %s: %v, %v", name, err1, err2)
+				} else if shared := slices.Contains(tt.shared, name); (v1 == v2) != shared {
+					t.Errorf("%s is %#x in main.asm and %#x in other.asm, want shared = %v", name, v1, v2, shared)
+				}
+			}
+		})
+	}
+}
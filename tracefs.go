@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fault makes matching calls to a TracingVFS fail. Op is the name of the
+// call as it appears in the trace, or "*" for any call. Path is matched with
+// path.Match, an empty Path matches every file. If Nth is set, only the nth
+// matching call fails, otherwise all of them do. A short fault does not fail
+// the call, but only reads or writes half of the requested bytes.
+type Fault struct {
+	Op    string
+	Path  string
+	Nth   int
+	Err   error
+	Short bool
+	calls int
+}
+
+// ParseFault parses a fault given as <op>[:<path>][@<n>][=<error>], where the
+// error is the name of an error code like ENOSPC, or "short". Without an
+// error, EIO is used.
+//
+//	write:/log.txt@3=ENOSPC
+//	read:/data/*=short
+func ParseFault(spec string) (*Fault, error) {
+	f := &Fault{Err: ErrorForCode(EIO)}
+	spec, result, hasResult := strings.Cut(spec, "=")
+	if hasResult {
+		if result == "short" {
+			f.Short = true
+			f.Err = nil
+		} else {
+			found := false
+			for code, name := range ErrorNames {
+				if code != int(ENONE) && strings.EqualFold(name, result) {
+					f.Err = ErrorForCode(uint32(code))
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unknown error %q", result)
+			}
+		}
+	}
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		n, err := strconv.Atoi(spec[i+1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid call number %q", spec[i+1:])
+		}
+		f.Nth = n
+		spec = spec[:i]
+	}
+	f.Op, f.Path, _ = strings.Cut(spec, ":")
+	if f.Op == "" {
+		return nil, fmt.Errorf("missing operation in fault %q", spec)
+	}
+	if f.Path != "" {
+		f.Path = cleanPath(f.Path)
+		if _, err := path.Match(f.Path, "/"); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *Fault) matches(op string, name string) bool {
+	if f.Op != "*" && f.Op != op {
+		return false
+	}
+	if f.Path != "" {
+		if ok, _ := path.Match(f.Path, cleanPath(name)); !ok {
+			return false
+		}
+	}
+	f.calls++
+	return f.Nth == 0 || f.calls == f.Nth
+}
+
+// TracingVFS wraps another VFS, writing a line to Trace for every call and
+// making the calls described by Faults fail. Files are numbered in the order
+// they are opened, so calls on the same file can be told apart in the trace.
+type TracingVFS struct {
+	FS     VFS
+	Trace  io.Writer
+	Faults []*Fault
+
+	mu       sync.Mutex
+	calls    int
+	nextFile int
+}
+
+type tracedFile struct {
+	Name string
+	File interface{}
+	ID   int
+}
+
+func (f *tracedFile) FileName() string {
+	return f.Name
+}
+
+// Unwrap returns the VFS that is being traced.
+func (vfs *TracingVFS) Unwrap() VFS {
+	return vfs.FS
+}
+
+// fault returns the fault that applies to a call, if any.
+func (vfs *TracingVFS) fault(op string, name string) *Fault {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	var found *Fault
+	for _, f := range vfs.Faults {
+		if f.matches(op, name) && found == nil {
+			found = f
+		}
+	}
+	return found
+}
+
+func (vfs *TracingVFS) log(op string, args string, result string, err error, f *Fault) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	vfs.calls++
+	if vfs.Trace == nil {
+		return
+	}
+	line := fmt.Sprintf("%d %s %s", vfs.calls, op, args)
+	if result != "" {
+		line += " -> " + result
+	}
+	if err != nil {
+		line += fmt.Sprintf(" %s (%v)", ErrorNames[ErrorCode(err)], err)
+	}
+	if f != nil {
+		line += " [injected]"
+	}
+	fmt.Fprintln(vfs.Trace, line)
+}
+
+func (vfs *TracingVFS) wrap(name string, file interface{}) *tracedFile {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	vfs.nextFile++
+	return &tracedFile{Name: cleanPath(name), File: file, ID: vfs.nextFile}
+}
+
+// call runs a call that only takes a path.
+func (vfs *TracingVFS) call(op string, name string, fn func() error) error {
+	f := vfs.fault(op, name)
+	var err error
+	if f != nil && f.Err != nil {
+		err = f.Err
+	} else {
+		err = fn()
+	}
+	vfs.log(op, name, "", err, f)
+	return err
+}
+
+func (vfs *TracingVFS) open(op string, name string, fn func(string) (interface{}, error)) (interface{}, error) {
+	f := vfs.fault(op, name)
+	if f != nil && f.Err != nil {
+		vfs.log(op, name, "", f.Err, f)
+		return nil, f.Err
+	}
+	file, err := fn(name)
+	if err != nil {
+		vfs.log(op, name, "", err, nil)
+		return nil, err
+	}
+	tf := vfs.wrap(name, file)
+	vfs.log(op, name, fmt.Sprintf("#%d", tf.ID), nil, nil)
+	return tf, nil
+}
+
+func (vfs *TracingVFS) Open(name string) (interface{}, error) {
+	return vfs.open("open", name, vfs.FS.Open)
+}
+
+func (vfs *TracingVFS) Create(name string) (interface{}, error) {
+	return vfs.open("create", name, vfs.FS.Create)
+}
+
+func (vfs *TracingVFS) Close(file interface{}) error {
+	tf := file.(*tracedFile)
+	// Closing always closes the file, even if a failure is injected
+	err := vfs.FS.Close(tf.File)
+	f := vfs.fault("close", tf.Name)
+	if f != nil && f.Err != nil {
+		err = f.Err
+	}
+	vfs.log("close", fmt.Sprintf("%s #%d", tf.Name, tf.ID), "", err, f)
+	return err
+}
+
+func (vfs *TracingVFS) Remove(name string) error {
+	return vfs.call("remove", name, func() error { return vfs.FS.Remove(name) })
+}
+
+func (vfs *TracingVFS) Mkdir(name string) error {
+	return vfs.call("mkdir", name, func() error { return vfs.FS.Mkdir(name) })
+}
+
+func (vfs *TracingVFS) Rename(oldName string, newName string) error {
+	f := vfs.fault("rename", oldName)
+	var err error
+	if f != nil && f.Err != nil {
+		err = f.Err
+	} else {
+		err = vfs.FS.Rename(oldName, newName)
+	}
+	vfs.log("rename", oldName+" "+newName, "", err, f)
+	return err
+}
+
+func (vfs *TracingVFS) Stat(name string) (*FileInfo, error) {
+	var info *FileInfo
+	err := vfs.call("stat", name, func() error {
+		var err error
+		info, err = vfs.FS.Stat(name)
+		return err
+	})
+	return info, err
+}
+
+func (vfs *TracingVFS) ReadDir(name string) ([]*FileInfo, error) {
+	var entries []*FileInfo
+	err := vfs.call("readdir", name, func() error {
+		var err error
+		entries, err = vfs.FS.ReadDir(name)
+		return err
+	})
+	return entries, err
+}
+
+// transfer runs a read or write. A short fault halves the length, but always
+// leaves at least one byte.
+func (vfs *TracingVFS) transfer(op string, tf *tracedFile, b []byte, args string, fn func([]byte) (int, error)) (int, error) {
+	args = fmt.Sprintf("%s #%d len=%d%s", tf.Name, tf.ID, len(b), args)
+	f := vfs.fault(op, tf.Name)
+	if f != nil && f.Err != nil {
+		vfs.log(op, args, "n=0", f.Err, f)
+		return 0, f.Err
+	}
+	if f != nil && f.Short && len(b) > 1 {
+		b = b[:len(b)/2]
+	}
+	n, err := fn(b)
+	vfs.log(op, args, fmt.Sprintf("n=%d", n), err, f)
+	return n, err
+}
+
+func (vfs *TracingVFS) Read(file interface{}, b []byte) (int, error) {
+	tf := file.(*tracedFile)
+	return vfs.transfer("read", tf, b, "", func(b []byte) (int, error) { return vfs.FS.Read(tf.File, b) })
+}
+
+func (vfs *TracingVFS) Write(file interface{}, b []byte) (int, error) {
+	tf := file.(*tracedFile)
+	return vfs.transfer("write", tf, b, "", func(b []byte) (int, error) { return vfs.FS.Write(tf.File, b) })
+}
+
+func (vfs *TracingVFS) ReadAt(file interface{}, b []byte, off int64) (int, error) {
+	tf := file.(*tracedFile)
+	return vfs.transfer("readat", tf, b, fmt.Sprintf(" off=%d", off), func(b []byte) (int, error) { return vfs.FS.ReadAt(tf.File, b, off) })
+}
+
+func (vfs *TracingVFS) WriteAt(file interface{}, b []byte, off int64) (int, error) {
+	tf := file.(*tracedFile)
+	return vfs.transfer("writeat", tf, b, fmt.Sprintf(" off=%d", off), func(b []byte) (int, error) { return vfs.FS.WriteAt(tf.File, b, off) })
+}
+
+func (vfs *TracingVFS) Seek(file interface{}, off int64, whence int) (int64, error) {
+	tf := file.(*tracedFile)
+	args := fmt.Sprintf("%s #%d off=%d whence=%d", tf.Name, tf.ID, off, whence)
+	f := vfs.fault("seek", tf.Name)
+	if f != nil && f.Err != nil {
+		vfs.log("seek", args, "", f.Err, f)
+		return 0, f.Err
+	}
+	pos, err := vfs.FS.Seek(tf.File, off, whence)
+	vfs.log("seek", args, fmt.Sprintf("pos=%d", pos), err, nil)
+	return pos, err
+}
+
+func (vfs *TracingVFS) LoadBinary(file interface{}, mm *MemoryManager) (*ProgramInfo, error) {
+	tf := file.(*tracedFile)
+	args := fmt.Sprintf("%s #%d", tf.Name, tf.ID)
+	f := vfs.fault("loadbinary", tf.Name)
+	if f != nil && f.Err != nil {
+		vfs.log("loadbinary", args, "", f.Err, f)
+		return nil, f.Err
+	}
+	program, err := vfs.FS.LoadBinary(tf.File, mm)
+	result := ""
+	if err == nil {
+		result = fmt.Sprintf("start=%08x", program.StartAddress)
+	}
+	vfs.log("loadbinary", args, result, err, nil)
+	return program, err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseFault(t *testing.T) {
+	tests := []struct {
+		spec  string
+		op    string
+		path  string
+		nth   int
+		code  uint32
+		short bool
+		err   bool
+	}{
+		{spec: "write", op: "write", code: EIO},
+		{spec: "*", op: "*", code: EIO},
+		{spec: "open:/data.txt", op: "open", path: "/data.txt", code: EIO},
+		{spec: "open:data.txt", op: "open", path: "/data.txt", code: EIO},
+		{spec: "write:/log.txt@3=ENOSPC", op: "write", path: "/log.txt", nth: 3, code: ENOSPC},
+		{spec: "read:/data/*=short", op: "read", path: "/data/*", short: true},
+		{spec: "stat@2=enoent", op: "stat", nth: 2, code: ENOENT},
+		{spec: "open:/a@b.txt@2", op: "open", path: "/a@b.txt", nth: 2, code: EIO},
+		{spec: "", err: true},
+		{spec: ":/data.txt", err: true},
+		{spec: "write@0", err: true},
+		{spec: "write@x", err: true},
+		{spec: "write=ENONE", err: true},
+		{spec: "write=EWHAT", err: true},
+		{spec: "open:/[", err: true},
+	}
+	for _, tt := range tests {
+		f, err := ParseFault(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseFault(%q): expected an error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseFault(%q): %v", tt.spec, err)
+			continue
+		}
+		if f.Op != tt.op || f.Path != tt.path || f.Nth != tt.nth || f.Short != tt.short {
+			t.Errorf("ParseFault(%q) = %+v, want op %q, path %q, nth %d, short %v", tt.spec, f, tt.op, tt.path, tt.nth, tt.short)
+		}
+		if tt.short {
+			if f.Err != nil {
+				t.Errorf("ParseFault(%q): short fault has error %v", tt.spec, f.Err)
+			}
+		} else if f.Err == nil || ErrorCode(f.Err) != tt.code {
+			t.Errorf("ParseFault(%q): error %v, want %s", tt.spec, f.Err, ErrorNames[tt.code])
+		}
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	tests := []struct {
+		name   string
+		faults []string
+		file   string
+		// results holds the expected result of five writes of 4 bytes, the
+		// number of bytes written or the name of the error
+		results  []string
+		injected int
+	}{
+		{"no faults", nil, "/log.txt", []string{"4", "4", "4", "4", "4"}, 0},
+		{"every call", []string{"write"}, "/log.txt", []string{"EIO", "EIO", "EIO", "EIO", "EIO"}, 5},
+		{"third call", []string{"write:/log.txt@3=ENOSPC"}, "/log.txt", []string{"4", "4", "ENOSPC", "4", "4"}, 1},
+		{"other file", []string{"write:/log.txt@3=ENOSPC"}, "/other.txt", []string{"4", "4", "4", "4", "4"}, 0},
+		// Creating the file is the first call matching *
+		{"any call", []string{"*:/*.txt@2"}, "/log.txt", []string{"EIO", "4", "4", "4", "4"}, 1},
+		{"short", []string{"write=short"}, "/log.txt", []string{"2", "2", "2", "2", "2"}, 5},
+		{"first match wins", []string{"write@2=EACCES", "write@2=ENOSPC", "write@4=ENOSPC"}, "/log.txt", []string{"4", "EACCES", "4", "ENOSPC", "4"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var trace strings.Builder
+			vfs := &TracingVFS{FS: NewMemoryVFS(), Trace: &trace}
+			for _, spec := range tt.faults {
+				f, err := ParseFault(spec)
+				if err != nil {
+					t.Fatal(err)
+				}
+				vfs.Faults = append(vfs.Faults, f)
+			}
+			file, err := vfs.Create(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tt.results {
+				n, err := vfs.Write(file, []byte("data"))
+				got := strconv.Itoa(n)
+				if err != nil {
+					got = ErrorNames[ErrorCode(err)]
+				}
+				if got != want {
+					t.Errorf("write %d: got %s, want %s", i+1, got, want)
+				}
+			}
+			if injected := strings.Count(trace.String(), "[injected]"); injected != tt.injected {
+				t.Errorf("trace marks %d calls as injected, want %d:\n%s", injected, tt.injected, trace.String())
+			}
+		})
+	}
+}